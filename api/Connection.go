@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nps5696/go-ninja/bus"
@@ -31,27 +32,51 @@ type Connection struct {
 	rpc       *rpc.Client
 	rpcServer *rpc.Server
 	services  []model.ServiceAnnouncement
+	acl       *bus.ACL
+
+	// rpc clients for services using codecs other than json2, created as they are first needed
+	rpcClientsMutex sync.Mutex
+	rpcClients      map[string]*rpc.Client
 }
 
-// Connect Builds a new ninja connection to the MQTT broker, using the given client ID
-func Connect(clientID string) (*Connection, error) {
+// Connect Builds a new ninja connection to the MQTT broker, using the given client ID. Every message
+// published or received through the connection passes through the interceptors, if any are given.
+func Connect(clientID string, interceptors ...bus.Interceptor) (*Connection, error) {
 
 	log := logger.GetLogger(fmt.Sprintf("%s.connection", clientID))
 
 	conn := Connection{
-		log:      log,
-		services: []model.ServiceAnnouncement{},
+		log:        log,
+		services:   []model.ServiceAnnouncement{},
+		rpcClients: make(map[string]*rpc.Client),
 	}
 
-	mqttURL := fmt.Sprintf("%s:%d", config.MustString("mqtt", "host"), config.MustInt("mqtt", "port"))
+	// mqtt.host may also be a URL (ws://, wss:// or unix://), which includes the port if it needs one
+	mqttURL := config.MustString("mqtt", "host")
+	if !strings.Contains(mqttURL, "://") {
+		mqttURL = fmt.Sprintf("%s:%d", mqttURL, config.MustInt("mqtt", "port"))
+	}
 
 	log.Infof("Connecting to %s using cid:%s", mqttURL, clientID)
 
-	conn.mqtt = bus.MustConnect(mqttURL, clientID)
+	// what we may publish and subscribe to is limited by the mqtt.acl config, and the acl in the
+	// package.json of the app or driver we export. Replies to our rpc calls go to our own topic,
+	// which no other module should be reading.
+	conn.acl = bus.NewACL(bus.ACLFromConfig())
+	conn.acl.Grant(fmt.Sprintf("$rpc/%s/#", clientID))
+
+	conn.mqtt = bus.Restrict(bus.MustConnect(mqttURL, clientID), conn.acl)
+	if len(interceptors) > 0 {
+		conn.mqtt = bus.Intercept(conn.mqtt, interceptors...)
+	}
 
 	log.Infof("Connected")
 
 	conn.rpc = rpc.NewClient(conn.mqtt, json2.NewClientCodec())
+	conn.rpc.Caller = clientID
+	// older services only ever reply on <topic>/reply
+	conn.rpc.ReplyInbox = config.Bool(false, "rpc", "replyInbox")
+	conn.rpc.Inbox = fmt.Sprintf("$rpc/%s/reply", clientID)
 	conn.rpcServer = rpc.NewServer(conn.mqtt, json2.NewCodec())
 
 	// Add service discovery service. Responds to queries about services exposed in this process.
@@ -86,14 +111,56 @@ type rpcMessage struct {
 // specified in the topic string.
 func (c *Connection) Subscribe(topic string, callback interface{}) (*bus.Subscription, error) {
 	log.Println("Subscribing to " + topic)
-	return c.subscribe(true, topic, callback)
+	return c.subscribe(readRPCParams, topic, callback)
 }
 
 func (c *Connection) SubscribeRaw(topic string, callback interface{}) (*bus.Subscription, error) {
-	return c.subscribe(false, topic, callback)
+	return c.subscribe(readRawParams, topic, callback)
+}
+
+// paramsDecoder decodes the parameters a callback is given into the value it wants
+type paramsDecoder func(v interface{}) error
+
+// paramsReader reads the parameters a callback is given from a message's payload
+type paramsReader func(payload []byte) (paramsDecoder, error)
+
+// jsonParams decodes JSON encoded parameters
+func jsonParams(params json.RawMessage) paramsDecoder {
+	return func(v interface{}) error {
+		return json.Unmarshal(params, v)
+	}
+}
+
+// readRPCParams reads the params of a json-rpc notification
+func readRPCParams(payload []byte) (paramsDecoder, error) {
+	msg := &rpcMessage{}
+	if err := json.Unmarshal(payload, msg); err != nil {
+		return nil, err
+	}
+
+	var params json.RawMessage
+	err := json2.ReadRPCParams(msg.Params, &params)
+	return jsonParams(params), err
+}
+
+// readNotificationParams returns a reader of the params of notifications from services using a
+// codec other than json2, which decodes them straight into the value the callback wants
+func readNotificationParams(codec rpc.CodecProvider) paramsReader {
+	return func(payload []byte) (paramsDecoder, error) {
+		return func(v interface{}) error {
+			return codec.ReadNotification(payload, v)
+		}, nil
+	}
+}
+
+// readRawParams reads a plain JSON payload
+func readRawParams(payload []byte) (paramsDecoder, error) {
+	var params json.RawMessage
+	err := json.Unmarshal(payload, &params)
+	return jsonParams(params), err
 }
 
-func (c *Connection) subscribe(rpc bool, topic string, callback interface{}) (*bus.Subscription, error) {
+func (c *Connection) subscribe(read paramsReader, topic string, callback interface{}) (*bus.Subscription, error) {
 
 	adapter, err := getAdapter(c.log, callback)
 	if err != nil {
@@ -101,12 +168,19 @@ func (c *Connection) subscribe(rpc bool, topic string, callback interface{}) (*b
 		return nil, err
 	}
 
-	finished := false
+	// Messages may be delivered before Subscribe returns, so the subscription is only cancelled once
+	// we have it. Until then, done stops any more reaching the callback.
+	var (
+		lock sync.Mutex
+		sub  *bus.Subscription
+		done bool
+	)
 
-	var sub *bus.Subscription
-	sub, err = c.mqtt.Subscribe(GetSubscribeTopic(topic), func(incomingTopic string, payload []byte) {
+	s, err := c.mqtt.Subscribe(GetSubscribeTopic(topic), func(incomingTopic string, payload []byte) {
 
-		// TODO: Implement unsubscribing. For now, it will just skip over any subscriptions that have finished
+		lock.Lock()
+		finished := done
+		lock.Unlock()
 		if finished {
 			return
 		}
@@ -118,40 +192,41 @@ func (c *Connection) subscribe(rpc bool, topic string, callback interface{}) (*b
 			values = &p
 		}
 
-		var params json.RawMessage
-
-		if rpc {
-			msg := &rpcMessage{}
-			err := json.Unmarshal(payload, msg)
-
-			if err != nil {
-				c.log.Warningf("Failed to read parameters in rpc call to %s - %v", incomingTopic, err)
-				return
-			}
-
-			json2.ReadRPCParams(msg.Params, &params)
-			if err != nil {
-				c.log.Warningf("Failed to read parameters in rpc call to %s - %v", incomingTopic, err)
-				return
-			}
-		} else {
-			err := json.Unmarshal(payload, &params)
-
-			if err != nil {
-				c.log.Warningf("Failed to read parameters in call to %s - %v", incomingTopic, err)
-				return
-			}
+		params, err := read(payload)
+		if err != nil {
+			c.log.Warningf("Failed to read parameters in call to %s - %v", incomingTopic, err)
+			return
 		}
 
-		if !adapter(&params, *values) {
+		if !adapter(params, *values) {
 			// The callback has returned false, indicating that it does not want to receive any more messages,
-			// so we can cancel the subscription.
-			sub.Cancel()
+			// so we can cancel the subscription. No more messages are delivered once it returns.
+			lock.Lock()
+			done = true
+			subscription := sub
+			lock.Unlock()
+
+			if subscription != nil {
+				subscription.Cancel()
+			}
 		}
 
 	})
 
-	return sub, err
+	if err != nil {
+		return nil, err
+	}
+
+	lock.Lock()
+	sub = s
+	finished := done
+	lock.Unlock()
+
+	if finished {
+		s.Cancel()
+	}
+
+	return s, nil
 }
 
 // GetServiceClient returns an RPC client for the given service.
@@ -167,6 +242,7 @@ func (c *Connection) GetServiceClientFromAnnouncement(announcement model.Service
 	client := &ServiceClient{
 		conn:  c,
 		Topic: announcement.Topic,
+		Codec: announcement.Codec,
 	}
 
 	if announcement.SupportedEvents != nil {
@@ -189,6 +265,9 @@ func (c *Connection) ExportApp(app App) error {
 	topic := fmt.Sprintf("$node/%s/app/%s", config.Serial(), app.GetModuleInfo().ID)
 
 	announcement := app.GetModuleInfo()
+	if announcement.ACL != nil {
+		c.acl.Add(*announcement.ACL)
+	}
 
 	announcement.ServiceAnnouncement = model.ServiceAnnouncement{
 		Schema: "http://schema.ninjablocks.com/service/app",
@@ -218,6 +297,9 @@ func (c *Connection) ExportDriver(driver Driver) error {
 	topic := fmt.Sprintf("$node/%s/driver/%s", config.Serial(), driver.GetModuleInfo().ID)
 
 	announcement := driver.GetModuleInfo()
+	if announcement.ACL != nil {
+		c.acl.Add(*announcement.ACL)
+	}
 
 	announcement.ServiceAnnouncement = model.ServiceAnnouncement{
 		Schema: "http://schema.ninjablocks.com/service/driver",
@@ -331,12 +413,71 @@ type serviceAnnouncement interface {
 	GetServiceAnnouncement() *model.ServiceAnnouncement
 }
 
+type rpcOptionsService interface {
+	GetRPCOptions() rpc.ServiceOptions
+}
+
+// serverCodec returns the codec for a service announcing the given one, or nil for the server's own.
+// Codecs other than json2 must have been registered, by importing their package.
+func serverCodec(name string) (rpc.Codec, error) {
+	if name == "" || name == json2.Name {
+		return nil, nil
+	}
+	if codec, ok := rpc.LookupCodec(name); ok {
+		return codec.NewCodec(), nil
+	}
+	return nil, fmt.Errorf("Unknown rpc codec '%s'", name)
+}
+
+// rpcClient returns the rpc client for calling services that use the named codec
+func (c *Connection) rpcClient(codec string) *rpc.Client {
+	if codec == "" || codec == json2.Name {
+		return c.rpc
+	}
+
+	c.rpcClientsMutex.Lock()
+	defer c.rpcClientsMutex.Unlock()
+
+	if client, ok := c.rpcClients[codec]; ok {
+		return client
+	}
+
+	provider, ok := rpc.LookupCodec(codec)
+	if !ok {
+		c.log.Warningf("Unknown rpc codec '%s', using %s", codec, json2.Name)
+		return c.rpc
+	}
+
+	client := rpc.NewClient(c.mqtt, provider.NewClientCodec())
+
+	client.Caller = c.rpc.Caller
+	client.ReplyInbox = c.rpc.ReplyInbox
+	client.Inbox = fmt.Sprintf("$rpc/%s/%s/reply", c.rpc.Caller, codec)
+	c.rpcClients[codec] = client
+	return client
+}
+
 // exportService Exports an RPC service, and announces it over TOPIC/event/announce
 func (c *Connection) exportService(service interface{}, topic string, announcement serviceAnnouncement) (*rpc.ExportedService, error) {
 
 	announcement.GetServiceAnnouncement().Schema = resolveSchemaURI(announcement.GetServiceAnnouncement().Schema)
 
-	exportedService, err := c.rpcServer.RegisterService(service, topic, announcement.GetServiceAnnouncement().Schema)
+	// a module may always use the topics of its own services (and so its own devices and channels)
+	c.acl.Grant(topic + "/#")
+
+	options := rpc.ServiceOptions{}
+	if service, ok := service.(rpcOptionsService); ok {
+		options = service.GetRPCOptions()
+	}
+
+	// the announced codec is the one callers will use
+	codec, err := serverCodec(announcement.GetServiceAnnouncement().Codec)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to register service on %s : %s", topic, err)
+	}
+	options.Codec = codec
+
+	exportedService, err := c.rpcServer.RegisterServiceWithOptions(service, topic, announcement.GetServiceAnnouncement().Schema, options)
 
 	if err != nil {
 		return nil, fmt.Errorf("Failed to register service on %s : %s", topic, err)
@@ -455,8 +596,7 @@ type adapter struct {
 	argType  reflect.Type
 }
 
-func (a *adapter) invoke(params *json.RawMessage, values map[string]string) bool {
-	// self.log.Debugf("invoke: params=%s, values=%v", string(*params), values)
+func (a *adapter) invoke(params paramsDecoder, values map[string]string) bool {
 	var args []reflect.Value = make([]reflect.Value, a.argCount)
 
 	switch a.argCount {
@@ -465,9 +605,9 @@ func (a *adapter) invoke(params *json.RawMessage, values map[string]string) bool
 		fallthrough
 	case 1:
 		arg := reflect.New(a.argType.Elem())
-		err := json.Unmarshal(*params, arg.Interface())
+		err := params(arg.Interface())
 		if err != nil {
-			a.log.Errorf("failed to unmarshal %s as %v because %v", string(*params), arg, err)
+			a.log.Errorf("failed to unmarshal params as %v because %v", a.argType, err)
 			return true
 		}
 		args[0] = arg
@@ -476,14 +616,22 @@ func (a *adapter) invoke(params *json.RawMessage, values map[string]string) bool
 	return a.function.Call(args)[0].Interface().(bool)
 }
 
-func getAdapter(log *logger.Logger, callback interface{}) (func(params *json.RawMessage, values map[string]string) bool, error) {
+func getAdapter(log *logger.Logger, callback interface{}) (func(params paramsDecoder, values map[string]string) bool, error) {
 	var err error = nil
 
 	value := reflect.ValueOf(callback)
 	valueType := value.Type()
 
 	if valueType == reflect.ValueOf(dummyRawCallback).Type() {
-		return callback.(func(params *json.RawMessage, values map[string]string) bool), nil
+		raw := callback.(func(params *json.RawMessage, values map[string]string) bool)
+		return func(params paramsDecoder, values map[string]string) bool {
+			var message json.RawMessage
+			if err := params(&message); err != nil {
+				log.Errorf("failed to read params because %v", err)
+				return true
+			}
+			return raw(&message, values)
+		}, nil
 	}
 
 	kind := value.Kind()
@@ -1,10 +1,13 @@
 package ninja
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/nps5696/go-ninja/bus"
+	"github.com/nps5696/go-ninja/rpc"
+	"github.com/nps5696/go-ninja/rpc/json2"
 )
 
 type ServiceClient struct {
@@ -12,6 +15,14 @@ type ServiceClient struct {
 	Topic            string
 	SupportedEvents  []string
 	SupportedMethods []string
+
+	// Codec is the rpc codec the service announced, e.g. "cbor". Empty means json2. Other codecs
+	// must have been registered, by importing their package (e.g. rpc/cbor).
+	Codec string
+
+	// Retry, if set, is how Call tries again when a call times out or the service is busy. Every
+	// attempt carries the same idempotency key, so the service only acts on the call once.
+	Retry *rpc.RetryPolicy
 }
 
 //
@@ -30,17 +41,77 @@ type ServiceClient struct {
 // Both the params and topicKeys parameters can be omitted. If the topicKeys parameter is required, the params parameter must also be specified.
 //
 func (c *ServiceClient) OnEvent(event string, callback interface{}) (*bus.Subscription, error) {
+	if codec, ok := c.codec(); ok {
+		return c.conn.subscribe(readNotificationParams(codec), c.Topic+"/event/"+event, callback)
+	}
 	return c.conn.Subscribe(c.Topic+"/event/"+event, callback)
 }
 
+// codec returns the service's codec, if it isn't json2 and has been registered
+func (c *ServiceClient) codec() (rpc.CodecProvider, bool) {
+	if c.Codec == "" || c.Codec == json2.Name {
+		return rpc.CodecProvider{}, false
+	}
+	return rpc.LookupCodec(c.Codec)
+}
+
+// client returns the rpc client for the service's codec
+func (c *ServiceClient) client() *rpc.Client {
+	return c.conn.rpcClient(c.Codec)
+}
+
 func (c *ServiceClient) Call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	if timeout > 0 && c.Retry != nil {
+		return c.client().CallWithRetry(c.Topic, method, args, reply, timeout, *c.Retry)
+	}
+
 	if timeout > 0 {
-		return c.conn.rpc.CallWithTimeout(c.Topic, method, args, reply, timeout)
+		return c.client().CallWithTimeout(c.Topic, method, args, reply, timeout)
 	}
 
 	if reply != nil {
 		return fmt.Errorf("Attempted async call to method %s on service %s with a non-nil reply", method, c.Topic)
 	}
 
-	return c.conn.rpc.Call(c.Topic, method, args)
+	return c.client().Call(c.Topic, method, args)
+}
+
+// CallContext calls a method, waiting for the reply until the context is done. The context's
+// deadline is passed on to the service, which may give up at the same time.
+func (c *ServiceClient) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	return c.client().CallContext(ctx, c.Topic, method, args, reply)
+}
+
+// CallWithProgress calls a long running method, waiting for the reply until the context is done.
+// Updates on its progress are given to the callback as they arrive, which must be a function as for
+// OnEvent, e.g. func(update *YourProgressType) bool. It returns false to ignore further updates.
+func (c *ServiceClient) CallWithProgress(ctx context.Context, method string, args interface{}, reply interface{}, callback interface{}) error {
+	adapter, err := getAdapter(c.conn.log, callback)
+	if err != nil {
+		return fmt.Errorf("Incompatible progress callback for method %s on service %s: %s", method, c.Topic, err)
+	}
+
+	codec, ok := c.codec()
+
+	listening := true
+	return c.client().CallWithProgress(ctx, c.Topic, method, args, reply, func(update []byte) {
+		if !listening {
+			return
+		}
+
+		params := jsonParams(update)
+		if ok {
+			// decoded straight into the value the callback wants
+			params = func(v interface{}) error {
+				return codec.Unmarshal(update, v)
+			}
+		}
+		listening = adapter(params, map[string]string{})
+	})
+}
+
+// CallBatch calls several methods in one message, waiting for all the replies until the context is
+// done. See rpc.Client.CallBatch.
+func (c *ServiceClient) CallBatch(ctx context.Context, calls []*rpc.Call) error {
+	return c.client().CallBatch(ctx, c.Topic, calls)
 }
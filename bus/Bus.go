@@ -1,7 +1,11 @@
 package bus
 
 import (
+	"fmt"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/nps5696/go-ninja/config"
 	"github.com/nps5696/go-ninja/logger"
@@ -11,46 +15,227 @@ var log = logger.GetLogger("bus")
 
 type Bus interface {
 	Publish(topic string, payload []byte)
+	PublishWithOptions(topic string, payload []byte, options PublishOptions) error
 	Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error)
+	SubscribeWithOptions(topic string, options SubscribeOptions, callback func(topic string, payload []byte)) (*Subscription, error)
+	ClearRetained(topic string) error
 	OnDisconnect(cb func())
 	OnConnect(cb func())
 	Connected() bool
 	Destroy()
 }
 
-func MustConnect(host, id string) Bus {
-	//return ConnectTinyBus(host, id)
+// QoS is the MQTT quality of service a message is delivered with
+type QoS byte
+
+const (
+	// AtMostOnce messages are sent once, and are lost if the connection drops
+	AtMostOnce QoS = iota
+	// AtLeastOnce messages are resent until they are acknowledged, so may arrive more than once
+	AtLeastOnce
+	// ExactlyOnce messages are delivered once, using a two step acknowledgement
+	ExactlyOnce
+)
+
+type PublishOptions struct {
+	QoS QoS
+	// Retain asks the broker to keep the message, and give it to anyone who subscribes later
+	Retain bool
+	// Properties are sent with the message by buses that speak MQTT 5, and ignored by the others
+	Properties *Properties
+}
+
+// Properties are the MQTT 5 properties of a message that we make use of
+type Properties struct {
+	// ResponseTopic is where the receiver of a request should publish its response
+	ResponseTopic string
+	// CorrelationData is sent back with a response, to match it to its request
+	CorrelationData []byte
+	// UserProperties are application defined, e.g. trace ids or the identity of the caller
+	UserProperties map[string]string
+}
+
+// PropertiesBus is implemented by buses that carry MQTT 5 message properties
+type PropertiesBus interface {
+	Bus
+	SubscribeWithProperties(topic string, options SubscribeOptions, callback func(topic string, payload []byte, properties *Properties)) (*Subscription, error)
+}
+
+type SubscribeOptions struct {
+	QoS QoS
+	// ReplayRetained delivers the retained messages the bus already knows of that match the
+	// topic to the callback before SubscribeWithOptions returns
+	ReplayRetained bool
+	// QueueSize is the number of messages that may wait for the callback before the Overflow policy
+	// applies. Zero uses the bus's default, less than zero means no limit.
+	QueueSize int
+	// Overflow decides what happens to messages that arrive while the queue is full. Empty uses the
+	// bus's default.
+	Overflow OverflowPolicy
+}
+
+// Factory connects a bus implementation to the broker at host, using the given client id
+type Factory func(host, id string) (Bus, error)
+
+var (
+	implementations     = make(map[string]Factory)
+	implementationsLock sync.Mutex
+)
+
+// Register makes a bus implementation available to MustConnect, which uses the one named by the
+// mqtt.implementation config. It panics if the name is already taken.
+func Register(name string, factory Factory) {
+	implementationsLock.Lock()
+	defer implementationsLock.Unlock()
+
+	if _, ok := implementations[name]; ok {
+		panic("bus: Register called twice for implementation " + name)
+	}
+	implementations[name] = factory
+}
+
+// Implementations returns the names of the registered bus implementations
+func Implementations() []string {
+	implementationsLock.Lock()
+	defer implementationsLock.Unlock()
+
+	var names []string
+	for name := range implementations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
+func MustConnect(host, id string) Bus {
 	library := config.String("tiny", "mqtt.implementation")
 
 	log.Infof("Using mqtt bus implementation: %s", library)
 
-	var bus Bus
-	var err error
+	implementationsLock.Lock()
+	factory, ok := implementations[library]
+	implementationsLock.Unlock()
 
-	switch library {
-	case "tiny":
-		bus, err = ConnectTinyBus(host, id)
-	default:
-		log.Fatalf("Unknown mqtt bus implementation: %s", library)
+	if !ok {
+		log.Fatalf("Unknown mqtt bus implementation: %s (available: %s)", library, strings.Join(Implementations(), ", "))
 	}
 
+	bus, err := factory(host, id)
+
 	if err != nil {
 		log.HandleError(err, "Failed to connect to mqtt")
 	}
+
+	// mqtt.record names a file to append a recording of the bus traffic to, for Replay
+	if file := config.String("", "mqtt", "record"); file != "" && bus != nil {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.HandleError(err, "Failed to open mqtt recording")
+		} else {
+			log.Infof("Recording mqtt traffic to %s", file)
+			bus = Record(bus, f)
+		}
+	}
+
 	return bus
 }
 
+// willTopic is where the broker announces that a module has lost its connection, and connectedTopic
+// where the module announces that it has connected. Existing consumers watch each of them as they
+// are, so they differ.
+func willTopic(id string) string {
+	return fmt.Sprintf("$node/%s/module/%s/state/connected", config.Serial(), id)
+}
+
+func connectedTopic(id string) string {
+	return fmt.Sprintf("node/%s/module/%s/state/connected", config.Serial(), id)
+}
+
 type message struct {
-	topic   string
-	payload []byte
+	topic      string
+	payload    []byte
+	properties *Properties
+	// qos is the QoS the message was delivered at
+	qos QoS
+	// retained is true if the message was retained, i.e. it is the broker's copy of the topic's value
+	retained bool
 }
 
 type Subscription struct {
 	topic     string
-	c         chan *message
+	qos       QoS
+	queue     *deliveryQueue
 	Cancel    func()
 	cancelled bool
+	done      chan bool
+	replayed  map[string]string
+}
+
+// run hands the subscription's messages to deliver until it is cancelled, starting with any given
+// initial messages. No messages are delivered once done has been closed.
+func (s *Subscription) run(initial []*message, deliver func(m *message)) {
+	for _, m := range initial {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		deliver(m)
+		s.queue.countDelivered()
+	}
+
+	for {
+		m, ok := s.queue.pop(s.done)
+		if !ok {
+			return
+		}
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		deliver(m)
+		s.queue.countDelivered()
+	}
+}
+
+// stop stops delivery to the subscription
+func (s *Subscription) stop() {
+	s.cancelled = true
+	close(s.done)
+}
+
+// push queues a message for the subscription's callback
+func (s *Subscription) push(m *message) {
+	s.queue.push(m, s.done)
+}
+
+// Stats returns the counts of messages delivered to and dropped by the subscription
+func (s *Subscription) Stats() SubscriptionStats {
+	return s.queue.stats()
+}
+
+// replay synchronously delivers cached retained messages to a new subscription, remembering them so
+// the copies the broker sends afterwards aren't delivered twice.
+func (s *Subscription) replay(messages []*message, callback func(m *message)) {
+	s.replayed = make(map[string]string)
+	for _, m := range messages {
+		s.replayed[m.topic] = string(m.payload)
+		callback(m)
+		s.queue.countDelivered()
+	}
+}
+
+// isReplayed returns true if a retained message from the broker was already replayed from the cache
+func (s *Subscription) isReplayed(m *message) bool {
+	if !m.retained {
+		return false
+	}
+	if payload, ok := s.replayed[m.topic]; ok {
+		delete(s.replayed, m.topic)
+		return payload == string(m.payload)
+	}
+	return false
 }
 
 func matches(subscription string, topic string) bool {
@@ -87,27 +272,47 @@ func matches(subscription string, topic string) bool {
 
 type baseBus struct {
 	destroyed          bool
+	lock               sync.Mutex
 	connectionStatus   bool
 	disconnectHandlers []func()
 	connectHandlers    []func()
 }
 
 func (b *baseBus) OnDisconnect(cb func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 	b.disconnectHandlers = append(b.disconnectHandlers, cb)
 }
 
 func (b *baseBus) OnConnect(cb func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 	b.connectHandlers = append(b.connectHandlers, cb)
 }
 
 func (b *baseBus) Connected() bool {
-	if b.destroyed {
-		return false
-	}
-	return b.connectionStatus
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return !b.destroyed && b.connectionStatus
+}
+
+// isDestroyed returns true once the bus has been destroyed
+func (b *baseBus) isDestroyed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.destroyed
+}
+
+// markDestroyed records that the bus has been destroyed, so the connection handlers aren't called again
+func (b *baseBus) markDestroyed() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.destroyed = true
 }
 
 func (b *baseBus) disconnected() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 	if b.destroyed {
 		return
 	}
@@ -118,10 +323,11 @@ func (b *baseBus) disconnected() {
 }
 
 func (b *baseBus) connected() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 	if b.destroyed {
 		return
 	}
-
 	b.connectionStatus = true
 	for _, cb := range b.connectHandlers {
 		go cb()
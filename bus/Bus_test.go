@@ -28,3 +28,29 @@ func TestSimplePubSub(t *testing.T) {
 	}
 
 }
+
+func TestRegister(t *testing.T) {
+	Register("TestRegister", func(host, id string) (Bus, error) {
+		return ConnectMemoryBus(host, id)
+	})
+	defer func() {
+		implementationsLock.Lock()
+		delete(implementations, "TestRegister")
+		implementationsLock.Unlock()
+	}()
+
+	found := false
+	for _, name := range Implementations() {
+		found = found || name == "TestRegister"
+	}
+	if !found {
+		t.Fatalf("Expected TestRegister in %v", Implementations())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering the same name twice to panic")
+		}
+	}()
+	Register("TestRegister", nil)
+}
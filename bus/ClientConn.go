@@ -0,0 +1,265 @@
+package bus
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// ackTimeout is how long to wait for the broker to acknowledge a CONNECT, SUBSCRIBE or UNSUBSCRIBE
+var ackTimeout = time.Second * 10
+
+// packet is a message in either version of the protocol
+type packet interface {
+	Encode(w io.Writer) error
+}
+
+type packetKind int
+
+const (
+	otherPacket packetKind = iota
+	connAckPacket
+	ackPacket
+	pongPacket
+)
+
+// wire is a version of the MQTT protocol spoken over a clientConn
+type wire interface {
+	read(r io.Reader) (packet, error)
+	// kind says how the connection should treat a packet, giving the message id of acknowledgements
+	kind(p packet) (packetKind, uint16)
+	// refused returns an error if a CONNACK refuses the connection
+	refused(connack packet) error
+	pingReq() packet
+}
+
+// clientConn is a single connection to an MQTT broker. It reads messages from the broker, handing
+// acknowledgements to whoever is waiting for them and everything else to the handler.
+//
+// It replaces the ninjasphere/mqtt client, which ignores the acknowledgement flows needed for QoS 1
+// and 2 delivery.
+type clientConn struct {
+	net.Conn
+	wire      wire
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	connack   chan packet
+	pong      chan bool
+	acks      map[uint16]chan packet
+	handler   func(msg packet)
+	done      chan bool
+	closeOnce sync.Once
+}
+
+// backoff returns how long to wait after the given number of consecutive failures to connect. The
+// delay doubles with each failure up to max, and is jittered so that modules that lost the broker
+// at the same time don't all come back at once.
+func backoff(min, max time.Duration, failures int) time.Duration {
+	delay := min
+	for i := 0; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+func newClientConn(conn net.Conn, handler func(msg packet)) *clientConn {
+	return newClientConnWithWire(conn, mqtt3{}, handler)
+}
+
+func newClientConnWithWire(conn net.Conn, wire wire, handler func(msg packet)) *clientConn {
+	c := &clientConn{
+		Conn:    conn,
+		wire:    wire,
+		connack: make(chan packet, 1),
+		pong:    make(chan bool, 1),
+		acks:    make(map[uint16]chan packet),
+		handler: handler,
+		done:    make(chan bool),
+	}
+
+	go c.reader()
+
+	return c
+}
+
+// connect sends the CONNECT message and waits for the broker to accept it
+func (c *clientConn) connect(msg packet) error {
+	if err := c.send(msg); err != nil {
+		return err
+	}
+
+	select {
+	case ack := <-c.connack:
+		return c.wire.refused(ack)
+	case <-c.done:
+		return fmt.Errorf("Connection closed before CONNACK")
+	case <-time.After(ackTimeout):
+		return fmt.Errorf("Timed out waiting for CONNACK")
+	}
+}
+
+// request sends a SUBSCRIBE or UNSUBSCRIBE with the given message id, and waits for its acknowledgement
+func (c *clientConn) request(msg packet, id uint16) (packet, error) {
+	ack := make(chan packet, 1)
+
+	c.lock.Lock()
+	c.acks[id] = ack
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.acks, id)
+		c.lock.Unlock()
+	}()
+
+	if err := c.send(msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-ack:
+		return reply, nil
+	case <-c.done:
+		return nil, fmt.Errorf("Connection closed while waiting for acknowledgement of message %d", id)
+	case <-time.After(ackTimeout):
+		return nil, fmt.Errorf("Timed out waiting for acknowledgement of message %d", id)
+	}
+}
+
+func (c *clientConn) send(msg packet) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	err := msg.Encode(c.Conn)
+	if err != nil {
+		c.Close()
+	}
+	return err
+}
+
+func (c *clientConn) reader() {
+	defer c.Close()
+
+	for {
+		msg, err := c.wire.read(c.Conn)
+		if err != nil {
+			log.Debugf("Failed to read from mqtt connection: %s", err)
+			return
+		}
+
+		switch kind, id := c.wire.kind(msg); kind {
+		case connAckPacket:
+			c.connack <- msg
+		case ackPacket:
+			c.acknowledge(id, msg)
+		case pongPacket:
+			select {
+			case c.pong <- true:
+			default:
+			}
+		default:
+			c.handler(msg)
+		}
+	}
+}
+
+// keepalive pings the broker at the given interval, closing the connection if it doesn't answer
+// within the timeout. This is how we notice a half-open connection, which would otherwise go
+// unnoticed until we next try to write to it.
+func (c *clientConn) keepalive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		// forget any late answer to the last ping
+		select {
+		case <-c.pong:
+		default:
+		}
+
+		if err := c.send(c.wire.pingReq()); err != nil {
+			return
+		}
+
+		select {
+		case <-c.pong:
+		case <-c.done:
+			return
+		case <-time.After(timeout):
+			log.Warningf("No PINGRESP from broker in %s, closing connection", timeout)
+			c.Close()
+			return
+		}
+	}
+}
+
+func (c *clientConn) acknowledge(id uint16, msg packet) {
+	c.lock.Lock()
+	ack, ok := c.acks[id]
+	c.lock.Unlock()
+
+	if ok {
+		ack <- msg
+	} else {
+		log.Debugf("Ignoring unexpected acknowledgement of message %d", id)
+	}
+}
+
+// Close closes the underlying connection. It is safe to call more than once.
+func (c *clientConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// mqtt3 is MQTT 3.1, as spoken by TinyBus
+type mqtt3 struct{}
+
+func (mqtt3) read(r io.Reader) (packet, error) {
+	return proto.DecodeOneMessage(r, nil)
+}
+
+func (mqtt3) kind(p packet) (packetKind, uint16) {
+	switch p := p.(type) {
+	case *proto.ConnAck:
+		return connAckPacket, 0
+	case *proto.SubAck:
+		return ackPacket, p.MessageId
+	case *proto.UnsubAck:
+		return ackPacket, p.MessageId
+	case *proto.PingResp:
+		return pongPacket, 0
+	}
+	return otherPacket, 0
+}
+
+func (mqtt3) refused(connack packet) error {
+	if code := connack.(*proto.ConnAck).ReturnCode; code != proto.RetCodeAccepted {
+		return fmt.Errorf("Connection refused by broker, return code: %d", code)
+	}
+	return nil
+}
+
+func (mqtt3) pingReq() packet {
+	return &proto.PingReq{}
+}
@@ -0,0 +1,215 @@
+package bus
+
+import "sync"
+
+// MemoryBus is an in-process implementation of Bus. Every MemoryBus connected to the same host
+// shares its messages with the others, so a driver, an app and the rpc client/server can all talk
+// to each other in a test without a broker.
+type MemoryBus struct {
+	baseBus
+	sync.Mutex
+	hub           *memoryHub
+	subscriptions *topicTrie
+	id            string
+}
+
+type memoryHub struct {
+	sync.Mutex
+	buses    []*MemoryBus
+	retained *retainedCache
+}
+
+var (
+	memoryHubs     = make(map[string]*memoryHub)
+	memoryHubsLock sync.Mutex
+)
+
+func init() {
+	Register("memory", func(host, id string) (Bus, error) {
+		return ConnectMemoryBus(host, id)
+	})
+}
+
+// ConnectMemoryBus returns a MemoryBus attached to the in-process hub for the given host.
+func ConnectMemoryBus(host, id string) (*MemoryBus, error) {
+
+	memoryHubsLock.Lock()
+	hub, ok := memoryHubs[host]
+	if !ok {
+		hub = &memoryHub{
+			retained: newRetainedCache(),
+		}
+		memoryHubs[host] = hub
+	}
+	memoryHubsLock.Unlock()
+
+	bus := &MemoryBus{
+		hub:           hub,
+		subscriptions: newTopicTrie(),
+		id:            id,
+	}
+
+	bus.Reconnect()
+
+	return bus, nil
+}
+
+// Reconnect attaches the bus to its hub again after a call to Disconnect, firing the OnConnect handlers.
+func (b *MemoryBus) Reconnect() {
+	if b.isDestroyed() || b.Connected() {
+		return
+	}
+
+	b.hub.Lock()
+	b.hub.buses = append(b.hub.buses, b)
+	b.hub.Unlock()
+
+	b.connected()
+}
+
+// Disconnect simulates losing the connection to the broker. Messages published while disconnected
+// are dropped, and the OnDisconnect handlers are fired.
+func (b *MemoryBus) Disconnect() {
+	if !b.Connected() {
+		return
+	}
+
+	b.hub.Lock()
+	for i, other := range b.hub.buses {
+		if other == b {
+			b.hub.buses = append(b.hub.buses[:i], b.hub.buses[i+1:]...)
+			break
+		}
+	}
+	b.hub.Unlock()
+
+	b.disconnected()
+}
+
+func (b *MemoryBus) Destroy() {
+	log.Infof("Destroy called")
+	b.Disconnect()
+	b.markDestroyed()
+
+	b.Lock()
+	b.subscriptions.walk(func(_ string, s interface{}) {
+		s.(*Subscription).stop()
+	})
+	b.subscriptions = newTopicTrie()
+	b.Unlock()
+}
+
+func (b *MemoryBus) Publish(topic string, payload []byte) {
+	b.PublishWithOptions(topic, payload, PublishOptions{})
+}
+
+// PublishWithOptions publishes a message. Delivery within the process is always reliable, so the
+// QoS is ignored. Retained messages are kept by the hub, and given to later subscribers.
+func (b *MemoryBus) PublishWithOptions(topic string, payload []byte, options PublishOptions) error {
+	if !b.Connected() {
+		log.Debugf("Dropping message to %s, memory bus %s is not connected", topic, b.id)
+		return nil
+	}
+
+	if options.Retain {
+		b.hub.retained.set(topic, payload)
+	}
+
+	b.hub.Lock()
+	buses := make([]*MemoryBus, len(b.hub.buses))
+	copy(buses, b.hub.buses)
+	b.hub.Unlock()
+
+	for _, other := range buses {
+		other.onIncoming(&message{topic: topic, payload: payload, properties: options.Properties, qos: options.QoS, retained: options.Retain})
+	}
+	return nil
+}
+
+// ClearRetained removes the retained message on a topic from the hub. As with a broker, an empty
+// retained message is published to the topic, so current subscribers see it go.
+func (b *MemoryBus) ClearRetained(topic string) error {
+	b.hub.retained.clear(topic)
+	return b.PublishWithOptions(topic, []byte{}, PublishOptions{Retain: true})
+}
+
+// carriesProperties returns true, as messages are handed to the subscribers as they were published
+func (b *MemoryBus) carriesProperties() bool {
+	return true
+}
+
+func (b *MemoryBus) onIncoming(msg *message) {
+
+	// the subscriptions are pushed to once the lock is released, as a full queue may block until
+	// its callback catches up, and the callback may want to subscribe or cancel
+	var matching []*Subscription
+
+	b.Lock()
+	b.subscriptions.match(msg.topic, func(s interface{}) {
+		if sub := s.(*Subscription); !sub.cancelled {
+			matching = append(matching, sub)
+		}
+	})
+	b.Unlock()
+
+	for _, sub := range matching {
+		sub.push(msg)
+	}
+}
+
+func (b *MemoryBus) Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.SubscribeWithOptions(topic, SubscribeOptions{}, callback)
+}
+
+// SubscribeWithOptions subscribes to a topic. The QoS is ignored. Matching retained messages are
+// delivered to the callback before any others, or before returning if ReplayRetained is set.
+//
+// Unless QueueSize is given, the queue of messages waiting for the callback is unbounded, so that a
+// callback may publish to a topic it is itself subscribed to without deadlocking.
+func (b *MemoryBus) SubscribeWithOptions(topic string, options SubscribeOptions, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.subscribeMessages(topic, options, func(m *message) {
+		callback(m.topic, m.payload)
+	})
+}
+
+// subscribeMessages is SubscribeWithOptions, giving the callback the whole of each message
+func (b *MemoryBus) subscribeMessages(topic string, options SubscribeOptions, callback func(m *message)) (*Subscription, error) {
+
+	policy := options.Overflow
+	if policy == "" {
+		policy = Block
+	}
+
+	subscription := &Subscription{
+		topic: topic,
+		queue: newDeliveryQueue(options.QueueSize, policy),
+		done:  make(chan bool),
+	}
+
+	subscription.Cancel = func() {
+		b.Lock()
+		defer b.Unlock()
+
+		if subscription.cancelled {
+			return
+		}
+		subscription.stop()
+		b.subscriptions.remove(topic, subscription)
+	}
+
+	var initial []*message
+	retained := b.hub.retained.matching(topic)
+	if options.ReplayRetained {
+		subscription.replay(retained, callback)
+	} else {
+		initial = retained
+	}
+
+	go subscription.run(initial, callback)
+
+	b.Lock()
+	b.subscriptions.add(topic, subscription)
+	b.Unlock()
+
+	return subscription, nil
+}
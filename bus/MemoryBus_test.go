@@ -0,0 +1,213 @@
+package bus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryBusPubSub(t *testing.T) {
+
+	publisher, _ := ConnectMemoryBus("TestMemoryBusPubSub", "publisher")
+	subscriber, _ := ConnectMemoryBus("TestMemoryBusPubSub", "subscriber")
+	defer publisher.Destroy()
+	defer subscriber.Destroy()
+
+	received := make(chan string, 10)
+
+	subscriber.Subscribe("$device/+/channel/#", func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+
+	publisher.Publish("$device/abc/event/announce", []byte("ignored"))
+	publisher.Publish("$device/abc/channel/on-off", []byte("true"))
+	publisher.Publish("$device/abc/channel", []byte("also"))
+
+	for _, expected := range []string{"$device/abc/channel/on-off true", "$device/abc/channel also"} {
+		select {
+		case got := <-received:
+			if got != expected {
+				t.Errorf("expected %q, got %q", expected, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+	}
+
+	select {
+	case got := <-received:
+		t.Errorf("unexpected message %q", got)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestMemoryBusCancel(t *testing.T) {
+
+	bus, _ := ConnectMemoryBus("TestMemoryBusCancel", "bus")
+	defer bus.Destroy()
+
+	received := make(chan string, 10)
+
+	sub, _ := bus.Subscribe("testing/#", func(topic string, payload []byte) {
+		received <- topic
+	})
+
+	bus.Publish("testing/one", nil)
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for first message")
+	}
+
+	sub.Cancel()
+	bus.Publish("testing/two", nil)
+
+	select {
+	case got := <-received:
+		t.Errorf("received %q after cancel", got)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestMemoryBusBlockedSubscription(t *testing.T) {
+
+	bus, _ := ConnectMemoryBus("TestMemoryBusBlockedSubscription", "bus")
+	defer bus.Destroy()
+
+	release := make(chan bool)
+	slow, _ := bus.SubscribeWithOptions("testing/slow", SubscribeOptions{QueueSize: 1, Overflow: Block}, func(topic string, payload []byte) {
+		<-release
+	})
+	defer close(release)
+
+	// the first is with the callback and the second fills the queue, so the third blocks
+	bus.Publish("testing/slow", []byte("one"))
+	bus.Publish("testing/slow", []byte("two"))
+	published := make(chan bool)
+	go func() {
+		bus.Publish("testing/slow", []byte("three"))
+		close(published)
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	// while it's blocked, the bus can still be subscribed to and cancelled
+	done := make(chan bool)
+	go func() {
+		other, _ := bus.Subscribe("testing/other", func(topic string, payload []byte) {})
+		other.Cancel()
+		slow.Cancel()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Subscribing deadlocked with a blocked publish")
+	}
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatalf("Publish still blocked after the subscription was cancelled")
+	}
+}
+
+func TestMemoryBusConnectionCallbacks(t *testing.T) {
+
+	bus, _ := ConnectMemoryBus("TestMemoryBusConnectionCallbacks", "bus")
+	defer bus.Destroy()
+
+	disconnected := make(chan bool, 1)
+	connected := make(chan bool, 1)
+
+	bus.OnDisconnect(func() {
+		disconnected <- true
+	})
+	bus.OnConnect(func() {
+		connected <- true
+	})
+
+	bus.Disconnect()
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatalf("OnDisconnect was not called")
+	}
+
+	if bus.Connected() {
+		t.Errorf("expected bus to be disconnected")
+	}
+
+	bus.Reconnect()
+
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatalf("OnConnect was not called")
+	}
+
+	if !bus.Connected() {
+		t.Errorf("expected bus to be connected")
+	}
+}
+
+func TestMemoryBusRetained(t *testing.T) {
+
+	bus, _ := ConnectMemoryBus("TestMemoryBusRetained", "bus")
+	defer bus.Destroy()
+
+	bus.PublishWithOptions("testing/state", []byte("on"), PublishOptions{Retain: true})
+	bus.PublishWithOptions("testing/other", []byte("off"), PublishOptions{Retain: true})
+	bus.ClearRetained("testing/other")
+
+	var replayed []string
+	bus.SubscribeWithOptions("testing/+", SubscribeOptions{ReplayRetained: true}, func(topic string, payload []byte) {
+		replayed = append(replayed, topic+" "+string(payload))
+	})
+
+	if len(replayed) != 1 || replayed[0] != "testing/state on" {
+		t.Fatalf("expected the retained state to be replayed, got %v", replayed)
+	}
+
+	received := make(chan string, 10)
+	bus.Subscribe("testing/state", func(topic string, payload []byte) {
+		received <- string(payload)
+	})
+
+	select {
+	case got := <-received:
+		if got != "on" {
+			t.Errorf("expected retained payload %q, got %q", "on", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for retained message")
+	}
+}
+
+func TestMemoryBusClearRetained(t *testing.T) {
+
+	publisher, _ := ConnectMemoryBus("TestMemoryBusClearRetained", "publisher")
+	subscriber, _ := ConnectMemoryBus("TestMemoryBusClearRetained", "subscriber")
+	defer publisher.Destroy()
+	defer subscriber.Destroy()
+
+	publisher.PublishWithOptions("testing/state", []byte("on"), PublishOptions{Retain: true})
+
+	received := make(chan string, 10)
+	subscriber.Subscribe("testing/state", func(topic string, payload []byte) {
+		received <- string(payload)
+	})
+	expectMessage(t, received, "on")
+
+	publisher.ClearRetained("testing/state")
+	expectMessage(t, received, "")
+
+	var replayed []string
+	subscriber.SubscribeWithOptions("testing/state", SubscribeOptions{ReplayRetained: true}, func(topic string, payload []byte) {
+		replayed = append(replayed, string(payload))
+	})
+	if len(replayed) != 0 {
+		t.Errorf("expected nothing to be replayed after clearing, got %v", replayed)
+	}
+}
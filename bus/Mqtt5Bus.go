@@ -0,0 +1,381 @@
+package bus
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nps5696/go-ninja/bus/mqtt5"
+	"github.com/nps5696/go-ninja/config"
+)
+
+// Mqtt5Bus is a Bus that speaks MQTT 5, so that messages can carry properties such as a response
+// topic and correlation data for rpc, or user properties for tracing.
+//
+// It delivers messages at QoS 0 and 1; publishes and subscriptions asking for QoS 2 are made at
+// QoS 1. QoS 1 messages are kept until the broker acknowledges them, and are sent again after a
+// reconnect. QoS 0 messages published while disconnected are lost.
+type Mqtt5Bus struct {
+	*brokerBus
+	inflight      []*mqtt5.Publish
+	lastID        uint16
+	incoming      chan *mqtt5.Publish
+	cleanSession  bool
+	sessionExpiry time.Duration
+}
+
+func init() {
+	Register("mqtt5", func(host, id string) (Bus, error) {
+		options, err := ConnectOptionsFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return ConnectMqtt5Bus(host, id, options)
+	})
+}
+
+// ConnectMqtt5Bus connects to an MQTT 5 broker, returning once the first connection has been made.
+func ConnectMqtt5Bus(host, id string, options ConnectOptions) (*Mqtt5Bus, error) {
+
+	bus := &Mqtt5Bus{
+		brokerBus: newBrokerBus("mqtt5", host, id, options),
+		incoming:  make(chan *mqtt5.Publish, 100),
+		// keep our session on the broker while we're away, so QoS 1 messages aren't lost
+		cleanSession:  config.Bool(false, "mqtt", "cleanSession"),
+		sessionExpiry: config.Duration(time.Hour, "mqtt", "sessionExpiry"),
+	}
+
+	bus.subscriptions = newSubscriptionTable(bus.subscribe, bus.unsubscribe)
+
+	go bus.dispatch()
+
+	ready := make(chan bool)
+	go bus.run(ready, bus.connect, nil)
+	<-ready
+
+	return bus, nil
+}
+
+// connect makes a single attempt to connect to the broker. Once connected, our subscriptions are
+// restored and any unacknowledged messages are sent again.
+func (b *Mqtt5Bus) connect() (*clientConn, error) {
+
+	conn, err := dial(b.host, b.options)
+	if err != nil {
+		return nil, err
+	}
+
+	mqtt := newClientConnWithWire(conn, mqtt5Wire{}, b.onMessage)
+
+	connect := &mqtt5.Connect{
+		ClientID:   b.id,
+		CleanStart: b.cleanSession,
+		KeepAlive:  uint16(b.keepalive / time.Second),
+		Username:   b.options.Username,
+		Password:   b.options.Password,
+		Will: &mqtt5.Publish{
+			Retain:  true,
+			Topic:   willTopic(b.id),
+			Payload: []byte("false"),
+		},
+	}
+
+	if !b.cleanSession {
+		connect.Properties.SessionExpiryInterval = uint32(b.sessionExpiry / time.Second)
+	}
+
+	if err := mqtt.connect(connect); err != nil {
+		mqtt.Close()
+		return nil, err
+	}
+
+	b.online(mqtt)
+
+	b.Lock()
+	inflight := make([]*mqtt5.Publish, len(b.inflight))
+	copy(inflight, b.inflight)
+	b.Unlock()
+
+	// anything the broker hadn't acknowledged when we lost the last connection is sent again
+	for _, msg := range inflight {
+		dup := *msg
+		dup.Dup = true
+		mqtt.send(&dup)
+	}
+
+	mqtt.send(&mqtt5.Publish{
+		Retain:  true,
+		Topic:   connectedTopic(b.id),
+		Payload: []byte("true"),
+	})
+
+	return mqtt, nil
+}
+
+// onMessage is called by the connection for each message from the broker that isn't an
+// acknowledgement of a CONNECT, SUBSCRIBE or UNSUBSCRIBE.
+func (b *Mqtt5Bus) onMessage(msg packet) {
+	switch msg := msg.(type) {
+	case *mqtt5.Publish:
+		select {
+		case b.incoming <- msg:
+		case <-b.stop:
+		}
+	case *mqtt5.PubAck:
+		b.acknowledged(msg.PacketID)
+	case *mqtt5.Disconnect:
+		log.Warningf("Disconnected by broker, reason code: 0x%02x", msg.ReasonCode)
+	default:
+		log.Debugf("Ignoring unexpected message from broker: %T", msg)
+	}
+}
+
+// dispatch delivers incoming messages to the subscriptions, acknowledging them once they have been
+// handed over, until the bus is destroyed.
+func (b *Mqtt5Bus) dispatch() {
+	for {
+		var msg *mqtt5.Publish
+		select {
+		case msg = <-b.incoming:
+		case <-b.stop:
+			return
+		}
+
+		b.onIncoming(msg)
+		if msg.QoS > 0 {
+			b.send(&mqtt5.PubAck{PacketID: msg.PacketID})
+		}
+	}
+}
+
+func (b *Mqtt5Bus) onIncoming(msg *mqtt5.Publish) {
+	b.deliver(&message{topic: msg.Topic, payload: msg.Payload, properties: fromMqtt5Properties(&msg.Properties), qos: QoS(msg.QoS), retained: msg.Retain})
+}
+
+func (b *Mqtt5Bus) Destroy() {
+	log.Infof("Destroy called")
+
+	if !b.destroy() {
+		return
+	}
+
+	b.send(&mqtt5.Disconnect{})
+	if conn := b.getConn(); conn != nil {
+		conn.Close()
+	}
+	b.subscriptions.stopAll()
+}
+
+func (b *Mqtt5Bus) Publish(topic string, payload []byte) {
+	b.PublishWithOptions(topic, payload, PublishOptions{})
+}
+
+// PublishWithOptions publishes a message, with its properties. QoS 2 is downgraded to QoS 1.
+func (b *Mqtt5Bus) PublishWithOptions(topic string, payload []byte, options PublishOptions) error {
+	if b.isDestroyed() {
+		return fmt.Errorf("Can't publish to %s, the bus has been destroyed", topic)
+	}
+
+	if options.Retain {
+		b.retained.set(topic, payload)
+	}
+
+	msg := &mqtt5.Publish{
+		Retain:     options.Retain,
+		Topic:      topic,
+		Payload:    payload,
+		Properties: toMqtt5Properties(options.Properties),
+	}
+
+	if options.QoS == AtMostOnce {
+		return b.send(msg)
+	}
+
+	msg.QoS = 1
+
+	b.Lock()
+	msg.PacketID = b.nextID()
+	b.inflight = append(b.inflight, msg)
+	b.Unlock()
+
+	if err := b.send(msg); err != nil {
+		log.Infof("Failed to publish to %s, will retry after reconnecting: %s", topic, err)
+	}
+	return nil
+}
+
+// ClearRetained removes the retained message on a topic, from the broker and from our cache
+func (b *Mqtt5Bus) ClearRetained(topic string) error {
+	b.retained.clear(topic)
+	return b.PublishWithOptions(topic, []byte{}, PublishOptions{Retain: true})
+}
+
+func (b *Mqtt5Bus) acknowledged(id uint16) {
+	b.Lock()
+	defer b.Unlock()
+
+	for i, msg := range b.inflight {
+		if msg.PacketID == id {
+			b.inflight = append(b.inflight[:i], b.inflight[i+1:]...)
+			return
+		}
+	}
+}
+
+// nextID returns an unused packet id. The lock must be held.
+func (b *Mqtt5Bus) nextID() uint16 {
+	for {
+		b.lastID++
+		if b.lastID == 0 {
+			continue
+		}
+
+		inUse := false
+		for _, msg := range b.inflight {
+			if msg.PacketID == b.lastID {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			return b.lastID
+		}
+	}
+}
+
+// SubscribeWithProperties subscribes to a topic, giving the callback the properties of each
+// message. Retained messages replayed from the cache have no properties.
+func (b *Mqtt5Bus) SubscribeWithProperties(topic string, options SubscribeOptions, callback func(topic string, payload []byte, properties *Properties)) (*Subscription, error) {
+	return b.subscribeMessages(topic, options, func(m *message) {
+		callback(m.topic, m.payload, m.properties)
+	})
+}
+
+// carriesProperties returns true, as the properties of a message are passed to its subscribers
+func (b *Mqtt5Bus) carriesProperties() bool {
+	return true
+}
+
+func (b *Mqtt5Bus) subscribe(topic string, qos QoS) (bool, error) {
+	conn := b.getConn()
+	if conn == nil {
+		return false, nil
+	}
+
+	if qos > AtLeastOnce {
+		qos = AtLeastOnce
+	}
+
+	b.Lock()
+	id := b.nextID()
+	b.Unlock()
+
+	ack, err := conn.request(&mqtt5.Subscribe{
+		PacketID:      id,
+		Subscriptions: []mqtt5.Subscription{{Topic: topic, QoS: byte(qos)}},
+	}, id)
+
+	if err != nil {
+		// We'll subscribe again when we reconnect
+		log.Infof("Failed to subscribe to %s: %s", topic, err)
+		return false, nil
+	}
+
+	codes := ack.(*mqtt5.SubAck).ReasonCodes
+	if len(codes) != 1 || codes[0] >= mqtt5.UnspecifiedError {
+		return false, fmt.Errorf("Broker refused subscription to %s", topic)
+	}
+
+	if QoS(codes[0]) < qos {
+		log.Warningf("Broker downgraded subscription to %s from QoS %d to %d", topic, qos, codes[0])
+	}
+
+	return true, nil
+}
+
+func (b *Mqtt5Bus) unsubscribe(topic string) error {
+	conn := b.getConn()
+	if conn == nil {
+		return nil
+	}
+
+	b.Lock()
+	id := b.nextID()
+	b.Unlock()
+
+	_, err := conn.request(&mqtt5.Unsubscribe{
+		PacketID: id,
+		Topics:   []string{topic},
+	}, id)
+
+	if err != nil {
+		return fmt.Errorf("Failed to unsubscribe from %s: %s", topic, err)
+	}
+
+	return nil
+}
+
+func toMqtt5Properties(properties *Properties) mqtt5.Properties {
+	var p mqtt5.Properties
+	if properties == nil {
+		return p
+	}
+
+	p.ResponseTopic = properties.ResponseTopic
+	p.CorrelationData = properties.CorrelationData
+	for key, value := range properties.UserProperties {
+		p.User = append(p.User, mqtt5.UserProperty{Key: key, Value: value})
+	}
+	return p
+}
+
+func fromMqtt5Properties(p *mqtt5.Properties) *Properties {
+	properties := &Properties{
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+	}
+
+	if len(p.User) > 0 {
+		properties.UserProperties = make(map[string]string)
+		for _, u := range p.User {
+			properties.UserProperties[u.Key] = u.Value
+		}
+	}
+	return properties
+}
+
+// mqtt5Wire is MQTT 5, as spoken by Mqtt5Bus
+type mqtt5Wire struct{}
+
+func (mqtt5Wire) read(r io.Reader) (packet, error) {
+	return mqtt5.ReadPacket(r)
+}
+
+func (mqtt5Wire) kind(p packet) (packetKind, uint16) {
+	switch p := p.(type) {
+	case *mqtt5.ConnAck:
+		return connAckPacket, 0
+	case *mqtt5.SubAck:
+		return ackPacket, p.PacketID
+	case *mqtt5.UnsubAck:
+		return ackPacket, p.PacketID
+	case *mqtt5.PingResp:
+		return pongPacket, 0
+	}
+	return otherPacket, 0
+}
+
+func (mqtt5Wire) refused(connack packet) error {
+	ack := connack.(*mqtt5.ConnAck)
+	if ack.ReasonCode >= mqtt5.UnspecifiedError {
+		if ack.Properties.ReasonString != "" {
+			return fmt.Errorf("Connection refused by broker, reason code: 0x%02x (%s)", ack.ReasonCode, ack.Properties.ReasonString)
+		}
+		return fmt.Errorf("Connection refused by broker, reason code: 0x%02x", ack.ReasonCode)
+	}
+	return nil
+}
+
+func (mqtt5Wire) pingReq() packet {
+	return &mqtt5.PingReq{}
+}
@@ -0,0 +1,144 @@
+package bus
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/nps5696/go-ninja/bus/mqtt5"
+)
+
+// mqtt5TestBroker is just enough of an MQTT 5 broker to test Mqtt5Bus against. Messages are
+// delivered at QoS 0, with their properties.
+type mqtt5TestBroker struct {
+	sync.Mutex
+	listener      net.Listener
+	subscriptions map[*mqtt5TestClient][]string
+}
+
+type mqtt5TestClient struct {
+	sync.Mutex
+	conn net.Conn
+}
+
+func (c *mqtt5TestClient) send(p mqtt5.Packet) {
+	c.Lock()
+	defer c.Unlock()
+	p.Encode(c.conn)
+}
+
+func startMqtt5Broker(t *testing.T) *mqtt5TestBroker {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to start broker: %s", err)
+	}
+
+	b := &mqtt5TestBroker{
+		listener:      l,
+		subscriptions: make(map[*mqtt5TestClient][]string),
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(&mqtt5TestClient{conn: conn})
+		}
+	}()
+
+	return b
+}
+
+func (b *mqtt5TestBroker) serve(c *mqtt5TestClient) {
+	defer func() {
+		c.conn.Close()
+		b.Lock()
+		delete(b.subscriptions, c)
+		b.Unlock()
+	}()
+
+	for {
+		p, err := mqtt5.ReadPacket(c.conn)
+		if err != nil {
+			return
+		}
+
+		switch p := p.(type) {
+		case *mqtt5.Connect:
+			c.send(&mqtt5.ConnAck{ReasonCode: mqtt5.Success})
+		case *mqtt5.Subscribe:
+			codes := make([]byte, len(p.Subscriptions))
+			b.Lock()
+			for i, s := range p.Subscriptions {
+				b.subscriptions[c] = append(b.subscriptions[c], s.Topic)
+				codes[i] = s.QoS
+			}
+			b.Unlock()
+			c.send(&mqtt5.SubAck{PacketID: p.PacketID, ReasonCodes: codes})
+		case *mqtt5.Unsubscribe:
+			b.Lock()
+			b.subscriptions[c] = nil
+			b.Unlock()
+			c.send(&mqtt5.UnsubAck{PacketID: p.PacketID, ReasonCodes: make([]byte, len(p.Topics))})
+		case *mqtt5.Publish:
+			if p.QoS > 0 {
+				c.send(&mqtt5.PubAck{PacketID: p.PacketID})
+			}
+			b.publish(p)
+		case *mqtt5.PingReq:
+			c.send(&mqtt5.PingResp{})
+		case *mqtt5.Disconnect:
+			return
+		}
+	}
+}
+
+func (b *mqtt5TestBroker) publish(p *mqtt5.Publish) {
+	b.Lock()
+	defer b.Unlock()
+
+	for c, topics := range b.subscriptions {
+		for _, topic := range topics {
+			if matches(topic, p.Topic) {
+				c.send(&mqtt5.Publish{Topic: p.Topic, Payload: p.Payload, Properties: p.Properties})
+				break
+			}
+		}
+	}
+}
+
+func TestMqtt5BusProperties(t *testing.T) {
+	b := startMqtt5Broker(t)
+	defer b.listener.Close()
+
+	responder, _ := ConnectMqtt5Bus(b.listener.Addr().String(), "responder", ConnectOptions{})
+	defer responder.Destroy()
+
+	requester, _ := ConnectMqtt5Bus(b.listener.Addr().String(), "requester", ConnectOptions{})
+	defer requester.Destroy()
+
+	// answer requests on the response topic they name, with their correlation data
+	responder.SubscribeWithProperties("testing/request", SubscribeOptions{}, func(topic string, payload []byte, properties *Properties) {
+		responder.PublishWithOptions(properties.ResponseTopic, []byte(string(payload)+" "+properties.UserProperties["caller"]), PublishOptions{
+			QoS:        AtLeastOnce,
+			Properties: &Properties{CorrelationData: properties.CorrelationData},
+		})
+	})
+
+	received := make(chan string, 10)
+	requester.SubscribeWithProperties("testing/response/requester", SubscribeOptions{QoS: AtLeastOnce}, func(topic string, payload []byte, properties *Properties) {
+		received <- string(payload) + " " + string(properties.CorrelationData)
+	})
+
+	requester.PublishWithOptions("testing/request", []byte("hello"), PublishOptions{
+		Properties: &Properties{
+			ResponseTopic:   "testing/response/requester",
+			CorrelationData: []byte("1234"),
+			UserProperties:  map[string]string{"caller": "requester"},
+		},
+	})
+
+	expectMessage(t, received, "hello requester 1234")
+}
@@ -2,187 +2,346 @@ package bus
 
 import (
 	"fmt"
-	"net"
+	"path/filepath"
 	"sync"
 	"time"
 
 	proto "github.com/huin/mqtt"
 	"github.com/nps5696/go-ninja/config"
-	"github.com/ninjasphere/mqtt"
 )
 
 type TinyBus struct {
-	baseBus
-	connecting    sync.WaitGroup
-	mqtt          *mqtt.ClientConn
-	subscriptions []*Subscription
-	host          string
-	id            string
+	*brokerBus
+	session      *session
+	outbox       *outbox
+	flushLock    sync.Mutex
+	incoming     chan *proto.Publish
+	cleanSession bool
+}
+
+func init() {
+	Register("tiny", func(host, id string) (Bus, error) {
+		options, err := ConnectOptionsFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return ConnectTinyBusWithOptions(host, id, options)
+	})
 }
 
 func ConnectTinyBus(host, id string) (*TinyBus, error) {
+	return ConnectTinyBusWithOptions(host, id, ConnectOptions{})
+}
+
+// ConnectTinyBusWithOptions connects to the broker using the given TLS config and credentials. The
+// host may be host:port, or a ws://, wss:// or unix:// URL (see dial).
+func ConnectTinyBusWithOptions(host, id string, options ConnectOptions) (*TinyBus, error) {
+
+	// messages published while we're offline are queued, and optionally kept on disk so that they
+	// survive a restart
+	var queueFile string
+	if config.Bool(false, "mqtt", "queue", "persist") {
+		queueFile = filepath.Join(config.DataPath(), "mqtt", id+".queue")
+	}
+
+	queueSize := config.Int(1000, "mqtt", "queue", "size")
+	if queueSize <= 0 {
+		log.Warningf("mqtt.queue.size is %d, messages published while offline will be queued without limit", queueSize)
+		queueSize = 0
+	}
 
 	bus := &TinyBus{
-		subscriptions: make([]*Subscription, 0),
-		host:          host,
-		id:            id,
+		brokerBus: newBrokerBus("mqtt", host, id, options),
+		session:   newSession(),
+		outbox:    newOutbox(queueSize, OverflowPolicy(config.String(string(DropOldest), "mqtt", "queue", "policy")), queueFile),
+		incoming:  make(chan *proto.Publish, 100),
+		// keep our session on the broker while we're away, so QoS 1 and 2 messages aren't lost
+		cleanSession: config.Bool(false, "mqtt", "cleanSession"),
 	}
 
-	bus.connect()
+	bus.subscriptions = newSubscriptionTable(bus.subscribe, bus.unsubscribe)
 
-	return bus, nil
-}
+	go bus.dispatch()
 
-type wrappedConn struct {
-	net.Conn
-	done chan bool
-}
+	ready := make(chan bool)
+	go bus.run(ready, bus.connect, func() {
+		bus.outbox.setOnline(false)
+	})
+	<-ready
 
-func (c wrappedConn) Close() error {
-	log.Warningf("Connection closed!")
-	c.done <- true
-	c.Conn.Close()
-	return nil
+	return bus, nil
 }
 
-func (b *TinyBus) connect() {
-
-	b.connecting.Add(1)
-	defer func() {
-		b.connecting.Done()
+// connect makes a single attempt to connect to the broker. Once connected, our subscriptions are
+// restored and anything we owe the broker is sent.
+func (b *TinyBus) connect() (*clientConn, error) {
 
-		b.publish(&proto.Publish{
-			Header: proto.Header{
-				Retain: true,
-			},
-			TopicName: fmt.Sprintf("node/%s/module/%s/state/connected", config.Serial(), b.id),
-			Payload:   proto.BytesPayload([]byte("true")),
-		})
-	}()
+	conn, err := dial(b.host, b.options)
+	if err != nil {
+		return nil, err
+	}
 
-	var conn wrappedConn
-	for {
-		tcpConn, err := net.Dial("tcp", b.host)
-		if err == nil {
-			conn = wrappedConn{
-				Conn: tcpConn,
-				done: make(chan bool, 1),
-			}
-			break
-		}
+	mqtt := newClientConn(conn, b.onMessage)
+
+	err = mqtt.connect(&proto.Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		ClientId:        b.id,
+		CleanSession:    b.cleanSession,
+		UsernameFlag:    b.options.Username != "",
+		Username:        b.options.Username,
+		PasswordFlag:    b.options.Password != "",
+		Password:        b.options.Password,
+		KeepAliveTimer:  uint16(b.keepalive / time.Second),
+		WillFlag:        true,
+		WillQos:         0,
+		WillRetain:      true,
+		WillTopic:       willTopic(b.id),
+		WillMessage:     "false",
+	})
 
-		//log.Warningf("Failed to connect to: %s", err)
-		time.Sleep(time.Millisecond * 500)
+	if err != nil {
+		mqtt.Close()
+		return nil, err
 	}
 
-	if b.mqtt != nil {
-		log.Infof("Reconnected to mqtt server")
+	b.online(mqtt)
+
+	// anything the broker hadn't acknowledged when we lost the last connection is sent again
+	for _, msg := range b.session.pending() {
+		mqtt.send(msg)
 	}
 
-	mqtt := mqtt.NewClientConn(conn)
-	mqtt.ClientId = b.id
+	// followed by everything published while we were offline
+	b.outbox.setOnline(true)
+	b.flush()
 
-	err := mqtt.ConnectCustom(&proto.Connect{
-		WillFlag:    true,
-		WillQos:     0,
-		WillRetain:  true,
-		WillTopic:   fmt.Sprintf("$node/%s/module/%s/state/connected", config.Serial(), b.id),
-		WillMessage: "false",
+	b.publish(&proto.Publish{
+		Header: proto.Header{
+			Retain: true,
+		},
+		TopicName: connectedTopic(b.id),
+		Payload:   proto.BytesPayload([]byte("true")),
 	})
 
-	if err != nil {
-		log.Fatalf("MQTT Failed to connect to: %s", err)
-	}
-
-	b.mqtt = mqtt
-
-	b.connected()
+	return mqtt, nil
+}
 
-	for _, s := range b.subscriptions {
-		if !s.cancelled {
-			b.subscribe(s)
+// onMessage is called by the connection for each message from the broker that isn't an
+// acknowledgement of a CONNECT, SUBSCRIBE or UNSUBSCRIBE.
+func (b *TinyBus) onMessage(msg packet) {
+	switch msg := msg.(type) {
+	case *proto.Publish:
+		select {
+		case b.incoming <- msg:
+		case <-b.stop:
 		}
+	case *proto.PubAck:
+		b.session.acknowledged(msg.MessageId)
+	case *proto.PubRec:
+		b.session.released(msg.MessageId)
+		b.send(&proto.PubRel{
+			Header:    proto.Header{QosLevel: proto.QosAtLeastOnce},
+			MessageId: msg.MessageId,
+		})
+	case *proto.PubComp:
+		b.session.acknowledged(msg.MessageId)
+	case *proto.PubRel:
+		b.session.release(msg.MessageId)
+		b.send(&proto.PubComp{MessageId: msg.MessageId})
+	default:
+		log.Debugf("Ignoring unexpected message from broker: %T", msg)
 	}
+}
 
-	go func() {
-		for m := range mqtt.Incoming {
-			b.onIncoming(m)
+// dispatch delivers incoming messages to the subscriptions, acknowledging them once they have been
+// handed over, until the bus is destroyed.
+func (b *TinyBus) dispatch() {
+	for {
+		var msg *proto.Publish
+		select {
+		case msg = <-b.incoming:
+		case <-b.stop:
+			return
 		}
-	}()
 
-	go func() {
-		<-conn.done
-		b.disconnected()
-		if !b.destroyed {
-			b.connect()
+		switch msg.QosLevel {
+		case proto.QosAtMostOnce:
+			b.onIncoming(msg)
+		case proto.QosAtLeastOnce:
+			b.onIncoming(msg)
+			b.send(&proto.PubAck{MessageId: msg.MessageId})
+		case proto.QosExactlyOnce:
+			if b.session.receive(msg.MessageId) {
+				b.onIncoming(msg)
+			}
+			b.send(&proto.PubRec{MessageId: msg.MessageId})
 		}
-	}()
+	}
 }
 
 func (b *TinyBus) onIncoming(msg *proto.Publish) {
-
-	for _, sub := range b.subscriptions {
-		if !sub.cancelled && matches(sub.topic, msg.TopicName) {
-			sub.c <- &message{msg.TopicName, []byte(msg.Payload.(proto.BytesPayload))}
-		}
-	}
+	b.deliver(&message{topic: msg.TopicName, payload: []byte(msg.Payload.(proto.BytesPayload)), qos: QoS(msg.QosLevel), retained: msg.Retain})
 }
 
 func (b *TinyBus) Destroy() {
 	log.Infof("Destroy called")
-	b.destroyed = true
-	b.mqtt.Disconnect()
+
+	if !b.destroy() {
+		return
+	}
+
+	b.outbox.close()
+	b.send(&proto.Disconnect{})
+	if conn := b.getConn(); conn != nil {
+		conn.Close()
+	}
+	b.subscriptions.stopAll()
 }
 
 func (b *TinyBus) Publish(topic string, payload []byte) {
-	b.connecting.Wait()
+	b.PublishWithOptions(topic, payload, PublishOptions{})
+}
 
-	b.publish(&proto.Publish{
-		TopicName: topic,
-		Payload:   proto.BytesPayload(payload),
+// PublishWithOptions publishes a message at the given QoS. Messages sent at QoS 1 or 2 are kept
+// until the broker acknowledges them, and are sent again if the connection drops first.
+//
+// While the bus is offline messages are queued, and sent in order once it reconnects. When the
+// queue is full the mqtt.queue.policy config decides whether the oldest message is dropped, the new
+// one is (returning an error), or the call blocks until there is room.
+func (b *TinyBus) PublishWithOptions(topic string, payload []byte, options PublishOptions) error {
+	if b.isDestroyed() {
+		return fmt.Errorf("Can't publish to %s, the bus has been destroyed", topic)
+	}
+
+	if options.Retain {
+		b.retained.set(topic, payload)
+	}
+
+	err := b.outbox.push(&queuedMessage{
+		Topic:   topic,
+		Payload: payload,
+		QoS:     options.QoS,
+		Retain:  options.Retain,
 	})
+	if err != nil {
+		return err
+	}
 
-}
+	b.flush()
 
-func (b *TinyBus) publish(message *proto.Publish) {
-	b.mqtt.Publish(message)
+	return nil
 }
 
-func (b *TinyBus) Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error) {
+// flush sends queued messages to the broker in order, until the queue is empty or the connection fails
+func (b *TinyBus) flush() {
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
 
-	subscription := &Subscription{
-		topic: topic,
-		c:     make(chan *message),
-	}
+	for {
+		conn := b.getConn()
+		if conn == nil {
+			return
+		}
+
+		select {
+		case <-conn.done:
+			return
+		default:
+		}
 
-	go func() {
-		for m := range subscription.c {
-			if subscription.cancelled {
-				break
+		queued := b.outbox.pop()
+		if queued == nil {
+			return
+		}
+
+		msg := &proto.Publish{
+			Header: proto.Header{
+				QosLevel: proto.QosLevel(queued.QoS),
+				Retain:   queued.Retain,
+			},
+			TopicName: queued.Topic,
+			Payload:   proto.BytesPayload(queued.Payload),
+		}
+
+		if queued.QoS != AtMostOnce {
+			// the session sends it again after a reconnect if the broker doesn't acknowledge it
+			b.session.track(msg)
+		}
+
+		if err := conn.send(msg); err != nil {
+			log.Infof("Failed to publish to %s, will retry after reconnecting: %s", queued.Topic, err)
+			if queued.QoS == AtMostOnce {
+				b.outbox.unpop(queued)
 			}
-			callback(m.topic, m.payload)
+			return
 		}
-	}()
+	}
+}
 
-	subscription.Cancel = func() {
-		// TODO: Actually unsubscribe if we were the only one listening
-		// TODO: Remove from from b.subscriptions
-		subscription.cancelled = true
+// ClearRetained removes the retained message on a topic, from the broker and from our cache
+func (b *TinyBus) ClearRetained(topic string) error {
+	b.retained.clear(topic)
+	return b.PublishWithOptions(topic, []byte{}, PublishOptions{Retain: true})
+}
+
+func (b *TinyBus) publish(message *proto.Publish) error {
+	return b.send(message)
+}
+
+func (b *TinyBus) subscribe(topic string, qos QoS) (bool, error) {
+	conn := b.getConn()
+	if conn == nil {
+		return false, nil
 	}
 
-	err := b.subscribe(subscription)
+	id := b.session.nextID()
+
+	ack, err := conn.request(&proto.Subscribe{
+		Header: proto.Header{
+			QosLevel: proto.QosAtLeastOnce,
+		},
+		MessageId: id,
+		Topics:    []proto.TopicQos{{Topic: topic, Qos: proto.QosLevel(qos)}},
+	}, id)
+
 	if err != nil {
-		return nil, err
+		// We'll subscribe again when we reconnect
+		log.Infof("Failed to subscribe to %s: %s", topic, err)
+		return false, nil
+	}
+
+	granted := ack.(*proto.SubAck).TopicsQos
+	if len(granted) != 1 || !granted[0].IsValid() {
+		return false, fmt.Errorf("Broker refused subscription to %s", topic)
 	}
 
-	b.subscriptions = append(b.subscriptions, subscription)
+	if QoS(granted[0]) < qos {
+		log.Warningf("Broker downgraded subscription to %s from QoS %d to %d", topic, qos, granted[0])
+	}
 
-	return subscription, nil
+	return true, nil
 }
 
-func (b *TinyBus) subscribe(subscription *Subscription) error {
-	_ = b.mqtt.Subscribe([]proto.TopicQos{proto.TopicQos{subscription.topic, proto.QosAtMostOnce}})
-	//spew.Dump("subscription ack", ack)
-	// TODO: Check ack
+func (b *TinyBus) unsubscribe(topic string) error {
+	conn := b.getConn()
+	if conn == nil {
+		return nil
+	}
+
+	id := b.session.nextID()
+
+	_, err := conn.request(&proto.Unsubscribe{
+		Header: proto.Header{
+			QosLevel: proto.QosAtLeastOnce,
+		},
+		MessageId: id,
+		Topics:    []string{topic},
+	}, id)
+
+	if err != nil {
+		return fmt.Errorf("Failed to unsubscribe from %s: %s", topic, err)
+	}
+
 	return nil
 }
@@ -0,0 +1,715 @@
+package bus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	proto "github.com/huin/mqtt"
+	"github.com/nps5696/go-ninja/bus/broker"
+	"github.com/nps5696/go-ninja/config"
+)
+
+func init() {
+	// TinyBus publishes its connection state under the node serial
+	if !config.HasString("serial") {
+		os.Setenv("sphere_serial", "TESTSERIAL")
+		config.MustRefresh()
+	}
+}
+
+func startBroker(t *testing.T) *broker.Broker {
+	b, err := broker.ListenAndServe("localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to start broker: %s", err)
+	}
+
+	for b.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	return b
+}
+
+func expectMessage(t *testing.T, c chan string, expected string) {
+	select {
+	case got := <-c:
+		if got != expected {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("timed out waiting for %q", expected)
+	}
+}
+
+func TestTinyBusPubSub(t *testing.T) {
+	b := startBroker(t)
+	defer b.Close()
+
+	bus, _ := ConnectTinyBus(b.Addr().String(), "TestTinyBusPubSub")
+	defer bus.Destroy()
+
+	received := make(chan string, 10)
+	bus.Subscribe("testing/+/ever", func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+
+	bus.Publish("testing/what/ever", []byte(`{"hello":123}`))
+
+	expectMessage(t, received, `testing/what/ever {"hello":123}`)
+}
+
+func TestTinyBusWillAndReconnect(t *testing.T) {
+	b := startBroker(t)
+	defer b.Close()
+
+	watcher, _ := ConnectTinyBus(b.Addr().String(), "watcher")
+	defer watcher.Destroy()
+
+	states := make(chan string, 10)
+	for _, filter := range []string{"$node/+/module/+/state/connected", "node/+/module/+/state/connected"} {
+		watcher.Subscribe(filter, func(topic string, payload []byte) {
+			if strings.Contains(topic, "/module/module/") {
+				states <- topic + " " + string(payload)
+			}
+		})
+	}
+
+	module, _ := ConnectTinyBus(b.Addr().String(), "module")
+	defer module.Destroy()
+
+	reconnected := make(chan bool, 1)
+	module.OnConnect(func() {
+		reconnected <- true
+	})
+
+	will := "$node/" + config.Serial() + "/module/module/state/connected"
+	topic := "node/" + config.Serial() + "/module/module/state/connected"
+
+	expectMessage(t, states, topic+" true")
+
+	if err := b.Disconnect("module"); err != nil {
+		t.Fatalf("Failed to drop module connection: %s", err)
+	}
+
+	expectMessage(t, states, will+" false")
+
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("module did not reconnect")
+	}
+
+	expectMessage(t, states, topic+" true")
+
+	if payload, ok := b.Retained(topic); !ok || string(payload) != "true" {
+		t.Errorf("expected retained connection state to be true, got %q", payload)
+	}
+}
+
+func TestTinyBusQoSDeliveryAcrossReconnect(t *testing.T) {
+	b := startBroker(t)
+	defer b.Close()
+
+	publisher, _ := ConnectTinyBus(b.Addr().String(), "publisher")
+	defer publisher.Destroy()
+
+	subscriber, _ := ConnectTinyBus(b.Addr().String(), "subscriber")
+	defer subscriber.Destroy()
+
+	received := make(chan string, 10)
+	for _, qos := range []QoS{AtLeastOnce, ExactlyOnce} {
+		topic := fmt.Sprintf("testing/qos/%d", qos)
+		subscriber.SubscribeWithOptions(topic, SubscribeOptions{QoS: qos}, func(topic string, payload []byte) {
+			received <- topic + " " + string(payload)
+		})
+	}
+
+	// the subscriber's session is kept by the broker, so messages published while it is away are
+	// delivered when it reconnects
+	b.Disconnect("subscriber")
+
+	publisher.PublishWithOptions("testing/qos/1", []byte("one"), PublishOptions{QoS: AtLeastOnce})
+	publisher.PublishWithOptions("testing/qos/2", []byte("two"), PublishOptions{QoS: ExactlyOnce})
+
+	// each subscription delivers on its own goroutine, so the two may arrive in either order
+	expected := map[string]bool{"testing/qos/1 one": true, "testing/qos/2 two": true}
+	for len(expected) > 0 {
+		select {
+		case got := <-received:
+			if !expected[got] {
+				t.Fatalf("unexpected message %q", got)
+			}
+			delete(expected, got)
+		case <-time.After(time.Second * 2):
+			t.Fatalf("timed out waiting for %v", expected)
+		}
+	}
+
+	select {
+	case got := <-received:
+		t.Errorf("unexpected duplicate %q", got)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	if len(publisher.session.pending()) != 0 {
+		t.Errorf("expected all published messages to be acknowledged")
+	}
+}
+
+func TestSessionPendingAfterDisconnect(t *testing.T) {
+	s := newSession()
+
+	first := &proto.Publish{Header: proto.Header{QosLevel: proto.QosAtLeastOnce}, TopicName: "a"}
+	second := &proto.Publish{Header: proto.Header{QosLevel: proto.QosExactlyOnce}, TopicName: "b"}
+	third := &proto.Publish{Header: proto.Header{QosLevel: proto.QosExactlyOnce}, TopicName: "c"}
+
+	s.track(first)
+	s.track(second)
+	s.track(third)
+
+	s.acknowledged(first.MessageId)
+	s.released(second.MessageId)
+
+	pending := s.pending()
+	if len(pending) != 2 {
+		t.Fatalf("expected 2 pending messages, got %d", len(pending))
+	}
+
+	if rel, ok := pending[0].(*proto.PubRel); !ok || rel.MessageId != second.MessageId {
+		t.Errorf("expected PUBREL for message %d, got %#v", second.MessageId, pending[0])
+	}
+
+	if pub, ok := pending[1].(*proto.Publish); !ok || pub.TopicName != "c" || !pub.DupFlag {
+		t.Errorf("expected duplicate PUBLISH to c, got %#v", pending[1])
+	}
+}
+
+func TestTinyBusRetained(t *testing.T) {
+	b := startBroker(t)
+	defer b.Close()
+
+	bus, _ := ConnectTinyBus(b.Addr().String(), "TestTinyBusRetained")
+	defer bus.Destroy()
+
+	bus.PublishWithOptions("testing/retained", []byte("first"), PublishOptions{QoS: AtLeastOnce, Retain: true})
+
+	// the bus's own retained messages are cached, so they can be replayed straight away
+	replayed := ""
+	received := make(chan string, 10)
+	bus.SubscribeWithOptions("testing/+", SubscribeOptions{ReplayRetained: true}, func(topic string, payload []byte) {
+		if replayed == "" {
+			replayed = string(payload)
+			return
+		}
+		received <- string(payload)
+	})
+
+	if replayed != "first" {
+		t.Fatalf("expected %q to be replayed, got %q", "first", replayed)
+	}
+
+	if payload, ok := b.Retained("testing/retained"); !ok || string(payload) != "first" {
+		t.Errorf("expected broker to retain %q, got %q", "first", payload)
+	}
+
+	// the broker's copy of the retained message was already replayed, so isn't delivered again
+	bus.Publish("testing/retained", []byte("second"))
+	expectMessage(t, received, "second")
+
+	// it wasn't retained, so the cache still holds the broker's copy
+	if cached := bus.retained.matching("testing/retained"); len(cached) != 1 || string(cached[0].payload) != "first" {
+		t.Errorf("expected the retained cache to still hold %q, got %v", "first", cached)
+	}
+
+	bus.ClearRetained("testing/retained")
+	expectMessage(t, received, "")
+
+	time.Sleep(time.Millisecond * 100)
+	if _, ok := b.Retained("testing/retained"); ok {
+		t.Errorf("expected retained message to be cleared")
+	}
+	if cached := bus.retained.matching("testing/#"); len(cached) != 0 {
+		t.Errorf("expected retained cache to be empty, got %d messages", len(cached))
+	}
+}
+
+func TestTinyBusUnsubscribe(t *testing.T) {
+	b := startBroker(t)
+	defer b.Close()
+
+	bus, _ := ConnectTinyBus(b.Addr().String(), "TestTinyBusUnsubscribe")
+	defer bus.Destroy()
+
+	first := make(chan string, 10)
+	second := make(chan string, 10)
+
+	sub1, _ := bus.Subscribe("testing/unsubscribe", func(topic string, payload []byte) {
+		first <- string(payload)
+	})
+	sub2, _ := bus.Subscribe("testing/unsubscribe", func(topic string, payload []byte) {
+		second <- string(payload)
+	})
+
+	bus.Publish("testing/unsubscribe", []byte("both"))
+	expectMessage(t, first, "both")
+	expectMessage(t, second, "both")
+
+	// the broker subscription is shared, so is kept until the last listener goes
+	sub1.Cancel()
+	if !bus.subscriptions.isSubscribed("testing/unsubscribe") {
+		t.Fatalf("expected broker subscription to be kept while a listener remains")
+	}
+
+	bus.Publish("testing/unsubscribe", []byte("one"))
+	expectMessage(t, second, "one")
+
+	sub2.Cancel()
+	if bus.subscriptions.isSubscribed("testing/unsubscribe") {
+		t.Fatalf("expected broker subscription to be dropped with the last listener")
+	}
+
+	bus.Publish("testing/unsubscribe", []byte("none"))
+
+	select {
+	case got := <-first:
+		t.Errorf("unexpected message %q after cancel", got)
+	case got := <-second:
+		t.Errorf("unexpected message %q after cancel", got)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	if count := bus.subscriptions.count(); count != 0 {
+		t.Errorf("expected cancelled subscriptions to be removed, %d remain", count)
+	}
+}
+
+func TestTinyBusOfflineQueue(t *testing.T) {
+	b := startBroker(t)
+	addr := b.Addr().String()
+
+	bus, _ := ConnectTinyBus(addr, "TestTinyBusOfflineQueue")
+	defer bus.Destroy()
+
+	connected := make(chan bool, 1)
+	disconnected := make(chan bool, 1)
+	bus.OnConnect(func() { connected <- true })
+	bus.OnDisconnect(func() { disconnected <- true })
+
+	b.Close()
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("bus did not notice the broker going away")
+	}
+
+	// published while there is no broker to send them to
+	bus.PublishWithOptions("testing/offline", []byte("first"), PublishOptions{Retain: true})
+	bus.PublishWithOptions("testing/offline", []byte("second"), PublishOptions{QoS: AtLeastOnce, Retain: true})
+
+	b, err := broker.ListenAndServe(addr)
+	if err != nil {
+		t.Fatalf("Failed to restart broker: %s", err)
+	}
+	defer b.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("bus did not reconnect")
+	}
+
+	deadline := time.Now().Add(time.Second * 2)
+	for {
+		payload, _ := b.Retained("testing/offline")
+		if string(payload) == "second" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected queued messages to be flushed in order, retained payload is %q", payload)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestOutboxPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "mqtt", "test.queue")
+
+	o := newOutbox(2, DropOldest, file)
+	for _, payload := range []string{"one", "two", "three"} {
+		if err := o.push(&queuedMessage{Topic: "testing/outbox", Payload: []byte(payload)}); err != nil {
+			t.Fatalf("Failed to queue %s: %s", payload, err)
+		}
+	}
+
+	if o.dropped != 1 {
+		t.Errorf("expected the oldest message to be dropped, dropped %d", o.dropped)
+	}
+
+	// a new outbox picks up where the last one left off, as it would after a restart
+	restarted := newOutbox(2, DropNewest, file)
+	for _, expected := range []string{"two", "three"} {
+		msg := restarted.pop()
+		if msg == nil || string(msg.Payload) != expected {
+			t.Fatalf("expected queued message %q, got %#v", expected, msg)
+		}
+	}
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expected queue file to be removed once the queue is empty")
+	}
+
+	restarted.push(&queuedMessage{Topic: "a"})
+	restarted.push(&queuedMessage{Topic: "b"})
+	if err := restarted.push(&queuedMessage{Topic: "c"}); err == nil {
+		t.Errorf("expected an error when dropping the newest message")
+	}
+}
+
+func TestOutboxUnbounded(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		o := newOutbox(size, DropOldest, "")
+		for i := 0; i < 10; i++ {
+			if err := o.push(&queuedMessage{Topic: "testing/outbox"}); err != nil {
+				t.Fatalf("Failed to queue message %d with size %d: %s", i, size, err)
+			}
+		}
+
+		if len(o.messages) != 10 || o.dropped != 0 {
+			t.Errorf("expected an outbox of size %d to keep every message, kept %d and dropped %d", size, len(o.messages), o.dropped)
+		}
+	}
+}
+
+func TestClientConnPingTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// a broker that has stopped answering, as if the connection were half-open
+	go io.Copy(ioutil.Discard, server)
+
+	conn := newClientConn(client, func(msg packet) {})
+	go conn.keepalive(time.Millisecond*20, time.Millisecond*50)
+
+	select {
+	case <-conn.done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected connection to be closed after a ping timeout")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for failures, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		delay := backoff(time.Millisecond*100, time.Second, failures)
+		if delay < max/2 || delay > max {
+			t.Errorf("expected delay after %d failures to be between %s and %s, got %s", failures, max/2, max, delay)
+		}
+	}
+}
+
+func TestBackoffFloor(t *testing.T) {
+	os.Setenv("sphere_mqtt_backoff_min", "0s")
+	config.MustRefresh()
+	defer func() {
+		os.Unsetenv("sphere_mqtt_backoff_min")
+		config.MustRefresh()
+	}()
+
+	// a bus never redials the broker without waiting
+	bus := newBrokerBus("mqtt", "localhost:0", "TestBackoffFloor", ConnectOptions{})
+	if bus.backoffMin != minBackoff {
+		t.Errorf("expected the shortest backoff to be %s, got %s", minBackoff, bus.backoffMin)
+	}
+	if delay := backoff(bus.backoffMin, bus.backoffMax, 0); delay < minBackoff/2 {
+		t.Errorf("expected a delay of at least %s, got %s", minBackoff/2, delay)
+	}
+}
+
+func TestTinyBusDestroy(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	b := startBroker(t)
+	bus, _ := ConnectTinyBus(b.Addr().String(), "TestTinyBusDestroy")
+
+	received := make(chan string, 10)
+	bus.Subscribe("testing/destroy", func(topic string, payload []byte) {
+		received <- string(payload)
+	})
+	bus.Publish("testing/destroy", []byte("before"))
+	expectMessage(t, received, "before")
+
+	// nothing the bus started is left running once it and the broker are gone
+	bus.Destroy()
+	b.Close()
+
+	deadline := time.Now().Add(time.Second * 2)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d goroutines after destroying the bus, there are %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestTinyBusState(t *testing.T) {
+	b := startBroker(t)
+	defer b.Close()
+
+	bus, _ := ConnectTinyBus(b.Addr().String(), "TestTinyBusState")
+
+	if state := bus.State(); state != Connected {
+		t.Fatalf("expected bus to be connected, was %s", state)
+	}
+
+	disconnected := make(chan bool, 1)
+	bus.OnDisconnect(func() { disconnected <- true })
+
+	b.Close()
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("bus did not notice the broker going away")
+	}
+
+	deadline := time.Now().Add(time.Second * 2)
+	for bus.State() != Backoff {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected bus to back off while the broker is down, was %s", bus.State())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	bus.Destroy()
+
+	if state := bus.State(); state != Destroyed {
+		t.Errorf("expected bus to be destroyed, was %s", state)
+	}
+}
+
+// writeTestCertificates writes a CA, and a certificate for localhost signed by it, to the directory
+func writeTestCertificates(t *testing.T, dir string) (caFile, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	// the certificate is self signed, so is its own CA
+	return certFile, certFile, keyFile
+}
+
+func TestTinyBusTLSAndCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile, certFile, keyFile := writeTestCertificates(t, dir)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "localhost:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := broker.New()
+	b.Authenticate = func(clientID, username, password string) bool {
+		return username == "sphere" && password == "secret"
+	}
+	go b.Serve(l)
+	defer b.Close()
+
+	tlsConfig, err := loadTLSConfig(caFile, "", "", "localhost")
+	if err != nil {
+		t.Fatalf("Failed to load TLS config: %s", err)
+	}
+
+	// the broker refuses the wrong password
+	conn, err := tls.Dial("tcp", l.Addr().String(), tlsConfig)
+	if err != nil {
+		t.Fatalf("Failed to connect to TLS listener: %s", err)
+	}
+	refused := newClientConn(conn, func(msg packet) {})
+	err = refused.connect(&proto.Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		ClientId:        "refused",
+		UsernameFlag:    true,
+		Username:        "sphere",
+		PasswordFlag:    true,
+		Password:        "wrong",
+	})
+	if err == nil {
+		t.Errorf("expected connection with the wrong password to be refused")
+	}
+	refused.Close()
+
+	bus, _ := ConnectTinyBusWithOptions(l.Addr().String(), "TestTinyBusTLSAndCredentials", ConnectOptions{
+		TLS:      tlsConfig,
+		Username: "sphere",
+		Password: "secret",
+	})
+	defer bus.Destroy()
+
+	received := make(chan string, 10)
+	bus.Subscribe("testing/tls", func(topic string, payload []byte) {
+		received <- string(payload)
+	})
+
+	bus.Publish("testing/tls", []byte("secure"))
+	expectMessage(t, received, "secure")
+}
+
+func TestTinyBusSlowSubscriber(t *testing.T) {
+	b := startBroker(t)
+	defer b.Close()
+
+	bus, _ := ConnectTinyBus(b.Addr().String(), "TestTinyBusSlowSubscriber")
+	defer bus.Destroy()
+
+	// the slow subscriber is stuck in its callback until we let it go
+	entered, stuck := make(chan bool, 10), make(chan bool)
+	slow, _ := bus.SubscribeWithOptions("testing/slow", SubscribeOptions{QueueSize: 2, Overflow: DropOldest}, func(topic string, payload []byte) {
+		entered <- true
+		<-stuck
+	})
+
+	received := make(chan string, 10)
+	bus.Subscribe("testing/slow", func(topic string, payload []byte) {
+		received <- string(payload)
+	})
+
+	bus.Publish("testing/slow", []byte("0"))
+	<-entered
+	for i := 1; i < 5; i++ {
+		bus.Publish("testing/slow", []byte(fmt.Sprintf("%d", i)))
+	}
+
+	for i := 0; i < 5; i++ {
+		expectMessage(t, received, fmt.Sprintf("%d", i))
+	}
+
+	// one is stuck in the callback, two are queued, and the oldest two of the rest were dropped
+	if stats := slow.Stats(); stats.Queued != 2 || stats.Dropped != 2 {
+		t.Fatalf("Expected 2 queued and 2 dropped, got %+v", stats)
+	}
+
+	close(stuck)
+	for slow.Stats().Delivered != 3 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// websocketListener hands the broker the connections upgraded by an http server
+type websocketListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *websocketListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, fmt.Errorf("Listener closed")
+	}
+	return conn, nil
+}
+
+func TestTinyBusTransports(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "transports")
+	defer os.RemoveAll(dir)
+
+	// a broker on a unix socket
+	socket := filepath.Join(dir, "mqtt.sock")
+	unixListener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %s", socket, err)
+	}
+	unixBroker := broker.New()
+	go unixBroker.Serve(unixListener)
+	defer unixBroker.Close()
+
+	// and one behind a websocket
+	tcpListener, _ := net.Listen("tcp", "localhost:0")
+	wsListener := &websocketListener{tcpListener, make(chan net.Conn)}
+	upgrader := websocket.Upgrader{Subprotocols: []string{"mqtt"}}
+	go http.Serve(tcpListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			wsListener.conns <- newWebsocketConn(ws)
+		}
+	}))
+	wsBroker := broker.New()
+	go wsBroker.Serve(wsListener)
+	defer wsBroker.Close()
+
+	for _, host := range []string{"unix://" + socket, "ws://" + tcpListener.Addr().String() + "/mqtt"} {
+		bus, _ := ConnectTinyBus(host, "TestTinyBusTransports")
+
+		received := make(chan string, 10)
+		bus.SubscribeWithOptions("testing/transport", SubscribeOptions{QoS: AtLeastOnce}, func(topic string, payload []byte) {
+			received <- string(payload)
+		})
+		bus.PublishWithOptions("testing/transport", []byte(host), PublishOptions{QoS: AtLeastOnce})
+
+		expectMessage(t, received, host)
+		bus.Destroy()
+	}
+}
@@ -0,0 +1,257 @@
+package bus
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nps5696/go-ninja/config"
+	"github.com/nps5696/go-ninja/model"
+)
+
+// ACL decides which topics a module may publish and subscribe to (see model.TopicRules). Rules may
+// be added while it is in use, e.g. as a module declares its own services and devices.
+type ACL struct {
+	sync.Mutex
+	rules model.ACL
+}
+
+// NewACL returns an ACL enforcing the given rules
+func NewACL(rules model.ACL) *ACL {
+	acl := &ACL{}
+	acl.Add(rules)
+	return acl
+}
+
+// ACLFromConfig reads the rules under mqtt.acl, e.g. mqtt.acl.publish.deny or mqtt.acl.subscribe.allow
+func ACLFromConfig() model.ACL {
+	rules := func(kind string) model.TopicRules {
+		return model.TopicRules{
+			Allow: config.StringArray(nil, "mqtt", "acl", kind, "allow"),
+			Deny:  config.StringArray(nil, "mqtt", "acl", kind, "deny"),
+		}
+	}
+	return model.ACL{
+		Publish:   rules("publish"),
+		Subscribe: rules("subscribe"),
+	}
+}
+
+// Add adds more rules
+func (a *ACL) Add(rules model.ACL) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.rules.Publish.Allow = append(a.rules.Publish.Allow, rules.Publish.Allow...)
+	a.rules.Publish.Deny = append(a.rules.Publish.Deny, rules.Publish.Deny...)
+	a.rules.Subscribe.Allow = append(a.rules.Subscribe.Allow, rules.Subscribe.Allow...)
+	a.rules.Subscribe.Deny = append(a.rules.Subscribe.Deny, rules.Subscribe.Deny...)
+}
+
+// Grant permits publishing and subscribing to the topics matching a pattern, unless a more specific
+// rule denies them
+func (a *ACL) Grant(pattern string) {
+	a.Add(model.ACL{
+		Publish:   model.TopicRules{Allow: []string{pattern}},
+		Subscribe: model.TopicRules{Allow: []string{pattern}},
+	})
+}
+
+// CanPublish returns true if a message may be published to the topic
+func (a *ACL) CanPublish(topic string) bool {
+	a.Lock()
+	defer a.Unlock()
+	return permitted(a.rules.Publish, topic, matches, matches)
+}
+
+// CanSubscribe returns true if the topic filter may be subscribed to. It must be covered by an
+// allowed pattern, or not overlap any denied one.
+func (a *ACL) CanSubscribe(filter string) bool {
+	a.Lock()
+	defer a.Unlock()
+	return permitted(a.rules.Subscribe, filter, covers, overlaps)
+}
+
+// permitted decides whether a topic may be used. The most specific of the rules that apply to it
+// wins, a deny winning a tie, and a topic no rule denies is permitted.
+func permitted(rules model.TopicRules, topic string, allows, denies func(pattern, topic string) bool) bool {
+	deny, denied := mostSpecific(rules.Deny, topic, denies)
+	if !denied {
+		return true
+	}
+	allow, allowed := mostSpecific(rules.Allow, topic, allows)
+	return allowed && specificity(allow, deny) > 0
+}
+
+// mostSpecific returns the most specific of the patterns that apply to the topic
+func mostSpecific(patterns []string, topic string, applies func(pattern, topic string) bool) (string, bool) {
+	var best string
+	found := false
+	for _, pattern := range patterns {
+		if applies(pattern, topic) && (!found || specificity(pattern, best) > 0) {
+			best, found = pattern, true
+		}
+	}
+	return best, found
+}
+
+// specificity compares two patterns level by level, a topic level being more specific than "+",
+// which is more specific than "#". It returns more than zero if a is the more specific, less than
+// zero if b is, and zero if they are as specific as each other.
+func specificity(a, b string) int {
+	rank := func(part string) int {
+		switch part {
+		case "#":
+			return 0
+		case "+":
+			return 1
+		}
+		return 2
+	}
+
+	aParts := strings.Split(a, "/")
+	bParts := strings.Split(b, "/")
+
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if d := rank(aParts[i]) - rank(bParts[i]); d != 0 {
+			return d
+		}
+	}
+
+	return len(aParts) - len(bParts)
+}
+
+// covers returns true if every topic matching the filter also matches the pattern
+func covers(pattern, filter string) bool {
+	patternParts := strings.Split(pattern, "/")
+	filterParts := strings.Split(filter, "/")
+
+	for i, part := range patternParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(filterParts) || filterParts[i] == "#" {
+			return false
+		}
+		if part != "+" && part != filterParts[i] {
+			return false
+		}
+	}
+
+	return len(patternParts) == len(filterParts)
+}
+
+// overlaps returns true if any topic could match both filters
+func overlaps(a, b string) bool {
+	aParts := strings.Split(a, "/")
+	bParts := strings.Split(b, "/")
+
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if aParts[i] == "#" || bParts[i] == "#" {
+			return true
+		}
+		if aParts[i] != "+" && bParts[i] != "+" && aParts[i] != bParts[i] {
+			return false
+		}
+	}
+
+	// make finance/stock/ibm/# overlap finance/stock/ibm
+	switch {
+	case len(aParts) == len(bParts):
+		return true
+	case len(aParts) == len(bParts)+1:
+		return aParts[len(aParts)-1] == "#"
+	case len(bParts) == len(aParts)+1:
+		return bParts[len(bParts)-1] == "#"
+	}
+	return false
+}
+
+// Restrict wraps a bus so that publishing and subscribing are checked against the ACL. Violations
+// are logged, and refused with an error.
+func Restrict(b Bus, acl *ACL) Bus {
+	restricted := &restrictedBus{b, acl}
+
+	if pb, ok := b.(PropertiesBus); ok {
+		return &restrictedPropertiesBus{restricted, pb}
+	}
+	return restricted
+}
+
+type restrictedBus struct {
+	Bus
+	acl *ACL
+}
+
+func (b *restrictedBus) checkPublish(topic string) error {
+	if !b.acl.CanPublish(topic) {
+		log.Warningf("ACL violation: refused to publish to %s", topic)
+		return fmt.Errorf("Not permitted to publish to %s", topic)
+	}
+	return nil
+}
+
+func (b *restrictedBus) checkSubscribe(topic string) error {
+	if !b.acl.CanSubscribe(topic) {
+		log.Warningf("ACL violation: refused to subscribe to %s", topic)
+		return fmt.Errorf("Not permitted to subscribe to %s", topic)
+	}
+	return nil
+}
+
+func (b *restrictedBus) Publish(topic string, payload []byte) {
+	if b.checkPublish(topic) == nil {
+		b.Bus.Publish(topic, payload)
+	}
+}
+
+func (b *restrictedBus) PublishWithOptions(topic string, payload []byte, options PublishOptions) error {
+	if err := b.checkPublish(topic); err != nil {
+		return err
+	}
+	return b.Bus.PublishWithOptions(topic, payload, options)
+}
+
+func (b *restrictedBus) ClearRetained(topic string) error {
+	if err := b.checkPublish(topic); err != nil {
+		return err
+	}
+	return b.Bus.ClearRetained(topic)
+}
+
+func (b *restrictedBus) Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.SubscribeWithOptions(topic, SubscribeOptions{}, callback)
+}
+
+func (b *restrictedBus) SubscribeWithOptions(topic string, options SubscribeOptions, callback func(topic string, payload []byte)) (*Subscription, error) {
+	if err := b.checkSubscribe(topic); err != nil {
+		return nil, err
+	}
+	return b.Bus.SubscribeWithOptions(topic, options, callback)
+}
+
+// subscribeMessages is SubscribeWithOptions, giving the callback the whole of each message where
+// the restricted bus can
+func (b *restrictedBus) subscribeMessages(topic string, options SubscribeOptions, callback func(m *message)) (*Subscription, error) {
+	if err := b.checkSubscribe(topic); err != nil {
+		return nil, err
+	}
+	return subscribeMessages(b.Bus, topic, options, callback)
+}
+
+// carriesProperties returns true if the restricted bus does
+func (b *restrictedBus) carriesProperties() bool {
+	return carriesProperties(b.Bus)
+}
+
+type restrictedPropertiesBus struct {
+	*restrictedBus
+	properties PropertiesBus
+}
+
+func (b *restrictedPropertiesBus) SubscribeWithProperties(topic string, options SubscribeOptions, callback func(topic string, payload []byte, properties *Properties)) (*Subscription, error) {
+	if err := b.checkSubscribe(topic); err != nil {
+		return nil, err
+	}
+	return b.properties.SubscribeWithProperties(topic, options, callback)
+}
@@ -0,0 +1,120 @@
+package bus
+
+import (
+	"testing"
+
+	"github.com/nps5696/go-ninja/model"
+)
+
+func TestACL(t *testing.T) {
+	acl := NewACL(model.ACL{
+		Publish: model.TopicRules{
+			Deny: []string{"$device/+/channel/+"},
+		},
+		Subscribe: model.TopicRules{
+			Allow: []string{"$node/1234/app/myapp/#"},
+			Deny:  []string{"$node/+/config"},
+		},
+	})
+	acl.Grant("$device/mine/#")
+
+	for topic, expected := range map[string]bool{
+		"$device/theirs/channel/on-off": false,
+		"$device/mine/channel/on-off":   true,
+		"$device/theirs/channel":        true,
+		"$node/1234/config":             true,
+	} {
+		if acl.CanPublish(topic) != expected {
+			t.Errorf("Expected CanPublish(%q) to be %t", topic, expected)
+		}
+	}
+
+	for filter, expected := range map[string]bool{
+		"$node/1234/config":           false,
+		"$node/+/config":              false,
+		"$node/#":                     false,
+		"#":                           false,
+		"$node/+/+":                   false,
+		"$node/1234/config/x":         true,
+		"$node/1234/app/myapp/config": true,
+		"$node/1234/app/myapp/#":      true,
+		"$device/mine/channel/+":      true,
+		"$device/+/channel/+":         true,
+	} {
+		if acl.CanSubscribe(filter) != expected {
+			t.Errorf("Expected CanSubscribe(%q) to be %t", filter, expected)
+		}
+	}
+}
+
+func TestACLOverlap(t *testing.T) {
+	acl := NewACL(model.ACL{
+		Publish:   model.TopicRules{Deny: []string{"$node/+/config", "$rpc/#"}},
+		Subscribe: model.TopicRules{Deny: []string{"$node/+/config", "$rpc/#"}},
+	})
+	acl.Grant("$node/#")
+	acl.Grant("$rpc/mine/#")
+
+	// the most specific rule wins, whichever order they were added in
+	for topic, expected := range map[string]bool{
+		"$node/1234/config":  false,
+		"$node/1234/state":   true,
+		"$rpc/mine/reply":    true,
+		"$rpc/theirs/reply":  false,
+		"$node/1234/config2": true,
+	} {
+		if acl.CanPublish(topic) != expected {
+			t.Errorf("Expected CanPublish(%q) to be %t", topic, expected)
+		}
+	}
+
+	for filter, expected := range map[string]bool{
+		"$node/1234/config": false,
+		"$node/#":           false,
+		"$node/1234/+":      false,
+		"$node/1234/state":  true,
+		"$rpc/mine/#":       true,
+		"$rpc/mine/reply":   true,
+		"$rpc/#":            false,
+		"$rpc/+/reply":      false,
+	} {
+		if acl.CanSubscribe(filter) != expected {
+			t.Errorf("Expected CanSubscribe(%q) to be %t", filter, expected)
+		}
+	}
+
+	// a deny wins a tie
+	tie := NewACL(model.ACL{Publish: model.TopicRules{Allow: []string{"$device/+/channel"}, Deny: []string{"$device/+/channel"}}})
+	if tie.CanPublish("$device/abc/channel") {
+		t.Errorf("Expected a deny to win over an allow of the same pattern")
+	}
+}
+
+func TestRestrictedBus(t *testing.T) {
+	memory, _ := ConnectMemoryBus("TestRestrictedBus", "bus")
+	defer memory.Destroy()
+
+	bus := Restrict(memory, NewACL(model.ACL{
+		Publish:   model.TopicRules{Deny: []string{"$device/#"}},
+		Subscribe: model.TopicRules{Deny: []string{"$node/+/config"}},
+	}))
+
+	if err := bus.PublishWithOptions("$device/theirs/channel/on-off", []byte("true"), PublishOptions{}); err == nil {
+		t.Errorf("Expected publishing to be refused")
+	}
+
+	if _, err := bus.Subscribe("$node/#", func(topic string, payload []byte) {}); err == nil {
+		t.Errorf("Expected subscribing to be refused")
+	}
+
+	received := make(chan string, 10)
+	if _, err := bus.Subscribe("$node/1234/app/+", func(topic string, payload []byte) {
+		received <- topic
+	}); err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+	}
+	if err := bus.PublishWithOptions("$node/1234/app/myapp", nil, PublishOptions{}); err != nil {
+		t.Fatalf("Failed to publish: %s", err)
+	}
+	expectMessage(t, received, "$node/1234/app/myapp")
+}
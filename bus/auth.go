@@ -0,0 +1,77 @@
+package bus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/nps5696/go-ninja/config"
+)
+
+// ConnectOptions holds the transport security and credentials used when connecting to the broker
+type ConnectOptions struct {
+	// TLS, if set, is used to secure the connection
+	TLS      *tls.Config
+	Username string
+	Password string
+}
+
+// ConnectOptionsFromConfig builds the ConnectOptions described by the mqtt config:
+//
+//	mqtt.tls         connect using TLS (implied by any of the files below)
+//	mqtt.caFile      PEM bundle of the CAs to trust, instead of the system's
+//	mqtt.certFile    PEM client certificate...
+//	mqtt.keyFile     ...and its private key
+//	mqtt.serverName  name the broker's certificate must match, if not the host we connect to
+//	mqtt.username
+//	mqtt.password
+func ConnectOptionsFromConfig() (ConnectOptions, error) {
+	options := ConnectOptions{
+		Username: config.String("", "mqtt", "username"),
+		Password: config.String("", "mqtt", "password"),
+	}
+
+	caFile := config.String("", "mqtt", "caFile")
+	certFile := config.String("", "mqtt", "certFile")
+	keyFile := config.String("", "mqtt", "keyFile")
+	serverName := config.String("", "mqtt", "serverName")
+
+	if config.Bool(false, "mqtt", "tls") || caFile != "" || certFile != "" {
+		tlsConfig, err := loadTLSConfig(caFile, certFile, keyFile, serverName)
+		if err != nil {
+			return options, err
+		}
+		options.TLS = tlsConfig
+	}
+
+	return options, nil
+}
+
+func loadTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read mqtt CA bundle: %s", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Failed to read mqtt CA bundle: no certificates found in %s", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load mqtt client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
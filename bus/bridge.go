@@ -0,0 +1,270 @@
+package bus
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// echoWindow is how long the bridge waits for a message it forwarded to come back to it
+var echoWindow = time.Second * 10
+
+// bridgeProperty is the user property that marks a message forwarded by a bridge, with the
+// bridge's id
+const bridgeProperty = "bridge"
+
+// messageBus is implemented by the buses in this package, which can give a subscriber the whole of
+// each message rather than just its topic and payload
+type messageBus interface {
+	subscribeMessages(topic string, options SubscribeOptions, callback func(m *message)) (*Subscription, error)
+	// carriesProperties returns true if the properties of a message reach its subscribers
+	carriesProperties() bool
+}
+
+// subscribeMessages subscribes to a bus, giving the callback the whole of each message where the
+// bus can, and otherwise as much of it as the bus does give
+func subscribeMessages(bus Bus, topic string, options SubscribeOptions, callback func(m *message)) (*Subscription, error) {
+	switch b := bus.(type) {
+	case messageBus:
+		return b.subscribeMessages(topic, options, callback)
+	case PropertiesBus:
+		return b.SubscribeWithProperties(topic, options, func(topic string, payload []byte, properties *Properties) {
+			callback(&message{topic: topic, payload: payload, properties: properties})
+		})
+	}
+	return bus.SubscribeWithOptions(topic, options, func(topic string, payload []byte) {
+		callback(&message{topic: topic, payload: payload})
+	})
+}
+
+// BridgeRule selects messages to forward across a bridge, and how to rewrite their topics
+type BridgeRule struct {
+	// Filter is the topic filter the bridge subscribes to
+	Filter string
+	// Prefix is replaced with Replacement in the topics of the messages that start with it.
+	// Other messages are forwarded unchanged.
+	Prefix      string
+	Replacement string
+	// QoS is used to subscribe to, and to forward, the messages
+	QoS QoS
+}
+
+// PrefixRule forwards every message under a topic prefix, swapping it for another
+func PrefixRule(prefix, replacement string) BridgeRule {
+	return BridgeRule{
+		Filter:      prefix + "#",
+		Prefix:      prefix,
+		Replacement: replacement,
+	}
+}
+
+// SiteRules are the rules for bridging a node's bus to a site-wide one, so that the nodes of a site
+// (see config.IsMaster and config.IsSlave) can see each other's devices: $device/... is forwarded
+// to the site as site/<siteID>/device/..., and the reverse.
+func SiteRules(siteID string) (outgoing, incoming []BridgeRule) {
+	site := fmt.Sprintf("site/%s/device/", siteID)
+	return []BridgeRule{PrefixRule("$device/", site)}, []BridgeRule{PrefixRule(site, "$device/")}
+}
+
+// Bridge forwards messages between two buses, e.g. a sphere's own broker and a site-wide one.
+//
+// Messages are forwarded at the rule's QoS, and keep their retain flag and properties where the
+// buses have them. (A broker only flags a message as retained when it is sent to a new
+// subscription, so later updates to a retained topic are forwarded as plain messages.)
+//
+// A message the bridge forwards will usually come straight back to it, either because the bridge
+// is subscribed to its new topic on the other side, or because the other side forwards it back.
+// These echoes are dropped, so nothing loops. Where the bus forwarded to carries message
+// properties, the bridge marks what it forwards with its id in the "bridge" user property, and
+// knows its echoes by that. Otherwise the bridge counts the copies of each message it forwards that
+// its own subscriptions will bring back, and drops that many messages with the same topic and
+// payload when they arrive (so an unrelated message with the same topic and payload, arriving
+// before an echo, is taken for it). The filters of the rules in each direction shouldn't overlap,
+// or a message matching more than one will be forwarded more than once.
+type Bridge struct {
+	sync.Mutex
+	id            string
+	local, remote Bus
+	subscriptions []*Subscription
+	// the topic filters we have subscribed to on each bus
+	filters map[Bus][]string
+
+	// the messages we have forwarded to each bus, that haven't come back yet, oldest first
+	echoes  map[Bus]map[string][]*echo
+	pending []*echo
+}
+
+type echo struct {
+	to   Bus
+	key  string
+	at   time.Time
+	seen bool
+}
+
+// NewBridge starts forwarding messages from the local bus to the remote one according to the
+// outgoing rules, and from the remote bus to the local one according to the incoming rules.
+func NewBridge(local, remote Bus, outgoing, incoming []BridgeRule) (*Bridge, error) {
+	bridge := &Bridge{
+		id:      fmt.Sprintf("%08x", rand.Uint32()),
+		local:   local,
+		remote:  remote,
+		filters: make(map[Bus][]string),
+		echoes: map[Bus]map[string][]*echo{
+			local:  make(map[string][]*echo),
+			remote: make(map[string][]*echo),
+		},
+	}
+
+	for _, rule := range outgoing {
+		if err := bridge.forward(local, remote, rule); err != nil {
+			bridge.Close()
+			return nil, err
+		}
+	}
+
+	for _, rule := range incoming {
+		if err := bridge.forward(remote, local, rule); err != nil {
+			bridge.Close()
+			return nil, err
+		}
+	}
+
+	return bridge, nil
+}
+
+func (b *Bridge) forward(from, to Bus, rule BridgeRule) error {
+	marked := carriesProperties(to)
+
+	forward := func(m *message) {
+		if b.isEcho(from, m) {
+			return
+		}
+
+		topic := m.topic
+		if rule.Prefix != "" && strings.HasPrefix(topic, rule.Prefix) {
+			topic = rule.Replacement + strings.TrimPrefix(topic, rule.Prefix)
+		}
+
+		options := PublishOptions{QoS: rule.QoS, Retain: m.retained}
+		if marked {
+			options.Properties = b.mark(m.properties)
+		} else {
+			// remember it before publishing, as it may come back before we return
+			b.expect(to, topic, m.payload)
+		}
+
+		if err := to.PublishWithOptions(topic, m.payload, options); err != nil {
+			log.Warningf("Failed to forward message to %s across the bridge: %s", topic, err)
+		}
+	}
+
+	subscription, err := subscribeMessages(from, rule.Filter, SubscribeOptions{QoS: rule.QoS}, forward)
+	if err != nil {
+		return fmt.Errorf("Failed to subscribe to %s for the bridge: %s", rule.Filter, err)
+	}
+
+	b.Lock()
+	b.subscriptions = append(b.subscriptions, subscription)
+	b.filters[from] = append(b.filters[from], rule.Filter)
+	b.Unlock()
+	return nil
+}
+
+// expect notes that a message has been forwarded to a bus, so we'll know it when it comes back. It
+// comes back once for each of our subscriptions to that bus that it matches, if any.
+func (b *Bridge) expect(to Bus, topic string, payload []byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.expire()
+
+	key := topic + "\x00" + string(payload)
+	for _, filter := range b.filters[to] {
+		if matches(filter, topic) {
+			e := &echo{to: to, key: key, at: time.Now()}
+			b.echoes[to][key] = append(b.echoes[to][key], e)
+			b.pending = append(b.pending, e)
+		}
+	}
+}
+
+// carriesProperties returns true if the properties of the messages published to a bus reach its
+// subscribers, so the bridge can mark what it forwards
+func carriesProperties(bus Bus) bool {
+	mb, ok := bus.(messageBus)
+	return ok && mb.carriesProperties()
+}
+
+// mark copies the properties of a message, adding the bridge's id
+func (b *Bridge) mark(properties *Properties) *Properties {
+	marked := &Properties{UserProperties: map[string]string{bridgeProperty: b.id}}
+	if properties != nil {
+		marked.ResponseTopic = properties.ResponseTopic
+		marked.CorrelationData = properties.CorrelationData
+		for key, value := range properties.UserProperties {
+			if key != bridgeProperty {
+				marked.UserProperties[key] = value
+			}
+		}
+	}
+	return marked
+}
+
+// isEcho returns true if a message from a bus is one we forwarded to it
+func (b *Bridge) isEcho(from Bus, m *message) bool {
+	if m.properties != nil && m.properties.UserProperties[bridgeProperty] == b.id {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.expire()
+
+	key := m.topic + "\x00" + string(m.payload)
+	echoes := b.echoes[from][key]
+	if len(echoes) == 0 {
+		return false
+	}
+
+	echoes[0].seen = true
+	b.forget(from, key)
+	return true
+}
+
+// expire forgets the messages that haven't come back within the echo window. The lock must be held.
+func (b *Bridge) expire() {
+	cutoff := time.Now().Add(-echoWindow)
+	for len(b.pending) > 0 && (b.pending[0].seen || b.pending[0].at.Before(cutoff)) {
+		e := b.pending[0]
+		b.pending[0] = nil
+		b.pending = b.pending[1:]
+		if !e.seen {
+			b.forget(e.to, e.key)
+		}
+	}
+}
+
+// forget drops the oldest message we're expecting back from a bus with the key. The lock must be held.
+func (b *Bridge) forget(from Bus, key string) {
+	echoes := b.echoes[from][key]
+	if len(echoes) == 1 {
+		delete(b.echoes[from], key)
+	} else {
+		b.echoes[from][key] = echoes[1:]
+	}
+}
+
+// Close stops forwarding messages. The buses are left connected.
+func (b *Bridge) Close() {
+	b.Lock()
+	subscriptions := b.subscriptions
+	b.subscriptions = nil
+	b.Unlock()
+
+	for _, s := range subscriptions {
+		s.Cancel()
+	}
+}
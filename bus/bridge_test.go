@@ -0,0 +1,244 @@
+package bus
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/nps5696/go-ninja/model"
+)
+
+func TestBridge(t *testing.T) {
+	// two nodes of a site, each with their own bus, bridged to the site's bus
+	node1, _ := ConnectMemoryBus("TestBridge/node1", "node1")
+	defer node1.Destroy()
+	node2, _ := ConnectMemoryBus("TestBridge/node2", "node2")
+	defer node2.Destroy()
+	site, _ := ConnectMemoryBus("TestBridge/site", "site")
+	defer site.Destroy()
+
+	outgoing, incoming := SiteRules("1234")
+	for _, node := range []*MemoryBus{node1, node2} {
+		bridge, err := NewBridge(node, site, outgoing, incoming)
+		if err != nil {
+			t.Fatalf("Failed to start bridge: %s", err)
+		}
+		defer bridge.Close()
+	}
+
+	received := make(chan string, 10)
+	for name, b := range map[string]*MemoryBus{"node1": node1, "node2": node2, "site": site} {
+		name := name
+		b.Subscribe("#", func(topic string, payload []byte) {
+			received <- name + " " + topic + " " + string(payload)
+		})
+	}
+
+	node1.Publish("$device/abc/channel/on-off", []byte("true"))
+
+	// every bus sees the message once, and it isn't echoed back to the node it came from
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case got := <-received:
+			seen[got] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out, only saw %v", seen)
+		}
+	}
+
+	for _, expected := range []string{
+		"node1 $device/abc/channel/on-off true",
+		"site site/1234/device/abc/channel/on-off true",
+		"node2 $device/abc/channel/on-off true",
+	} {
+		if !seen[expected] {
+			t.Errorf("Expected %q, saw %v", expected, seen)
+		}
+	}
+
+	select {
+	case got := <-received:
+		t.Fatalf("Unexpected message %q", got)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestBridgeRetained(t *testing.T) {
+	node, _ := ConnectMemoryBus("TestBridgeRetained/node", "node")
+	defer node.Destroy()
+	site, _ := ConnectMemoryBus("TestBridgeRetained/site", "site")
+	defer site.Destroy()
+
+	outgoing, incoming := SiteRules("1234")
+	bridge, err := NewBridge(node, site, outgoing, incoming)
+	if err != nil {
+		t.Fatalf("Failed to start bridge: %s", err)
+	}
+	defer bridge.Close()
+
+	node.PublishWithOptions("$device/abc/channel/on-off", []byte("true"), PublishOptions{Retain: true})
+
+	// a subscriber that turns up later still gets it from the site
+	received := make(chan string, 10)
+	site.SubscribeWithOptions("site/1234/device/#", SubscribeOptions{ReplayRetained: true}, func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+	expectMessage(t, received, "site/1234/device/abc/channel/on-off true")
+}
+
+func TestBridgeRepeats(t *testing.T) {
+	node, _ := ConnectMemoryBus("TestBridgeRepeats/node", "node")
+	defer node.Destroy()
+	site, _ := ConnectMemoryBus("TestBridgeRepeats/site", "site")
+	defer site.Destroy()
+
+	outgoing, incoming := SiteRules("1234")
+	bridge, err := NewBridge(node, site, outgoing, incoming)
+	if err != nil {
+		t.Fatalf("Failed to start bridge: %s", err)
+	}
+	defer bridge.Close()
+
+	received := make(chan string, 10)
+	node.Subscribe("$device/#", func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+
+	node.Publish("$device/abc/channel/on-off", []byte("true"))
+	expectMessage(t, received, "$device/abc/channel/on-off true")
+
+	// the same message from another node on the site is forwarded, not taken for an echo
+	site.Publish("site/1234/device/abc/channel/on-off", []byte("true"))
+	expectMessage(t, received, "$device/abc/channel/on-off true")
+
+	// the bridge knows its echoes by their mark, so it isn't waiting for any
+	bridge.Lock()
+	pending := len(bridge.pending)
+	bridge.Unlock()
+	if pending != 0 {
+		t.Errorf("Expected the bridge to mark what it forwards, it is waiting for %d echoes", pending)
+	}
+
+	select {
+	case got := <-received:
+		t.Fatalf("Unexpected message %q", got)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// plainBus hides everything but the Bus interface of the bus it wraps, as if it were a bus from
+// another package
+type plainBus struct {
+	Bus
+}
+
+func TestBridgeRetainedWrapped(t *testing.T) {
+	acl := NewACL(model.ACL{})
+	acl.Grant("#")
+
+	wrappers := map[string]func(Bus) Bus{
+		"restricted":  func(b Bus) Bus { return Restrict(b, acl) },
+		"intercepted": func(b Bus) Bus { return Intercept(b) },
+		"recorded":    func(b Bus) Bus { return Record(b, ioutil.Discard) },
+	}
+
+	for name, wrap := range wrappers {
+		memory, _ := ConnectMemoryBus("TestBridgeRetainedWrapped/node/"+name, "node")
+		defer memory.Destroy()
+		site, _ := ConnectMemoryBus("TestBridgeRetainedWrapped/site/"+name, "site")
+		defer site.Destroy()
+
+		node := wrap(memory)
+		outgoing, incoming := SiteRules("1234")
+		bridge, err := NewBridge(node, site, outgoing, incoming)
+		if err != nil {
+			t.Fatalf("Failed to start bridge: %s", err)
+		}
+		defer bridge.Close()
+
+		forwarded := make(chan string, 10)
+		site.Subscribe("site/1234/device/#", func(topic string, payload []byte) {
+			forwarded <- topic + " " + string(payload)
+		})
+
+		memory.PublishWithOptions("$device/abc/channel/on-off", []byte(name), PublishOptions{Retain: true})
+		expectMessage(t, forwarded, "site/1234/device/abc/channel/on-off "+name)
+
+		// once it has crossed the bridge, a later subscriber gets it from the site
+		var replayed []string
+		site.SubscribeWithOptions("site/1234/device/#", SubscribeOptions{ReplayRetained: true}, func(topic string, payload []byte) {
+			replayed = append(replayed, topic+" "+string(payload))
+		})
+		if len(replayed) != 1 || replayed[0] != "site/1234/device/abc/channel/on-off "+name {
+			t.Errorf("%s bus: expected the retained message to be replayed, got %v", name, replayed)
+		}
+	}
+}
+
+func TestBridgeEchoes(t *testing.T) {
+	memory, _ := ConnectMemoryBus("TestBridgeEchoes/node", "node")
+	defer memory.Destroy()
+	site, _ := ConnectMemoryBus("TestBridgeEchoes/site", "site")
+	defer site.Destroy()
+
+	// neither bus carries properties, so the bridge knows its echoes by their topic and payload. Two
+	// of its subscriptions bring back what it forwards to abc, and none what it forwards to xyz.
+	node := plainBus{memory}
+	outgoing := []BridgeRule{PrefixRule("$device/", "site/1234/device/")}
+	incoming := []BridgeRule{
+		PrefixRule("site/1234/device/abc/", "$device/abc/"),
+		{Filter: "site/1234/device/abc/channel/#"},
+	}
+	bridge, err := NewBridge(node, plainBus{site}, outgoing, incoming)
+	if err != nil {
+		t.Fatalf("Failed to start bridge: %s", err)
+	}
+	defer bridge.Close()
+
+	received := make(chan string, 10)
+	memory.Subscribe("#", func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+
+	// both echoes are dropped
+	memory.Publish("$device/abc/channel/on-off", []byte("true"))
+	expectMessage(t, received, "$device/abc/channel/on-off true")
+
+	// nothing comes back from xyz, so nothing is expected
+	memory.Publish("$device/xyz/channel/on-off", []byte("true"))
+	expectMessage(t, received, "$device/xyz/channel/on-off true")
+
+	time.Sleep(time.Millisecond * 100)
+
+	bridge.Lock()
+	bridge.expire()
+	pending := len(bridge.pending)
+	bridge.Unlock()
+	if pending != 0 {
+		t.Errorf("Expected the bridge to have seen its echoes, it is waiting for %d", pending)
+	}
+
+	// so the same message from elsewhere is forwarded, by each rule it matches
+	site.Publish("site/1234/device/abc/channel/on-off", []byte("true"))
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-received:
+			seen[got] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out, only saw %v", seen)
+		}
+	}
+	for _, expected := range []string{"$device/abc/channel/on-off true", "site/1234/device/abc/channel/on-off true"} {
+		if !seen[expected] {
+			t.Errorf("Expected %q, saw %v", expected, seen)
+		}
+	}
+
+	select {
+	case got := <-received:
+		t.Fatalf("Unexpected message %q", got)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
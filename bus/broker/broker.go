@@ -0,0 +1,267 @@
+// Package broker is a small embeddable MQTT broker, intended for tests and for running modules on a
+// development machine without mosquitto.
+//
+// It speaks MQTT 3.1 and 3.1.1 and supports subscribe/unsubscribe with wildcards, retained messages,
+// last-will messages, QoS 0, 1 and 2 delivery and persistent sessions. It is not intended for
+// production use.
+package broker
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	proto "github.com/huin/mqtt"
+	"github.com/nps5696/go-ninja/logger"
+)
+
+var log = logger.GetLogger("broker")
+
+// Broker routes published messages to the subscribed clients.
+type Broker struct {
+	// Authenticate, if set, decides whether a client may connect with the given credentials
+	Authenticate func(clientID, username, password string) bool
+
+	sync.Mutex
+	listener net.Listener
+	clients  map[string]*client
+	sessions map[string]*session
+	retained map[string]*proto.Publish
+	closed   bool
+}
+
+// New returns a broker that is not yet listening.
+func New() *Broker {
+	return &Broker{
+		clients:  make(map[string]*client),
+		sessions: make(map[string]*session),
+		retained: make(map[string]*proto.Publish),
+	}
+}
+
+// ListenAndServe starts a broker listening on the given tcp address (e.g. "localhost:1883"). Use
+// port 0 to pick a free port, and Addr to find out which one was chosen.
+func ListenAndServe(addr string) (*Broker, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	b := New()
+	go b.Serve(l)
+
+	return b, nil
+}
+
+// Serve accepts client connections on the listener until the broker is closed.
+func (b *Broker) Serve(l net.Listener) error {
+	b.Lock()
+	b.listener = l
+	b.Unlock()
+
+	log.Infof("Listening on %s", l.Addr())
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if b.isClosed() {
+				return nil
+			}
+			return err
+		}
+		go newClient(b, conn).serve()
+	}
+}
+
+// Addr returns the address the broker is listening on.
+func (b *Broker) Addr() net.Addr {
+	b.Lock()
+	defer b.Unlock()
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Addr()
+}
+
+// Close stops listening and drops every connected client without publishing their wills.
+func (b *Broker) Close() error {
+	b.Lock()
+	b.closed = true
+	clients := b.clients
+	b.clients = make(map[string]*client)
+	listener := b.listener
+	b.Unlock()
+
+	for _, c := range clients {
+		c.Lock()
+		c.will = nil
+		c.Unlock()
+		c.close()
+	}
+
+	if listener != nil {
+		return listener.Close()
+	}
+	return nil
+}
+
+// Disconnect drops the connection of the client with the given id as if the network had failed,
+// so its last-will message is published. It returns an error if no such client is connected.
+func (b *Broker) Disconnect(clientID string) error {
+	b.Lock()
+	c, ok := b.clients[clientID]
+	b.Unlock()
+
+	if !ok {
+		return fmt.Errorf("No client connected with id %s", clientID)
+	}
+
+	c.close()
+	return nil
+}
+
+// Retained returns the payload retained on a topic, if any.
+func (b *Broker) Retained(topic string) ([]byte, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	msg, ok := b.retained[topic]
+	if !ok {
+		return nil, false
+	}
+	return []byte(msg.Payload.(proto.BytesPayload)), true
+}
+
+func (b *Broker) isClosed() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.closed
+}
+
+// register adds a newly connected client, dropping any existing client with the same id. The
+// client's previous session is returned if it asked to keep it, otherwise a new one is started.
+func (b *Broker) register(c *client, cleanSession bool) *session {
+	b.Lock()
+	existing := b.clients[c.id]
+	b.clients[c.id] = c
+
+	s, ok := b.sessions[c.id]
+	if !ok || cleanSession {
+		s = newSession(c.id, !cleanSession)
+		b.sessions[c.id] = s
+	}
+	s.persistent = !cleanSession
+	b.Unlock()
+
+	if existing != nil {
+		log.Infof("Client %s connected again, dropping the old connection", c.id)
+		existing.close()
+	}
+
+	return s
+}
+
+func (b *Broker) unregister(c *client) {
+	b.Lock()
+	defer b.Unlock()
+	if b.clients[c.id] == c {
+		delete(b.clients, c.id)
+		if s := b.sessions[c.id]; s != nil && !s.persistent {
+			delete(b.sessions, c.id)
+		}
+	}
+}
+
+// publish stores the message if it is retained, and sends it to every matching subscriber.
+func (b *Broker) publish(msg *proto.Publish) {
+
+	payload := []byte(msg.Payload.(proto.BytesPayload))
+
+	b.Lock()
+	if msg.Retain {
+		if len(payload) == 0 {
+			delete(b.retained, msg.TopicName)
+		} else {
+			b.retained[msg.TopicName] = msg
+		}
+	}
+
+	sessions := make([]*session, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.Unlock()
+
+	for _, s := range sessions {
+		qos, ok := s.qos(msg.TopicName)
+		if !ok {
+			continue
+		}
+
+		// deliver at the lower of the published and subscribed QoS
+		if msg.QosLevel < qos {
+			qos = msg.QosLevel
+		}
+
+		s.deliver(&proto.Publish{
+			Header: proto.Header{
+				QosLevel: qos,
+			},
+			TopicName: msg.TopicName,
+			Payload:   proto.BytesPayload(payload),
+		})
+	}
+}
+
+// sendRetained sends every retained message matching the subscription to the client.
+func (b *Broker) sendRetained(s *session, subscription string, qos proto.QosLevel) {
+	b.Lock()
+	var messages []*proto.Publish
+	for topic, msg := range b.retained {
+		if matches(subscription, topic) {
+			messages = append(messages, msg)
+		}
+	}
+	b.Unlock()
+
+	for _, msg := range messages {
+		retainedQos := msg.QosLevel
+		if qos < retainedQos {
+			retainedQos = qos
+		}
+
+		s.deliver(&proto.Publish{
+			Header: proto.Header{
+				Retain:   true,
+				QosLevel: retainedQos,
+			},
+			TopicName: msg.TopicName,
+			Payload:   msg.Payload,
+		})
+	}
+}
+
+func matches(subscription string, topic string) bool {
+	subParts := strings.Split(subscription, "/")
+	parts := strings.Split(topic, "/")
+
+	// wildcards don't match topics beginning with $, as per the spec
+	if strings.HasPrefix(topic, "$") && (subParts[0] == "+" || subParts[0] == "#") {
+		return false
+	}
+
+	for i, part := range subParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(parts) {
+			return false
+		}
+		if part != "+" && part != parts[i] {
+			return false
+		}
+	}
+
+	return len(parts) == len(subParts)
+}
@@ -0,0 +1,265 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// outgoingBuffer is the number of messages queued for a client before it is considered too slow
+const outgoingBuffer = 1024
+
+type client struct {
+	sync.Mutex
+	broker       *Broker
+	session      *session
+	conn         net.Conn
+	id           string
+	cleanSession bool
+	will         *proto.Publish
+	out          chan proto.Message
+	done         chan bool
+	closeOnce    sync.Once
+}
+
+func newClient(b *Broker, conn net.Conn) *client {
+	return &client{
+		broker: b,
+		conn:   conn,
+		out:    make(chan proto.Message, outgoingBuffer),
+		done:   make(chan bool),
+	}
+}
+
+func (c *client) serve() {
+	defer c.conn.Close()
+
+	if err := c.handshake(); err != nil {
+		log.Infof("Rejected connection from %s: %s", c.conn.RemoteAddr(), err)
+		return
+	}
+
+	go c.writer()
+
+	c.session = c.broker.register(c, c.cleanSession)
+	c.session.resume(c)
+
+	err := c.reader()
+
+	c.session.detach(c)
+	c.broker.unregister(c)
+	c.close()
+
+	c.Lock()
+	will := c.will
+	c.Unlock()
+
+	if will != nil {
+		log.Debugf("Client %s went away (%s), publishing will on %s", c.id, err, will.TopicName)
+		c.broker.publish(will)
+	}
+}
+
+// handshake reads the CONNECT message and replies with a CONNACK
+func (c *client) handshake() error {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+
+	msg, err := proto.DecodeOneMessage(c.conn, nil)
+	if err != nil {
+		return err
+	}
+
+	connect, ok := msg.(*proto.Connect)
+	if !ok {
+		return fmt.Errorf("Expected CONNECT, got %T", msg)
+	}
+
+	code := proto.RetCodeAccepted
+
+	switch {
+	case connect.ProtocolName == "MQIsdp" && connect.ProtocolVersion == 3:
+	case connect.ProtocolName == "MQTT" && connect.ProtocolVersion == 4:
+	default:
+		code = proto.RetCodeUnacceptableProtocolVersion
+	}
+
+	if connect.ClientId == "" {
+		if connect.ProtocolVersion == 4 && connect.CleanSession {
+			connect.ClientId = fmt.Sprintf("auto-%s", c.conn.RemoteAddr())
+		} else {
+			code = proto.RetCodeIdentifierRejected
+		}
+	}
+
+	if code == proto.RetCodeAccepted && c.broker.Authenticate != nil {
+		if !c.broker.Authenticate(connect.ClientId, connect.Username, connect.Password) {
+			code = proto.RetCodeBadUsernameOrPassword
+		}
+	}
+
+	(&proto.ConnAck{ReturnCode: code}).Encode(c.conn)
+
+	if code != proto.RetCodeAccepted {
+		return fmt.Errorf("CONNECT refused with code %d", code)
+	}
+
+	c.id = connect.ClientId
+	c.cleanSession = connect.CleanSession
+
+	if connect.WillFlag {
+		c.will = &proto.Publish{
+			Header: proto.Header{
+				Retain: connect.WillRetain,
+			},
+			TopicName: connect.WillTopic,
+			Payload:   proto.BytesPayload([]byte(connect.WillMessage)),
+		}
+	}
+
+	c.conn.SetReadDeadline(time.Time{})
+
+	// allow one and a half keepalive periods between messages, as per the spec
+	if connect.KeepAliveTimer > 0 {
+		c.conn = &deadlineConn{c.conn, time.Duration(connect.KeepAliveTimer) * time.Second * 3 / 2}
+	}
+
+	log.Debugf("Client %s connected from %s", c.id, c.conn.RemoteAddr())
+
+	return nil
+}
+
+func (c *client) reader() error {
+	for {
+		msg, err := proto.DecodeOneMessage(c.conn, nil)
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *proto.Publish:
+			switch msg.QosLevel {
+			case proto.QosAtMostOnce:
+				c.broker.publish(msg)
+			case proto.QosAtLeastOnce:
+				c.broker.publish(msg)
+				c.send(&proto.PubAck{MessageId: msg.MessageId})
+			case proto.QosExactlyOnce:
+				// only route the first copy, until the client releases the id
+				c.session.Lock()
+				duplicate := c.session.received[msg.MessageId]
+				c.session.received[msg.MessageId] = true
+				c.session.Unlock()
+
+				if !duplicate {
+					c.broker.publish(msg)
+				}
+				c.send(&proto.PubRec{MessageId: msg.MessageId})
+			}
+
+		case *proto.PubRel:
+			c.session.Lock()
+			delete(c.session.received, msg.MessageId)
+			c.session.Unlock()
+
+			c.send(&proto.PubComp{MessageId: msg.MessageId})
+
+		case *proto.PubAck, *proto.PubRec, *proto.PubComp:
+			c.session.acknowledged(msg)
+
+		case *proto.Subscribe:
+			granted := make([]proto.QosLevel, len(msg.Topics))
+			c.session.Lock()
+			for i, t := range msg.Topics {
+				qos := t.Qos
+				if qos > proto.QosExactlyOnce {
+					qos = proto.QosExactlyOnce
+				}
+				c.session.subscriptions[t.Topic] = qos
+				granted[i] = qos
+			}
+			c.session.Unlock()
+
+			c.send(&proto.SubAck{MessageId: msg.MessageId, TopicsQos: granted})
+
+			for i, t := range msg.Topics {
+				c.broker.sendRetained(c.session, t.Topic, granted[i])
+			}
+
+		case *proto.Unsubscribe:
+			c.session.Lock()
+			for _, topic := range msg.Topics {
+				delete(c.session.subscriptions, topic)
+			}
+			c.session.Unlock()
+
+			c.send(&proto.UnsubAck{MessageId: msg.MessageId})
+
+		case *proto.PingReq:
+			c.send(&proto.PingResp{})
+
+		case *proto.Disconnect:
+			// a clean disconnect discards the will
+			c.Lock()
+			c.will = nil
+			c.Unlock()
+			return nil
+
+		default:
+			return fmt.Errorf("Unexpected message %T", msg)
+		}
+	}
+}
+
+func (c *client) writer() {
+	for {
+		select {
+		case msg := <-c.out:
+			if err := msg.Encode(c.conn); err != nil {
+				log.Debugf("Failed to write to client %s: %s", c.id, err)
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// send queues a message for the client. If the client isn't keeping up, a QoS 0 PUBLISH is dropped,
+// but anything else is part of an exchange that must complete, so the client is disconnected
+// instead. Its session keeps the QoS 1 and 2 messages in flight, and resends them when it reconnects.
+func (c *client) send(msg proto.Message) {
+	select {
+	case c.out <- msg:
+	case <-c.done:
+	default:
+		if publish, ok := msg.(*proto.Publish); ok && publish.QosLevel == proto.QosAtMostOnce {
+			log.Warningf("Client %s is not keeping up, dropping message", c.id)
+			return
+		}
+		log.Warningf("Client %s is not keeping up, disconnecting it", c.id)
+		c.close()
+	}
+}
+
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// deadlineConn extends the read deadline each time a read is made, so that a client that goes
+// quiet for longer than its keepalive period is dropped.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,34 @@
+// mqtt-broker runs the embedded broker on mqtt.host:mqtt.port, for running modules on a
+// development machine without installing mosquitto.
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/nps5696/go-ninja/bus/broker"
+	"github.com/nps5696/go-ninja/config"
+	"github.com/nps5696/go-ninja/logger"
+)
+
+var log = logger.GetLogger("mqtt-broker")
+
+func main() {
+
+	addr := fmt.Sprintf("%s:%d", config.String("localhost", "mqtt.host"), config.Int(1883, "mqtt.port"))
+
+	b, err := broker.ListenAndServe(addr)
+	if err != nil {
+		log.Fatalf("Failed to start broker on %s: %s", addr, err)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, os.Kill)
+
+	// Block until a signal is received.
+	s := <-c
+	log.Infof("Got signal: %s", s)
+
+	b.Close()
+}
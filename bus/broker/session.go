@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"sync"
+
+	proto "github.com/huin/mqtt"
+)
+
+// maxInflight is the number of unacknowledged QoS 1 and 2 messages kept for a session before the
+// oldest are dropped
+const maxInflight = 1024
+
+// session is the state kept for a client id. The session of a client that connected with
+// clean-session=false outlives its connection, so QoS 1 and 2 messages published while the client
+// is away are delivered when it comes back.
+type session struct {
+	sync.Mutex
+	id            string
+	persistent    bool
+	client        *client
+	subscriptions map[string]proto.QosLevel
+	lastID        uint16
+	inflight      []*inflightMessage
+	received      map[uint16]bool
+}
+
+// inflightMessage is an outgoing QoS 1 or 2 message that has not been fully acknowledged
+type inflightMessage struct {
+	publish  *proto.Publish
+	sent     bool
+	released bool
+}
+
+func newSession(id string, persistent bool) *session {
+	return &session{
+		id:            id,
+		persistent:    persistent,
+		subscriptions: make(map[string]proto.QosLevel),
+		received:      make(map[uint16]bool),
+	}
+}
+
+// qos returns the highest QoS of the subscriptions matching a topic, and whether any matched
+func (s *session) qos(topic string) (proto.QosLevel, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	qos, matched := proto.QosAtMostOnce, false
+	for subscription, subQos := range s.subscriptions {
+		if matches(subscription, topic) {
+			matched = true
+			if subQos > qos {
+				qos = subQos
+			}
+		}
+	}
+	return qos, matched
+}
+
+// deliver sends a message to the client, or keeps it for later if it is QoS 1 or 2 and the
+// client is offline.
+func (s *session) deliver(msg *proto.Publish) {
+	s.Lock()
+	defer s.Unlock()
+
+	if msg.QosLevel == proto.QosAtMostOnce {
+		if s.client != nil {
+			s.client.send(msg)
+		}
+		return
+	}
+
+	msg.MessageId = s.nextID()
+
+	if len(s.inflight) >= maxInflight {
+		log.Warningf("Too many messages in flight for %s, dropping the oldest", s.id)
+		s.inflight = s.inflight[1:]
+	}
+
+	inflight := &inflightMessage{publish: msg}
+	s.inflight = append(s.inflight, inflight)
+
+	if s.client != nil {
+		inflight.sent = true
+		s.client.send(msg)
+	}
+}
+
+// resume attaches a newly connected client, and resends anything it has not acknowledged
+func (s *session) resume(c *client) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.client = c
+
+	for _, inflight := range s.inflight {
+		if inflight.released {
+			c.send(&proto.PubRel{
+				Header:    proto.Header{QosLevel: proto.QosAtLeastOnce},
+				MessageId: inflight.publish.MessageId,
+			})
+			continue
+		}
+
+		msg := *inflight.publish
+		msg.DupFlag = inflight.sent
+		inflight.sent = true
+		c.send(&msg)
+	}
+}
+
+func (s *session) detach(c *client) {
+	s.Lock()
+	defer s.Unlock()
+	if s.client == c {
+		s.client = nil
+	}
+}
+
+// acknowledged handles PUBACK, PUBREC and PUBCOMP from the client
+func (s *session) acknowledged(msg proto.Message) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch msg := msg.(type) {
+	case *proto.PubAck:
+		s.remove(msg.MessageId)
+	case *proto.PubRec:
+		for _, inflight := range s.inflight {
+			if inflight.publish.MessageId == msg.MessageId {
+				inflight.released = true
+			}
+		}
+		if s.client != nil {
+			s.client.send(&proto.PubRel{
+				Header:    proto.Header{QosLevel: proto.QosAtLeastOnce},
+				MessageId: msg.MessageId,
+			})
+		}
+	case *proto.PubComp:
+		s.remove(msg.MessageId)
+	}
+}
+
+func (s *session) remove(id uint16) {
+	for i, inflight := range s.inflight {
+		if inflight.publish.MessageId == id {
+			s.inflight = append(s.inflight[:i], s.inflight[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *session) nextID() uint16 {
+	for {
+		s.lastID++
+		if s.lastID == 0 {
+			continue
+		}
+		inUse := false
+		for _, inflight := range s.inflight {
+			if inflight.publish.MessageId == s.lastID {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			return s.lastID
+		}
+	}
+}
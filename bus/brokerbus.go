@@ -0,0 +1,288 @@
+package bus
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nps5696/go-ninja/config"
+)
+
+// State is the state of a bus's connection to the broker
+type State int
+
+const (
+	// Connecting is the state while dialling the broker and waiting for it to accept us
+	Connecting State = iota
+	// Connected means the broker has accepted our connection
+	Connected
+	// Backoff is the state while waiting to try again after failing to connect
+	Backoff
+	// Destroyed means the bus has been destroyed, and won't connect again
+	Destroyed
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Backoff:
+		return "backoff"
+	case Destroyed:
+		return "destroyed"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// minBackoff is the shortest wait between attempts to connect, whatever mqtt.backoff.min says, so
+// that a bus can't redial the broker in a tight loop
+const minBackoff = time.Millisecond * 100
+
+// brokerBus is the part of a bus connected to a broker that doesn't depend on the protocol: the
+// state of the connection and the loop that keeps it up, and the subscriptions and retained
+// messages shared by everything subscribed through the bus.
+type brokerBus struct {
+	baseBus
+	sync.Mutex
+	mqtt          *clientConn
+	subscriptions *subscriptionTable
+	retained      *retainedCache
+	state         State
+	stop          chan bool
+	// name is the name of the protocol, for logging
+	name        string
+	host        string
+	id          string
+	options     ConnectOptions
+	keepalive   time.Duration
+	pingTimeout time.Duration
+	backoffMin  time.Duration
+	backoffMax  time.Duration
+}
+
+// newBrokerBus returns a brokerBus for the given broker. The bus embedding it must set the
+// subscription table, as it knows how to subscribe.
+func newBrokerBus(name, host, id string, options ConnectOptions) *brokerBus {
+	backoffMin := config.Duration(time.Millisecond*500, "mqtt", "backoff", "min")
+	if backoffMin < minBackoff {
+		log.Warningf("mqtt.backoff.min is %s, waiting at least %s between attempts to connect", backoffMin, minBackoff)
+		backoffMin = minBackoff
+	}
+
+	backoffMax := config.Duration(time.Second*30, "mqtt", "backoff", "max")
+	if backoffMax < backoffMin {
+		backoffMax = backoffMin
+	}
+
+	return &brokerBus{
+		retained:    newRetainedCache(),
+		stop:        make(chan bool),
+		name:        name,
+		host:        host,
+		id:          id,
+		options:     options,
+		keepalive:   config.Duration(time.Second*30, "mqtt", "keepalive"),
+		pingTimeout: config.Duration(time.Second*10, "mqtt", "pingTimeout"),
+		backoffMin:  backoffMin,
+		backoffMax:  backoffMax,
+	}
+}
+
+// State returns the current state of the connection to the broker
+func (b *brokerBus) State() State {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+func (b *brokerBus) setState(state State) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == Destroyed || b.state == state {
+		return
+	}
+
+	log.Debugf("%s connection %s -> %s", b.name, b.state, state)
+	b.state = state
+}
+
+// run keeps the bus connected until it is destroyed, waiting longer after each failed attempt.
+// The ready channel is closed once the first connection has been made. connect makes a single
+// attempt to connect, and lost (if not nil) is called each time the connection closes.
+func (b *brokerBus) run(ready chan bool, connect func() (*clientConn, error), lost func()) {
+	failures := 0
+
+	for b.State() != Destroyed {
+		b.setState(Connecting)
+
+		mqtt, err := connect()
+		if err != nil {
+			delay := backoff(b.backoffMin, b.backoffMax, failures)
+			failures++
+
+			log.Warningf("Failed to connect to %s server %s: %s. Retrying in %s", b.name, b.host, err, delay)
+			b.setState(Backoff)
+
+			select {
+			case <-time.After(delay):
+			case <-b.stop:
+			}
+			continue
+		}
+
+		failures = 0
+
+		if b.State() == Destroyed {
+			// we were destroyed while connecting
+			mqtt.Close()
+		}
+
+		if ready != nil {
+			close(ready)
+			ready = nil
+		}
+
+		<-mqtt.done
+		log.Warningf("Connection closed!")
+		if lost != nil {
+			lost()
+		}
+		b.disconnected()
+	}
+}
+
+// online makes a connection the broker has just accepted the current one, and restores our
+// subscriptions on it. Anything the bus owes the broker should be sent after.
+func (b *brokerBus) online(mqtt *clientConn) {
+	if b.getConn() != nil {
+		log.Infof("Reconnected to %s server", b.name)
+	}
+
+	if b.keepalive > 0 {
+		go mqtt.keepalive(b.keepalive, b.pingTimeout)
+	}
+
+	b.Lock()
+	b.mqtt = mqtt
+	b.Unlock()
+
+	b.setState(Connected)
+	b.connected()
+
+	b.subscriptions.resync()
+}
+
+// destroy marks the bus destroyed, so that it doesn't connect again. It returns false if it already was.
+func (b *brokerBus) destroy() bool {
+	b.Lock()
+	if b.state == Destroyed {
+		b.Unlock()
+		return false
+	}
+	log.Debugf("%s connection %s -> %s", b.name, b.state, Destroyed)
+	b.state = Destroyed
+	b.Unlock()
+
+	close(b.stop)
+	b.markDestroyed()
+
+	return true
+}
+
+// carriesProperties returns false, as only MQTT 5 has message properties
+func (b *brokerBus) carriesProperties() bool {
+	return false
+}
+
+func (b *brokerBus) send(msg packet) error {
+	conn := b.getConn()
+	if conn == nil {
+		return fmt.Errorf("Not connected to %s server", b.name)
+	}
+	return conn.send(msg)
+}
+
+func (b *brokerBus) getConn() *clientConn {
+	b.Lock()
+	defer b.Unlock()
+	return b.mqtt
+}
+
+// deliver hands a message from the broker to the subscriptions it matches
+func (b *brokerBus) deliver(m *message) {
+
+	// the cache is updated before we look at the subscriptions, so a subscription added in between
+	// gets the new value from one or the other. Messages the broker forwards to a subscription we
+	// already had aren't flagged as retained, even if they were, so our copy may be older than the
+	// broker's until we next subscribe to the topic.
+	if m.retained {
+		b.retained.set(m.topic, m.payload)
+	}
+
+	for _, sub := range b.subscriptions.matching(m.topic) {
+		if sub.isReplayed(m) {
+			continue
+		}
+		sub.push(m)
+	}
+}
+
+func (b *brokerBus) Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.SubscribeWithOptions(topic, SubscribeOptions{}, callback)
+}
+
+// SubscribeWithOptions subscribes to a topic, asking the broker to deliver at the given QoS. If
+// ReplayRetained is set, the retained messages already cached for the topic are delivered before
+// it returns.
+//
+// Subscriptions to the same topic share a single subscription on the broker, which is dropped when
+// the last of them is cancelled. Each has its own queue of messages waiting for the callback, so a
+// slow callback doesn't hold up the others until its queue is full (see newSubscriptionQueue).
+func (b *brokerBus) SubscribeWithOptions(topic string, options SubscribeOptions, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.subscribeMessages(topic, options, func(m *message) {
+		callback(m.topic, m.payload)
+	})
+}
+
+// subscribeMessages is SubscribeWithOptions, giving the callback the whole of each message.
+// Retained messages replayed from the cache have no properties.
+func (b *brokerBus) subscribeMessages(topic string, options SubscribeOptions, callback func(m *message)) (*Subscription, error) {
+
+	subscription := &Subscription{
+		topic: topic,
+		qos:   options.QoS,
+		queue: newSubscriptionQueue(options),
+		done:  make(chan bool),
+	}
+
+	if options.ReplayRetained {
+		subscription.replay(b.retained.matching(topic), callback)
+	}
+
+	subscription.Cancel = func() {
+		if b.subscriptions.remove(subscription) {
+			if err := b.subscriptions.sync(topic); err != nil {
+				log.Warningf("Failed to unsubscribe: %s", err)
+			}
+		}
+	}
+
+	var initial []*message
+	if b.subscriptions.add(subscription) && !options.ReplayRetained {
+		// the broker won't send the retained messages again for a topic we're already subscribed to
+		initial = b.retained.matching(topic)
+	}
+
+	go subscription.run(initial, callback)
+
+	err := b.subscriptions.sync(topic)
+	if err != nil {
+		b.subscriptions.remove(subscription)
+		return nil, err
+	}
+
+	return subscription, nil
+}
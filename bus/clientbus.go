@@ -0,0 +1,129 @@
+package bus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nps5696/go-ninja/config"
+)
+
+// Client is the part of a ClientBus that talks to the broker, using an MQTT client library
+type Client interface {
+	// Publish sends a message to the broker
+	Publish(topic string, payload []byte, options PublishOptions) error
+	// Subscribe asks the broker for the messages matching a topic. It returns false, and no error,
+	// if the broker couldn't be asked (e.g. we aren't connected); it is asked again on reconnecting.
+	Subscribe(topic string, qos QoS) (bool, error)
+	// Unsubscribe drops a subscription on the broker
+	Unsubscribe(topic string) error
+	// Disconnect closes the connection for good, as the bus has been destroyed
+	Disconnect()
+}
+
+// ClientSettings are what a Client needs to connect to the broker as the other buses do
+type ClientSettings struct {
+	Keepalive   time.Duration
+	PingTimeout time.Duration
+	// AckTimeout is how long to wait for the broker to acknowledge a CONNECT, SUBSCRIBE or UNSUBSCRIBE
+	AckTimeout time.Duration
+	// BackoffMin and BackoffMax bound the wait between attempts to connect
+	BackoffMin   time.Duration
+	BackoffMax   time.Duration
+	CleanSession bool
+	// WillTopic is where the broker should publish "false", retained, if the connection is lost
+	WillTopic string
+}
+
+// ClientBus is a Bus whose connection to the broker is kept up by an MQTT client library, such as
+// Paho in bus/paho. It shares the behaviour of TinyBus - shared broker subscriptions, the retained
+// cache and per-subscription queues - but leaves the connection, reconnecting and QoS flows to the
+// library. The library tells the bus when it connects and disconnects, and hands it each message.
+type ClientBus struct {
+	*brokerBus
+	client Client
+}
+
+// NewClientBus returns a ClientBus that talks to the broker at host through the client. The name
+// of the protocol or library is used in logging.
+func NewClientBus(name, host, id string, options ConnectOptions, client Client) *ClientBus {
+	bus := &ClientBus{
+		brokerBus: newBrokerBus(name, host, id, options),
+		client:    client,
+	}
+	bus.subscriptions = newSubscriptionTable(client.Subscribe, client.Unsubscribe)
+	return bus
+}
+
+// Settings returns how the client should connect
+func (b *ClientBus) Settings() ClientSettings {
+	return ClientSettings{
+		Keepalive:   b.keepalive,
+		PingTimeout: b.pingTimeout,
+		AckTimeout:  ackTimeout,
+		BackoffMin:  b.backoffMin,
+		BackoffMax:  b.backoffMax,
+		// keep our session on the broker while we're away, so QoS 1 and 2 messages aren't lost
+		CleanSession: config.Bool(false, "mqtt", "cleanSession"),
+		WillTopic:    willTopic(b.id),
+	}
+}
+
+// Online tells the bus the client has connected to the broker, or reconnected. Our subscriptions
+// are restored and the connected state published.
+func (b *ClientBus) Online() {
+	b.setState(Connected)
+	b.connected()
+	b.subscriptions.resync()
+
+	if err := b.client.Publish(connectedTopic(b.id), []byte("true"), PublishOptions{Retain: true}); err != nil {
+		log.Warningf("Failed to publish connected state: %s", err)
+	}
+}
+
+// Offline tells the bus the client has lost its connection, and is reconnecting
+func (b *ClientBus) Offline(err error) {
+	log.Warningf("Connection closed! %s", err)
+	b.setState(Connecting)
+	b.disconnected()
+}
+
+// Deliver hands a message from the broker to the subscriptions it matches
+func (b *ClientBus) Deliver(topic string, payload []byte, qos QoS, retained bool) {
+	b.deliver(&message{topic: topic, payload: payload, qos: qos, retained: retained})
+}
+
+func (b *ClientBus) Destroy() {
+	log.Infof("Destroy called")
+
+	if !b.destroy() {
+		return
+	}
+
+	b.client.Disconnect()
+	b.subscriptions.stopAll()
+}
+
+func (b *ClientBus) Publish(topic string, payload []byte) {
+	if err := b.PublishWithOptions(topic, payload, PublishOptions{}); err != nil {
+		log.Warningf("Failed to publish to %s: %s", topic, err)
+	}
+}
+
+// PublishWithOptions publishes a message at the given QoS, through the client
+func (b *ClientBus) PublishWithOptions(topic string, payload []byte, options PublishOptions) error {
+	if b.isDestroyed() {
+		return fmt.Errorf("Can't publish to %s, the bus has been destroyed", topic)
+	}
+
+	if options.Retain {
+		b.retained.set(topic, payload)
+	}
+
+	return b.client.Publish(topic, payload, options)
+}
+
+// ClearRetained removes the retained message on a topic, from the broker and from our cache
+func (b *ClientBus) ClearRetained(topic string) error {
+	b.retained.clear(topic)
+	return b.PublishWithOptions(topic, []byte{}, PublishOptions{Retain: true})
+}
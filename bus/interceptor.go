@@ -0,0 +1,134 @@
+package bus
+
+// PublishFunc publishes a message, or hands it to the next interceptor in the chain
+type PublishFunc func(topic string, payload []byte, options PublishOptions) error
+
+// DeliverFunc delivers an incoming message to a subscription's callback, or hands it to the next
+// interceptor in the chain
+type DeliverFunc func(topic string, payload []byte)
+
+// Interceptor sees every message published through, or delivered by, a bus wrapped with Intercept.
+// Each method is given the next step of the chain; it may call it with the message as it is,
+// call it with a different topic or payload, or not call it at all to drop the message.
+type Interceptor interface {
+	// InterceptPublish is called with each outgoing message. An error stops the message and is
+	// returned to the publisher.
+	InterceptPublish(topic string, payload []byte, options PublishOptions, next PublishFunc) error
+	// InterceptDeliver is called with each incoming message, along with the topic of the
+	// subscription it is being delivered to.
+	InterceptDeliver(subscription string, topic string, payload []byte, next DeliverFunc)
+}
+
+// PublishInterceptor is an Interceptor that only looks at outgoing messages
+type PublishInterceptor func(topic string, payload []byte, options PublishOptions, next PublishFunc) error
+
+func (i PublishInterceptor) InterceptPublish(topic string, payload []byte, options PublishOptions, next PublishFunc) error {
+	return i(topic, payload, options, next)
+}
+
+func (i PublishInterceptor) InterceptDeliver(subscription string, topic string, payload []byte, next DeliverFunc) {
+	next(topic, payload)
+}
+
+// DeliverInterceptor is an Interceptor that only looks at incoming messages
+type DeliverInterceptor func(subscription string, topic string, payload []byte, next DeliverFunc)
+
+func (i DeliverInterceptor) InterceptPublish(topic string, payload []byte, options PublishOptions, next PublishFunc) error {
+	return next(topic, payload, options)
+}
+
+func (i DeliverInterceptor) InterceptDeliver(subscription string, topic string, payload []byte, next DeliverFunc) {
+	i(subscription, topic, payload, next)
+}
+
+// Intercept wraps a bus so that its messages pass through the interceptors, the first of which
+// sees outgoing messages first and incoming messages first. If the bus carries MQTT 5 properties,
+// so does the wrapper.
+func Intercept(b Bus, interceptors ...Interceptor) Bus {
+	intercepted := &interceptedBus{
+		Bus:          b,
+		interceptors: interceptors,
+	}
+
+	intercepted.publish = b.PublishWithOptions
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], intercepted.publish
+		intercepted.publish = func(topic string, payload []byte, options PublishOptions) error {
+			return interceptor.InterceptPublish(topic, payload, options, next)
+		}
+	}
+
+	if pb, ok := b.(PropertiesBus); ok {
+		return &interceptedPropertiesBus{intercepted, pb}
+	}
+	return intercepted
+}
+
+type interceptedBus struct {
+	Bus
+	interceptors []Interceptor
+	publish      PublishFunc
+}
+
+func (b *interceptedBus) Publish(topic string, payload []byte) {
+	if err := b.publish(topic, payload, PublishOptions{}); err != nil {
+		log.Warningf("Failed to publish to %s: %s", topic, err)
+	}
+}
+
+func (b *interceptedBus) PublishWithOptions(topic string, payload []byte, options PublishOptions) error {
+	return b.publish(topic, payload, options)
+}
+
+func (b *interceptedBus) Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.SubscribeWithOptions(topic, SubscribeOptions{}, callback)
+}
+
+func (b *interceptedBus) SubscribeWithOptions(topic string, options SubscribeOptions, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return b.Bus.SubscribeWithOptions(topic, options, b.deliver(topic, callback))
+}
+
+// deliver wraps a subscription's callback in the chain of interceptors
+func (b *interceptedBus) deliver(subscription string, callback DeliverFunc) DeliverFunc {
+	for i := len(b.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := b.interceptors[i], callback
+		callback = func(topic string, payload []byte) {
+			interceptor.InterceptDeliver(subscription, topic, payload, next)
+		}
+	}
+	return callback
+}
+
+// subscribeMessages is SubscribeWithOptions, giving the callback the whole of each message where
+// the intercepted bus can. The interceptors may change the topic and payload, the rest of the
+// message is passed around them.
+func (b *interceptedBus) subscribeMessages(topic string, options SubscribeOptions, callback func(m *message)) (*Subscription, error) {
+	subscription := topic
+	return subscribeMessages(b.Bus, topic, options, func(m *message) {
+		b.deliver(subscription, func(topic string, payload []byte) {
+			delivered := *m
+			delivered.topic, delivered.payload = topic, payload
+			callback(&delivered)
+		})(m.topic, m.payload)
+	})
+}
+
+// carriesProperties returns true if the intercepted bus does
+func (b *interceptedBus) carriesProperties() bool {
+	return carriesProperties(b.Bus)
+}
+
+type interceptedPropertiesBus struct {
+	*interceptedBus
+	properties PropertiesBus
+}
+
+// SubscribeWithProperties passes the message properties around the interceptors, which don't see them
+func (b *interceptedPropertiesBus) SubscribeWithProperties(topic string, options SubscribeOptions, callback func(topic string, payload []byte, properties *Properties)) (*Subscription, error) {
+	subscription := topic
+	return b.properties.SubscribeWithProperties(topic, options, func(topic string, payload []byte, properties *Properties) {
+		b.deliver(subscription, func(topic string, payload []byte) {
+			callback(topic, payload, properties)
+		})(topic, payload)
+	})
+}
@@ -0,0 +1,54 @@
+package bus
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestInterceptors(t *testing.T) {
+	memory, _ := ConnectMemoryBus("TestInterceptors", "bus")
+	defer memory.Destroy()
+
+	var seen []string
+
+	// refuse large payloads
+	limit := PublishInterceptor(func(topic string, payload []byte, options PublishOptions, next PublishFunc) error {
+		if len(payload) > 5 {
+			return fmt.Errorf("Payload too large")
+		}
+		return next(topic, payload, options)
+	})
+
+	// move everything under legacy/ to current/
+	rewrite := PublishInterceptor(func(topic string, payload []byte, options PublishOptions, next PublishFunc) error {
+		return next(strings.Replace(topic, "legacy/", "current/", 1), payload, options)
+	})
+
+	// record deliveries, and drop any hushed ones
+	record := DeliverInterceptor(func(subscription string, topic string, payload []byte, next DeliverFunc) {
+		seen = append(seen, subscription+" "+topic)
+		if string(payload) != "hush" {
+			next(topic, payload)
+		}
+	})
+
+	bus := Intercept(memory, limit, rewrite, record)
+
+	received := make(chan string, 10)
+	bus.Subscribe("current/+", func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+
+	if err := bus.PublishWithOptions("legacy/a", []byte("too large"), PublishOptions{}); err == nil {
+		t.Fatalf("Expected the large payload to be refused")
+	}
+	bus.Publish("legacy/b", []byte("hush"))
+	bus.Publish("legacy/c", []byte("hello"))
+
+	expectMessage(t, received, "current/c hello")
+
+	if fmt.Sprint(seen) != "[current/+ current/b current/+ current/c]" {
+		t.Fatalf("Unexpected deliveries seen by the interceptor: %v", seen)
+	}
+}
@@ -0,0 +1,652 @@
+// Package mqtt5 encodes and decodes the MQTT 5 control packets needed by a client that publishes
+// and subscribes at QoS 0 and 1.
+//
+// Only the properties the bus makes use of are exposed; any others are read and discarded.
+package mqtt5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Packet types
+const (
+	CONNECT     = 1
+	CONNACK     = 2
+	PUBLISH     = 3
+	PUBACK      = 4
+	SUBSCRIBE   = 8
+	SUBACK      = 9
+	UNSUBSCRIBE = 10
+	UNSUBACK    = 11
+	PINGREQ     = 12
+	PINGRESP    = 13
+	DISCONNECT  = 14
+)
+
+// Reason codes
+const (
+	Success                 = 0x00
+	NormalDisconnection     = 0x00
+	GrantedQoS1             = 0x01
+	GrantedQoS2             = 0x02
+	DisconnectWithWill      = 0x04
+	NoMatchingSubscribers   = 0x10
+	NoSubscriptionExisted   = 0x11
+	UnspecifiedError        = 0x80
+	UnsupportedProtocol     = 0x84
+	ClientIdentifierInvalid = 0x85
+	BadUserNameOrPassword   = 0x86
+	NotAuthorized           = 0x87
+	KeepAliveTimeout        = 0x8D
+)
+
+// maxRemainingLength is the largest packet body the variable length encoding can describe
+const maxRemainingLength = 268435455
+
+var ErrMalformed = errors.New("Malformed MQTT 5 packet")
+
+// Packet is an MQTT 5 control packet
+type Packet interface {
+	Encode(w io.Writer) error
+}
+
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties are the properties of a packet. Fields that aren't set are left out when encoding.
+type Properties struct {
+	PayloadFormat         byte
+	ContentType           string
+	ResponseTopic         string
+	CorrelationData       []byte
+	SessionExpiryInterval uint32
+	AssignedClientID      string
+	ServerKeepAlive       uint16
+	ReasonString          string
+	ReceiveMaximum        uint16
+	MaximumQoS            *byte
+	User                  []UserProperty
+}
+
+type Connect struct {
+	ClientID   string
+	CleanStart bool
+	KeepAlive  uint16
+	Properties Properties
+	Username   string
+	Password   string
+	// Will is published by the broker if the connection is lost. Its packet id is ignored.
+	Will *Publish
+}
+
+type ConnAck struct {
+	SessionPresent bool
+	ReasonCode     byte
+	Properties     Properties
+}
+
+type Publish struct {
+	Dup        bool
+	QoS        byte
+	Retain     bool
+	Topic      string
+	PacketID   uint16
+	Properties Properties
+	Payload    []byte
+}
+
+type PubAck struct {
+	PacketID   uint16
+	ReasonCode byte
+}
+
+// Subscription is a topic filter and the options asked for in a SUBSCRIBE
+type Subscription struct {
+	Topic   string
+	QoS     byte
+	NoLocal bool
+}
+
+type Subscribe struct {
+	PacketID      uint16
+	Subscriptions []Subscription
+}
+
+type SubAck struct {
+	PacketID    uint16
+	ReasonCodes []byte
+}
+
+type Unsubscribe struct {
+	PacketID uint16
+	Topics   []string
+}
+
+type UnsubAck struct {
+	PacketID    uint16
+	ReasonCodes []byte
+}
+
+type PingReq struct{}
+
+type PingResp struct{}
+
+type Disconnect struct {
+	ReasonCode byte
+}
+
+// ----------------------------------------------------------------------------
+// Encoding
+// ----------------------------------------------------------------------------
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) byte(b byte) {
+	e.WriteByte(b)
+}
+
+func (e *encoder) uint16(v uint16) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *encoder) varint(v int) {
+	for {
+		b := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			b |= 0x80
+		}
+		e.WriteByte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func (e *encoder) string(s string) {
+	e.binary([]byte(s))
+}
+
+func (e *encoder) binary(b []byte) {
+	e.uint16(uint16(len(b)))
+	e.Write(b)
+}
+
+func (e *encoder) properties(p *Properties) {
+	props := &encoder{}
+
+	if p.PayloadFormat != 0 {
+		props.byte(0x01)
+		props.byte(p.PayloadFormat)
+	}
+	if p.ContentType != "" {
+		props.byte(0x03)
+		props.string(p.ContentType)
+	}
+	if p.ResponseTopic != "" {
+		props.byte(0x08)
+		props.string(p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		props.byte(0x09)
+		props.binary(p.CorrelationData)
+	}
+	if p.SessionExpiryInterval != 0 {
+		props.byte(0x11)
+		props.uint32(p.SessionExpiryInterval)
+	}
+	if p.AssignedClientID != "" {
+		props.byte(0x12)
+		props.string(p.AssignedClientID)
+	}
+	if p.ServerKeepAlive != 0 {
+		props.byte(0x13)
+		props.uint16(p.ServerKeepAlive)
+	}
+	if p.ReasonString != "" {
+		props.byte(0x1F)
+		props.string(p.ReasonString)
+	}
+	if p.ReceiveMaximum != 0 {
+		props.byte(0x21)
+		props.uint16(p.ReceiveMaximum)
+	}
+	if p.MaximumQoS != nil {
+		props.byte(0x24)
+		props.byte(*p.MaximumQoS)
+	}
+	for _, u := range p.User {
+		props.byte(0x26)
+		props.string(u.Key)
+		props.string(u.Value)
+	}
+
+	e.varint(props.Len())
+	e.Write(props.Bytes())
+}
+
+// write sends a packet with the given type and flags, and the encoded body
+func write(w io.Writer, packetType byte, flags byte, body *encoder) error {
+	if body.Len() > maxRemainingLength {
+		return fmt.Errorf("MQTT 5 packet too large: %d bytes", body.Len())
+	}
+
+	header := &encoder{}
+	header.byte(packetType<<4 | flags)
+	header.varint(body.Len())
+	header.Write(body.Bytes())
+
+	_, err := w.Write(header.Bytes())
+	return err
+}
+
+func boolBit(b bool, bit byte) byte {
+	if b {
+		return bit
+	}
+	return 0
+}
+
+func (p *Connect) Encode(w io.Writer) error {
+	body := &encoder{}
+	body.string("MQTT")
+	body.byte(5)
+
+	flags := boolBit(p.Username != "", 0x80) | boolBit(p.Password != "", 0x40) | boolBit(p.CleanStart, 0x02)
+	if p.Will != nil {
+		flags |= 0x04 | p.Will.QoS<<3 | boolBit(p.Will.Retain, 0x20)
+	}
+	body.byte(flags)
+	body.uint16(p.KeepAlive)
+	body.properties(&p.Properties)
+
+	body.string(p.ClientID)
+	if p.Will != nil {
+		body.properties(&p.Will.Properties)
+		body.string(p.Will.Topic)
+		body.binary(p.Will.Payload)
+	}
+	if p.Username != "" {
+		body.string(p.Username)
+	}
+	if p.Password != "" {
+		body.binary([]byte(p.Password))
+	}
+
+	return write(w, CONNECT, 0, body)
+}
+
+func (p *ConnAck) Encode(w io.Writer) error {
+	body := &encoder{}
+	body.byte(boolBit(p.SessionPresent, 0x01))
+	body.byte(p.ReasonCode)
+	body.properties(&p.Properties)
+	return write(w, CONNACK, 0, body)
+}
+
+func (p *Publish) Encode(w io.Writer) error {
+	body := &encoder{}
+	body.string(p.Topic)
+	if p.QoS > 0 {
+		body.uint16(p.PacketID)
+	}
+	body.properties(&p.Properties)
+	body.Write(p.Payload)
+
+	flags := boolBit(p.Dup, 0x08) | p.QoS<<1 | boolBit(p.Retain, 0x01)
+	return write(w, PUBLISH, flags, body)
+}
+
+func (p *PubAck) Encode(w io.Writer) error {
+	body := &encoder{}
+	body.uint16(p.PacketID)
+	if p.ReasonCode != Success {
+		body.byte(p.ReasonCode)
+	}
+	return write(w, PUBACK, 0, body)
+}
+
+func (p *Subscribe) Encode(w io.Writer) error {
+	body := &encoder{}
+	body.uint16(p.PacketID)
+	body.properties(&Properties{})
+	for _, s := range p.Subscriptions {
+		body.string(s.Topic)
+		body.byte(s.QoS | boolBit(s.NoLocal, 0x04))
+	}
+	return write(w, SUBSCRIBE, 0x02, body)
+}
+
+func (p *SubAck) Encode(w io.Writer) error {
+	body := &encoder{}
+	body.uint16(p.PacketID)
+	body.properties(&Properties{})
+	body.Write(p.ReasonCodes)
+	return write(w, SUBACK, 0, body)
+}
+
+func (p *Unsubscribe) Encode(w io.Writer) error {
+	body := &encoder{}
+	body.uint16(p.PacketID)
+	body.properties(&Properties{})
+	for _, topic := range p.Topics {
+		body.string(topic)
+	}
+	return write(w, UNSUBSCRIBE, 0x02, body)
+}
+
+func (p *UnsubAck) Encode(w io.Writer) error {
+	body := &encoder{}
+	body.uint16(p.PacketID)
+	body.properties(&Properties{})
+	body.Write(p.ReasonCodes)
+	return write(w, UNSUBACK, 0, body)
+}
+
+func (p *PingReq) Encode(w io.Writer) error {
+	return write(w, PINGREQ, 0, &encoder{})
+}
+
+func (p *PingResp) Encode(w io.Writer) error {
+	return write(w, PINGRESP, 0, &encoder{})
+}
+
+func (p *Disconnect) Encode(w io.Writer) error {
+	body := &encoder{}
+	if p.ReasonCode != NormalDisconnection {
+		body.byte(p.ReasonCode)
+	}
+	return write(w, DISCONNECT, 0, body)
+}
+
+// ----------------------------------------------------------------------------
+// Decoding
+// ----------------------------------------------------------------------------
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = ErrMalformed
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) varint() int {
+	v, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		b := d.byte()
+		v += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			return v
+		}
+		multiplier *= 128
+	}
+	d.err = ErrMalformed
+	return 0
+}
+
+func (d *decoder) binary() []byte {
+	n := int(d.uint16())
+	b := d.next(n)
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (d *decoder) string() string {
+	return string(d.binary())
+}
+
+func (d *decoder) properties(p *Properties) {
+	length := d.varint()
+	props := &decoder{buf: d.next(length), err: d.err}
+
+	for props.err == nil && len(props.buf) > 0 {
+		switch id := props.varint(); id {
+		case 0x01:
+			p.PayloadFormat = props.byte()
+		case 0x03:
+			p.ContentType = props.string()
+		case 0x08:
+			p.ResponseTopic = props.string()
+		case 0x09:
+			p.CorrelationData = props.binary()
+		case 0x11:
+			p.SessionExpiryInterval = props.uint32()
+		case 0x12:
+			p.AssignedClientID = props.string()
+		case 0x13:
+			p.ServerKeepAlive = props.uint16()
+		case 0x1F:
+			p.ReasonString = props.string()
+		case 0x21:
+			p.ReceiveMaximum = props.uint16()
+		case 0x24:
+			qos := props.byte()
+			p.MaximumQoS = &qos
+		case 0x26:
+			p.User = append(p.User, UserProperty{props.string(), props.string()})
+
+		// the rest are read and ignored
+		case 0x17, 0x19, 0x25, 0x28, 0x29, 0x2A:
+			props.byte()
+		case 0x22, 0x23:
+			props.uint16()
+		case 0x02, 0x18, 0x27:
+			props.uint32()
+		case 0x0B:
+			props.varint()
+		case 0x15, 0x1A, 0x1C:
+			props.string()
+		case 0x16:
+			props.binary()
+		default:
+			props.err = fmt.Errorf("Unknown MQTT 5 property 0x%02x", id)
+		}
+	}
+
+	if d.err == nil {
+		d.err = props.err
+	}
+}
+
+// ReadPacket reads a single packet
+func ReadPacket(r io.Reader) (Packet, error) {
+	var b [1]byte
+
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	first := b[0]
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, ErrMalformed
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		b := b[0]
+		length += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	return decode(first>>4, first&0x0F, &decoder{buf: buf})
+}
+
+func decode(packetType, flags byte, d *decoder) (Packet, error) {
+	var p Packet
+
+	switch packetType {
+	case CONNECT:
+		p = decodeConnect(d)
+	case CONNACK:
+		c := &ConnAck{}
+		c.SessionPresent = d.byte()&0x01 != 0
+		c.ReasonCode = d.byte()
+		if len(d.buf) > 0 {
+			d.properties(&c.Properties)
+		}
+		p = c
+	case PUBLISH:
+		pub := &Publish{
+			Dup:    flags&0x08 != 0,
+			QoS:    (flags >> 1) & 0x03,
+			Retain: flags&0x01 != 0,
+		}
+		pub.Topic = d.string()
+		if pub.QoS > 0 {
+			pub.PacketID = d.uint16()
+		}
+		d.properties(&pub.Properties)
+		pub.Payload = append([]byte{}, d.buf...)
+		d.buf = nil
+		p = pub
+	case PUBACK:
+		ack := &PubAck{PacketID: d.uint16()}
+		if len(d.buf) > 0 {
+			ack.ReasonCode = d.byte()
+		}
+		if len(d.buf) > 0 {
+			d.properties(&Properties{})
+		}
+		p = ack
+	case SUBSCRIBE:
+		sub := &Subscribe{PacketID: d.uint16()}
+		d.properties(&Properties{})
+		for d.err == nil && len(d.buf) > 0 {
+			topic := d.string()
+			options := d.byte()
+			sub.Subscriptions = append(sub.Subscriptions, Subscription{Topic: topic, QoS: options & 0x03, NoLocal: options&0x04 != 0})
+		}
+		p = sub
+	case SUBACK:
+		ack := &SubAck{PacketID: d.uint16()}
+		d.properties(&Properties{})
+		ack.ReasonCodes = append([]byte{}, d.buf...)
+		d.buf = nil
+		p = ack
+	case UNSUBSCRIBE:
+		unsub := &Unsubscribe{PacketID: d.uint16()}
+		d.properties(&Properties{})
+		for d.err == nil && len(d.buf) > 0 {
+			unsub.Topics = append(unsub.Topics, d.string())
+		}
+		p = unsub
+	case UNSUBACK:
+		ack := &UnsubAck{PacketID: d.uint16()}
+		d.properties(&Properties{})
+		ack.ReasonCodes = append([]byte{}, d.buf...)
+		d.buf = nil
+		p = ack
+	case PINGREQ:
+		p = &PingReq{}
+	case PINGRESP:
+		p = &PingResp{}
+	case DISCONNECT:
+		dis := &Disconnect{}
+		if len(d.buf) > 0 {
+			dis.ReasonCode = d.byte()
+		}
+		if len(d.buf) > 0 {
+			d.properties(&Properties{})
+		}
+		p = dis
+	default:
+		return nil, fmt.Errorf("Unsupported MQTT 5 packet type %d", packetType)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return p, nil
+}
+
+func decodeConnect(d *decoder) *Connect {
+	c := &Connect{}
+
+	if name := d.string(); name != "MQTT" || d.byte() != 5 {
+		d.err = fmt.Errorf("Not an MQTT 5 CONNECT")
+		return nil
+	}
+
+	flags := d.byte()
+	c.CleanStart = flags&0x02 != 0
+	c.KeepAlive = d.uint16()
+	d.properties(&c.Properties)
+	c.ClientID = d.string()
+
+	if flags&0x04 != 0 {
+		c.Will = &Publish{
+			QoS:    (flags >> 3) & 0x03,
+			Retain: flags&0x20 != 0,
+		}
+		d.properties(&c.Will.Properties)
+		c.Will.Topic = d.string()
+		c.Will.Payload = d.binary()
+	}
+	if flags&0x80 != 0 {
+		c.Username = d.string()
+	}
+	if flags&0x40 != 0 {
+		c.Password = string(d.binary())
+	}
+
+	return c
+}
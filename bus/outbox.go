@@ -0,0 +1,235 @@
+package bus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// OverflowPolicy decides what happens to a message when a bounded queue is full
+type OverflowPolicy string
+
+const (
+	// DropOldest discards the message at the front of the queue to make room
+	DropOldest OverflowPolicy = "drop-oldest"
+	// DropNewest discards the message being added
+	DropNewest OverflowPolicy = "drop-newest"
+	// Block waits until there is room in the queue
+	Block OverflowPolicy = "block"
+)
+
+// queuedMessage is an outgoing message waiting to be sent to the broker
+type queuedMessage struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	QoS     QoS    `json:"qos"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+// outbox holds the messages published through a TinyBus until they can be sent. While the bus is
+// offline they are kept (and optionally written to a file, so they survive a restart), and they
+// are flushed in order once it reconnects. Like a deliveryQueue, an outbox with a size of zero or
+// less is unbounded.
+type outbox struct {
+	sync.Mutex
+	space    *sync.Cond
+	messages []*queuedMessage
+	size     int
+	policy   OverflowPolicy
+	file     string
+	online   bool
+	closed   bool
+	dropped  int
+}
+
+func newOutbox(size int, policy OverflowPolicy, file string) *outbox {
+	o := &outbox{
+		size:   size,
+		policy: policy,
+		file:   file,
+	}
+	o.space = sync.NewCond(&o.Mutex)
+
+	if file != "" {
+		if err := o.load(); err != nil {
+			log.Warningf("Failed to load queued messages from %s: %s", file, err)
+		}
+	}
+
+	return o
+}
+
+// push adds a message to the back of the queue, applying the overflow policy if it is full
+func (o *outbox) push(msg *queuedMessage) error {
+	o.Lock()
+	defer o.Unlock()
+
+	for o.size > 0 && len(o.messages) >= o.size {
+		if o.closed {
+			return fmt.Errorf("Can't publish to %s, the bus has been destroyed", msg.Topic)
+		}
+
+		switch o.policy {
+		case DropNewest:
+			o.dropped++
+			return fmt.Errorf("Outgoing queue is full, dropped message to %s", msg.Topic)
+		case Block:
+			o.space.Wait()
+		default:
+			log.Debugf("Outgoing queue is full, dropped message to %s", o.messages[0].Topic)
+			o.dropped++
+			o.messages = o.messages[1:]
+			o.save()
+		}
+	}
+
+	o.messages = append(o.messages, msg)
+
+	if !o.online {
+		o.append(msg)
+	}
+
+	return nil
+}
+
+// pop takes the message at the front of the queue, returning nil if it is empty
+func (o *outbox) pop() *queuedMessage {
+	o.Lock()
+	defer o.Unlock()
+
+	if len(o.messages) == 0 {
+		return nil
+	}
+
+	msg := o.messages[0]
+	o.messages = o.messages[1:]
+	o.space.Broadcast()
+
+	if len(o.messages) == 0 && o.file != "" {
+		os.Remove(o.file)
+	}
+
+	return msg
+}
+
+// unpop puts a message that couldn't be sent back at the front of the queue
+func (o *outbox) unpop(msg *queuedMessage) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.messages = append([]*queuedMessage{msg}, o.messages...)
+	o.save()
+}
+
+// setOnline records whether the bus is connected. Messages pushed while offline are persisted.
+func (o *outbox) setOnline(online bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.online = online
+	if !online {
+		o.save()
+	}
+}
+
+// close releases anyone blocked waiting for room in the queue
+func (o *outbox) close() {
+	o.Lock()
+	defer o.Unlock()
+
+	o.closed = true
+	o.space.Broadcast()
+}
+
+func (o *outbox) append(msg *queuedMessage) {
+	if o.file == "" {
+		return
+	}
+
+	f, err := os.OpenFile(o.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Warningf("Failed to persist queued message: %s", err)
+		return
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(msg); err != nil {
+		log.Warningf("Failed to persist queued message: %s", err)
+	}
+}
+
+// save rewrites the queue file with the current contents of the queue
+func (o *outbox) save() {
+	if o.file == "" {
+		return
+	}
+
+	if len(o.messages) == 0 {
+		os.Remove(o.file)
+		return
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(o.file), filepath.Base(o.file))
+	if err != nil {
+		log.Warningf("Failed to persist queued messages: %s", err)
+		return
+	}
+
+	encoder := json.NewEncoder(f)
+	for _, msg := range o.messages {
+		if err = encoder.Encode(msg); err != nil {
+			break
+		}
+	}
+	f.Close()
+
+	if err == nil {
+		err = os.Rename(f.Name(), o.file)
+	}
+	if err != nil {
+		log.Warningf("Failed to persist queued messages: %s", err)
+		os.Remove(f.Name())
+	}
+}
+
+// load reads the messages left in the queue file by a previous run
+func (o *outbox) load() error {
+	if err := os.MkdirAll(filepath.Dir(o.file), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Open(o.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024*16)
+	for scanner.Scan() {
+		msg := &queuedMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), msg); err != nil {
+			log.Warningf("Ignoring unreadable queued message: %s", err)
+			continue
+		}
+		o.messages = append(o.messages, msg)
+	}
+
+	if o.size > 0 && len(o.messages) > o.size {
+		o.dropped += len(o.messages) - o.size
+		o.messages = o.messages[len(o.messages)-o.size:]
+	}
+
+	if len(o.messages) > 0 {
+		log.Infof("Loaded %d queued messages from %s", len(o.messages), o.file)
+	}
+
+	return scanner.Err()
+}
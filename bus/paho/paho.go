@@ -0,0 +1,140 @@
+// Package paho is an implementation of bus.Bus on the Eclipse Paho client. Importing it registers
+// it as "paho", for the mqtt.implementation config:
+//
+//	import _ "github.com/nps5696/go-ninja/bus/paho"
+//
+// It shares the behaviour of TinyBus - shared broker subscriptions, the retained cache and
+// per-subscription queues - but leaves the connection, reconnecting and QoS flows to Paho, so the
+// two can be compared.
+package paho
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nps5696/go-ninja/bus"
+	"github.com/nps5696/go-ninja/logger"
+)
+
+var log = logger.GetLogger("bus.paho")
+
+func init() {
+	bus.Register("paho", func(host, id string) (bus.Bus, error) {
+		options, err := bus.ConnectOptionsFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return Connect(host, id, options)
+	})
+}
+
+// client is a bus.Client on a Paho client
+type client struct {
+	mqtt       mqtt.Client
+	ackTimeout time.Duration
+}
+
+// Connect connects to the broker, returning once the first connection has been made. The host may
+// be host:port, or any URL Paho understands (e.g. tcp://, ssl://, ws://).
+func Connect(host, id string, options bus.ConnectOptions) (*bus.ClientBus, error) {
+
+	if !strings.Contains(host, "://") {
+		if options.TLS != nil {
+			host = "ssl://" + host
+		} else {
+			host = "tcp://" + host
+		}
+	}
+
+	c := &client{}
+	b := bus.NewClientBus("mqtt", host, id, options, c)
+	settings := b.Settings()
+	c.ackTimeout = settings.AckTimeout
+
+	// Paho reconnects by itself, so the state only tells whether it is connected
+	opts := mqtt.NewClientOptions().
+		AddBroker(host).
+		SetClientID(id).
+		SetUsername(options.Username).
+		SetPassword(options.Password).
+		SetTLSConfig(options.TLS).
+		SetCleanSession(settings.CleanSession).
+		SetKeepAlive(settings.Keepalive).
+		SetPingTimeout(settings.PingTimeout).
+		SetConnectTimeout(settings.AckTimeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(settings.BackoffMin).
+		SetMaxReconnectInterval(settings.BackoffMax).
+		SetWill(settings.WillTopic, "false", 0, true).
+		SetDefaultPublishHandler(func(_ mqtt.Client, msg mqtt.Message) {
+			b.Deliver(msg.Topic(), msg.Payload(), bus.QoS(msg.Qos()), msg.Retained())
+		}).
+		SetOnConnectHandler(func(mqtt.Client) {
+			b.Online()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			b.Offline(err)
+		})
+
+	c.mqtt = mqtt.NewClient(opts)
+
+	token := c.mqtt.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("Failed to connect to mqtt server %s: %s", host, err)
+	}
+
+	return b, nil
+}
+
+// Publish doesn't wait for the broker to acknowledge the message; while reconnecting, Paho keeps
+// QoS 1 and 2 messages to send once it is back.
+func (c *client) Publish(topic string, payload []byte, options bus.PublishOptions) error {
+	token := c.mqtt.Publish(topic, byte(options.QoS), options.Retain, payload)
+
+	select {
+	case <-token.Done():
+		return token.Error()
+	default:
+		return nil
+	}
+}
+
+func (c *client) Subscribe(topic string, qos bus.QoS) (bool, error) {
+	if !c.mqtt.IsConnectionOpen() {
+		return false, nil
+	}
+
+	// with no callback of its own, Paho hands the messages to the default handler
+	token := c.mqtt.Subscribe(topic, byte(qos), nil)
+	if !token.WaitTimeout(c.ackTimeout) || token.Error() != nil {
+		// We'll subscribe again when we reconnect
+		log.Infof("Failed to subscribe to %s: %v", topic, token.Error())
+		return false, nil
+	}
+
+	if granted, ok := token.(*mqtt.SubscribeToken).Result()[topic]; !ok || granted > byte(bus.ExactlyOnce) {
+		return false, fmt.Errorf("Broker refused subscription to %s", topic)
+	}
+
+	return true, nil
+}
+
+func (c *client) Unsubscribe(topic string) error {
+	if !c.mqtt.IsConnectionOpen() {
+		return nil
+	}
+
+	token := c.mqtt.Unsubscribe(topic)
+	if !token.WaitTimeout(c.ackTimeout) {
+		return fmt.Errorf("Timed out unsubscribing from %s", topic)
+	}
+	return token.Error()
+}
+
+func (c *client) Disconnect() {
+	c.mqtt.Disconnect(250)
+}
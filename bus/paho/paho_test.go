@@ -0,0 +1,84 @@
+package paho
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nps5696/go-ninja/bus"
+	"github.com/nps5696/go-ninja/bus/broker"
+	"github.com/nps5696/go-ninja/config"
+)
+
+func init() {
+	// the bus publishes its connection state under the node serial
+	if !config.HasString("serial") {
+		os.Setenv("sphere_serial", "TESTSERIAL")
+		config.MustRefresh()
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	b, err := broker.ListenAndServe("localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to start broker: %s", err)
+	}
+	defer b.Close()
+
+	for b.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	client, err := Connect(b.Addr().String(), "TestPahoPubSub", bus.ConnectOptions{})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer client.Destroy()
+
+	reconnected := make(chan bool, 1)
+	client.OnConnect(func() {
+		reconnected <- true
+	})
+
+	received := make(chan string, 10)
+	client.SubscribeWithOptions("testing/+/ever", bus.SubscribeOptions{QoS: bus.AtLeastOnce}, func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+
+	client.Publish("testing/what/ever", []byte("hello"))
+	expectMessage(t, received, "testing/what/ever hello")
+
+	// the subscription survives losing the connection
+	if err := b.Disconnect("TestPahoPubSub"); err != nil {
+		t.Fatalf("Failed to drop connection: %s", err)
+	}
+
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Did not reconnect")
+	}
+
+	client.PublishWithOptions("testing/what/ever", []byte("again"), bus.PublishOptions{QoS: bus.AtLeastOnce})
+	expectMessage(t, received, "testing/what/ever again")
+}
+
+func TestRegistered(t *testing.T) {
+	for _, name := range bus.Implementations() {
+		if name == "paho" {
+			return
+		}
+	}
+	t.Fatalf("Expected paho in %v", bus.Implementations())
+}
+
+func expectMessage(t *testing.T, c chan string, expected string) {
+	select {
+	case got := <-c:
+		if got != expected {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("timed out waiting for %q", expected)
+	}
+}
@@ -0,0 +1,142 @@
+package bus
+
+import (
+	"sync"
+
+	"github.com/nps5696/go-ninja/config"
+)
+
+// SubscriptionStats counts what has happened to the messages for a subscription
+type SubscriptionStats struct {
+	// Delivered is the number of messages handed to the callback
+	Delivered uint64
+	// Dropped is the number of messages discarded because the queue was full
+	Dropped uint64
+	// Queued is the number of messages waiting for the callback
+	Queued int
+}
+
+// deliveryQueue holds the messages waiting for a subscription's callback, so a slow callback only
+// holds up its own subscription. A queue with a size of zero or less is unbounded.
+type deliveryQueue struct {
+	sync.Mutex
+	messages  []*message
+	size      int
+	policy    OverflowPolicy
+	delivered uint64
+	dropped   uint64
+
+	// wake is signalled when a message is added, and space when one is taken
+	wake  chan bool
+	space chan bool
+}
+
+func newDeliveryQueue(size int, policy OverflowPolicy) *deliveryQueue {
+	return &deliveryQueue{
+		size:   size,
+		policy: policy,
+		wake:   make(chan bool, 1),
+		space:  make(chan bool, 1),
+	}
+}
+
+// newSubscriptionQueue builds the queue for a subscription to a broker. Unless the options say
+// otherwise, it holds mqtt.subscription.queueSize messages (default 256) and applies the
+// mqtt.subscription.overflow policy (default "drop-oldest") when full. Blocking is opt-in, as a
+// full queue then holds up every other subscription on the bus.
+func newSubscriptionQueue(options SubscribeOptions) *deliveryQueue {
+	size := options.QueueSize
+	if size == 0 {
+		size = config.Int(256, "mqtt", "subscription", "queueSize")
+	}
+
+	policy := options.Overflow
+	if policy == "" {
+		policy = OverflowPolicy(config.String(string(DropOldest), "mqtt", "subscription", "overflow"))
+	}
+
+	return newDeliveryQueue(size, policy)
+}
+
+// push adds a message to the back of the queue, applying the overflow policy if it is full. When
+// blocking, it gives up if done is closed.
+func (q *deliveryQueue) push(m *message, done <-chan bool) {
+	for {
+		q.Lock()
+		if q.size <= 0 || len(q.messages) < q.size {
+			q.messages = append(q.messages, m)
+			q.Unlock()
+			signal(q.wake)
+			return
+		}
+
+		switch q.policy {
+		case DropNewest:
+			log.Debugf("Subscription queue is full, dropped message to %s", m.topic)
+			q.dropped++
+			q.Unlock()
+			return
+		case DropOldest:
+			log.Debugf("Subscription queue is full, dropped message to %s", q.messages[0].topic)
+			q.dropped++
+			q.messages = append(q.messages[1:], m)
+			q.Unlock()
+			return
+		}
+		q.Unlock()
+
+		select {
+		case <-q.space:
+		case <-done:
+			return
+		}
+	}
+}
+
+// pop takes the message at the front of the queue, waiting for one if it is empty. It returns
+// false if done is closed first.
+func (q *deliveryQueue) pop(done <-chan bool) (*message, bool) {
+	for {
+		q.Lock()
+		if len(q.messages) > 0 {
+			m := q.messages[0]
+			q.messages[0] = nil
+			q.messages = q.messages[1:]
+			q.Unlock()
+			signal(q.space)
+			return m, true
+		}
+		q.Unlock()
+
+		select {
+		case <-q.wake:
+		case <-done:
+			return nil, false
+		}
+	}
+}
+
+func (q *deliveryQueue) stats() SubscriptionStats {
+	q.Lock()
+	defer q.Unlock()
+
+	return SubscriptionStats{
+		Delivered: q.delivered,
+		Dropped:   q.dropped,
+		Queued:    len(q.messages),
+	}
+}
+
+func (q *deliveryQueue) countDelivered() {
+	q.Lock()
+	q.delivered++
+	q.Unlock()
+}
+
+// signal wakes whoever is waiting on a channel, without waiting if nobody is
+func signal(c chan bool) {
+	select {
+	case c <- true:
+	default:
+	}
+}
@@ -0,0 +1,230 @@
+package bus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nps5696/go-ninja/simtime"
+)
+
+// Directions of the messages in a recording
+const (
+	// Published messages were sent by the recorded bus
+	Published = "out"
+	// Received messages were delivered to the recorded bus's subscribers
+	Received = "in"
+)
+
+// RecordedMessage is a line of a recording
+type RecordedMessage struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Topic     string    `json:"topic"`
+	Payload   []byte    `json:"payload"`
+	QoS       QoS       `json:"qos,omitempty"`
+	Retain    bool      `json:"retain,omitempty"`
+}
+
+// Record wraps a bus so that every message published through it, and every message it receives, is
+// written to w as a line of JSON. A message received by several subscriptions is only recorded once.
+func Record(b Bus, w io.Writer) Bus {
+	recorder := &recorder{
+		Bus:           b,
+		encoder:       json.NewEncoder(w),
+		subscriptions: newTopicTrie(),
+	}
+
+	if _, ok := b.(PropertiesBus); ok {
+		return &propertiesRecorder{recorder}
+	}
+	return recorder
+}
+
+type recorder struct {
+	Bus
+	sync.Mutex
+	encoder *json.Encoder
+	// subscriptions are numbered in the order they were made. A message is recorded by the oldest
+	// subscription that matches it, as that is the one that will receive it whatever the others do.
+	subscriptions *topicTrie
+	sequence      int
+}
+
+type recordedSubscription struct {
+	sequence int
+}
+
+func (r *recorder) record(m *RecordedMessage) {
+	m.Time = time.Now()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.encoder.Encode(m); err != nil {
+		log.Warningf("Failed to record message to %s: %s", m.Topic, err)
+	}
+}
+
+func (r *recorder) Publish(topic string, payload []byte) {
+	r.record(&RecordedMessage{Direction: Published, Topic: topic, Payload: payload})
+	r.Bus.Publish(topic, payload)
+}
+
+func (r *recorder) PublishWithOptions(topic string, payload []byte, options PublishOptions) error {
+	r.record(&RecordedMessage{Direction: Published, Topic: topic, Payload: payload, QoS: options.QoS, Retain: options.Retain})
+	return r.Bus.PublishWithOptions(topic, payload, options)
+}
+
+func (r *recorder) Subscribe(topic string, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return r.SubscribeWithOptions(topic, SubscribeOptions{}, callback)
+}
+
+func (r *recorder) SubscribeWithOptions(topic string, options SubscribeOptions, callback func(topic string, payload []byte)) (*Subscription, error) {
+	return r.subscribeMessages(topic, options, func(m *message) {
+		callback(m.topic, m.payload)
+	})
+}
+
+// subscribeMessages is SubscribeWithOptions, giving the callback the whole of each message. Where
+// the recorded bus can't give us the whole message, received messages are recorded without their
+// QoS or retain flag.
+func (r *recorder) subscribeMessages(topic string, options SubscribeOptions, callback func(m *message)) (*Subscription, error) {
+	recorded := r.add(topic)
+
+	subscription, err := subscribeMessages(r.Bus, topic, options, func(m *message) {
+		r.received(recorded, m)
+		callback(m)
+	})
+
+	return r.wrap(topic, recorded, subscription, err)
+}
+
+// carriesProperties returns true if the recorded bus does
+func (r *recorder) carriesProperties() bool {
+	return carriesProperties(r.Bus)
+}
+
+// add numbers a new subscription
+func (r *recorder) add(topic string) *recordedSubscription {
+	r.Lock()
+	defer r.Unlock()
+
+	r.sequence++
+	recorded := &recordedSubscription{r.sequence}
+	r.subscriptions.add(topic, recorded)
+	return recorded
+}
+
+// wrap forgets a subscription when it is cancelled, or if it failed
+func (r *recorder) wrap(topic string, recorded *recordedSubscription, subscription *Subscription, err error) (*Subscription, error) {
+	forget := func() {
+		r.Lock()
+		r.subscriptions.remove(topic, recorded)
+		r.Unlock()
+	}
+
+	if err != nil {
+		forget()
+		return nil, err
+	}
+
+	cancel := subscription.Cancel
+	subscription.Cancel = func() {
+		forget()
+		cancel()
+	}
+	return subscription, nil
+}
+
+// received records a message delivered to a subscription, if it's the oldest one it matches
+func (r *recorder) received(recorded *recordedSubscription, m *message) {
+	r.Lock()
+	oldest := recorded.sequence
+	r.subscriptions.match(m.topic, func(s interface{}) {
+		if s := s.(*recordedSubscription); s.sequence < oldest {
+			oldest = s.sequence
+		}
+	})
+	r.Unlock()
+
+	if oldest == recorded.sequence {
+		r.record(&RecordedMessage{Direction: Received, Topic: m.topic, Payload: m.payload, QoS: m.qos, Retain: m.retained})
+	}
+}
+
+type propertiesRecorder struct {
+	*recorder
+}
+
+func (r *propertiesRecorder) SubscribeWithProperties(topic string, options SubscribeOptions, callback func(topic string, payload []byte, properties *Properties)) (*Subscription, error) {
+	return r.subscribeMessages(topic, options, func(m *message) {
+		callback(m.topic, m.payload, m.properties)
+	})
+}
+
+// ReplayOptions control how a recording is played back
+type ReplayOptions struct {
+	// Speed is how many times faster than real time the recording is played back, so 1 plays it in
+	// real time. Zero plays it as fast as possible.
+	Speed float64
+	// Simtime plays the recording in lock-step with simtime, waiting for each message with
+	// simtime.After and calling simtime.Continue once it has been published. Speed is ignored.
+	Simtime bool
+	// Published also replays the messages the recorded bus published, not just those it received
+	Published bool
+}
+
+// Replay publishes the messages in a recording made by Record to a bus, usually a MemoryBus that
+// the driver or app being tested is connected to, keeping the gaps between them as the options say.
+// It returns once the whole recording has been played.
+func Replay(r io.Reader, b Bus, options ReplayOptions) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var first, previous time.Time
+	start := time.Now()
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		m := &RecordedMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), m); err != nil {
+			return fmt.Errorf("Failed to read recording, line %d: %s", line, err)
+		}
+
+		if m.Direction != Received && !options.Published {
+			continue
+		}
+
+		if first.IsZero() {
+			first, previous = m.Time, m.Time
+		}
+
+		switch {
+		case options.Simtime:
+			<-simtime.After(m.Time.Sub(previous))
+		case options.Speed > 0:
+			due := start.Add(time.Duration(float64(m.Time.Sub(first)) / options.Speed))
+			time.Sleep(due.Sub(time.Now()))
+		}
+		previous = m.Time
+
+		err := b.PublishWithOptions(m.Topic, m.Payload, PublishOptions{QoS: m.QoS, Retain: m.Retain})
+
+		if options.Simtime {
+			simtime.Continue()
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to replay message to %s: %s", m.Topic, err)
+		}
+	}
+
+	return scanner.Err()
+}
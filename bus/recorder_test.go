@@ -0,0 +1,121 @@
+package bus
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	memory, _ := ConnectMemoryBus("TestRecord", "recorded")
+	defer memory.Destroy()
+	other, _ := ConnectMemoryBus("TestRecord", "other")
+	defer other.Destroy()
+
+	recording := &bytes.Buffer{}
+	recorded := Record(memory, recording)
+
+	// both subscriptions receive the message, but it should only be recorded once
+	received := make(chan string, 10)
+	recorded.Subscribe("$device/+/channel/#", func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+	recorded.Subscribe("$device/abc/channel/on-off", func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+
+	recorded.Publish("$node/1234/module/announce", []byte("hello"))
+	other.Publish("$device/abc/channel/on-off", []byte("true"))
+	expectMessage(t, received, "$device/abc/channel/on-off true")
+	expectMessage(t, received, "$device/abc/channel/on-off true")
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(recording.String()), "\n") {
+		m := &RecordedMessage{}
+		if err := json.Unmarshal([]byte(line), m); err != nil {
+			t.Fatalf("Failed to read recording: %s", err)
+		}
+		lines = append(lines, m.Direction+" "+m.Topic+" "+string(m.Payload))
+	}
+	if strings.Join(lines, ", ") != "out $node/1234/module/announce hello, in $device/abc/channel/on-off true" {
+		t.Fatalf("Unexpected recording: %v", lines)
+	}
+
+	// replaying into another bus delivers what was received, and not what was published
+	replayed, _ := ConnectMemoryBus("TestReplay", "replayed")
+	defer replayed.Destroy()
+
+	replayed.Subscribe("#", func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+
+	if err := Replay(bytes.NewReader(recording.Bytes()), replayed, ReplayOptions{Speed: 100}); err != nil {
+		t.Fatalf("Failed to replay: %s", err)
+	}
+	expectMessage(t, received, "$device/abc/channel/on-off true")
+
+	select {
+	case got := <-received:
+		t.Fatalf("Unexpected message %q", got)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestRecordRetained(t *testing.T) {
+	memory, _ := ConnectMemoryBus("TestRecordRetained", "recorded")
+	defer memory.Destroy()
+	other, _ := ConnectMemoryBus("TestRecordRetained", "other")
+	defer other.Destroy()
+
+	other.PublishWithOptions("$device/abc/channel/on-off/state", []byte("true"), PublishOptions{QoS: AtLeastOnce, Retain: true})
+
+	recording := &bytes.Buffer{}
+	recorded := Record(memory, recording)
+
+	received := make(chan string, 10)
+	recorded.SubscribeWithOptions("$device/#", SubscribeOptions{ReplayRetained: true}, func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+
+	m := &RecordedMessage{}
+	if err := json.Unmarshal(recording.Bytes(), m); err != nil {
+		t.Fatalf("Failed to read recording: %s", err)
+	}
+	if !m.Retain {
+		t.Fatalf("Retained message was recorded as a plain one: %+v", m)
+	}
+
+	other.PublishWithOptions("$device/abc/channel/on-off/state", []byte("false"), PublishOptions{QoS: AtLeastOnce})
+	expectMessage(t, received, "$device/abc/channel/on-off/state true")
+	expectMessage(t, received, "$device/abc/channel/on-off/state false")
+
+	lines := strings.Split(strings.TrimSpace(recording.String()), "\n")
+	m = &RecordedMessage{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), m); err != nil {
+		t.Fatalf("Failed to read recording: %s", err)
+	}
+	if m.Retain || m.QoS != AtLeastOnce {
+		t.Fatalf("Expected a plain QoS 1 message, got %+v", m)
+	}
+
+	// the retained message is retained again when it's replayed, so a later subscriber gets it
+	replayed, _ := ConnectMemoryBus("TestReplayRetained", "replayed")
+	defer replayed.Destroy()
+
+	if err := Replay(bytes.NewReader(recording.Bytes()), replayed, ReplayOptions{}); err != nil {
+		t.Fatalf("Failed to replay: %s", err)
+	}
+
+	replayed.SubscribeWithOptions("$device/#", SubscribeOptions{ReplayRetained: true}, func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	})
+	expectMessage(t, received, "$device/abc/channel/on-off/state true")
+
+	select {
+	case got := <-received:
+		t.Fatalf("Unexpected message %q", got)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
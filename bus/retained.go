@@ -0,0 +1,49 @@
+package bus
+
+import "sync"
+
+// retainedCache keeps the last retained payload seen on each topic, so that a new subscription can
+// be given the current value without waiting for the broker to send it. Only messages with the retain
+// flag set are kept, as only those are what the broker holds.
+type retainedCache struct {
+	sync.Mutex
+	payloads map[string][]byte
+}
+
+func newRetainedCache() *retainedCache {
+	return &retainedCache{
+		payloads: make(map[string][]byte),
+	}
+}
+
+// set records a retained payload. An empty payload clears the topic, as it does on the broker.
+func (c *retainedCache) set(topic string, payload []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(payload) == 0 {
+		delete(c.payloads, topic)
+	} else {
+		c.payloads[topic] = payload
+	}
+}
+
+func (c *retainedCache) clear(topic string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.payloads, topic)
+}
+
+// matching returns the cached messages on topics matched by the subscription
+func (c *retainedCache) matching(subscription string) []*message {
+	c.Lock()
+	defer c.Unlock()
+
+	var messages []*message
+	for topic, payload := range c.payloads {
+		if matches(subscription, topic) {
+			messages = append(messages, &message{topic: topic, payload: payload, retained: true})
+		}
+	}
+	return messages
+}
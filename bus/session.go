@@ -0,0 +1,129 @@
+package bus
+
+import (
+	"sync"
+
+	proto "github.com/huin/mqtt"
+)
+
+// session tracks the QoS 1 and 2 messages in flight between a TinyBus and the broker. It outlives
+// the connection, so that unacknowledged messages can be sent again after a reconnect.
+type session struct {
+	sync.Mutex
+	lastID   uint16
+	inflight []*inflightMessage
+	received map[uint16]bool
+}
+
+// inflightMessage is an outgoing QoS 1 or 2 message that the broker hasn't fully acknowledged
+type inflightMessage struct {
+	publish  *proto.Publish
+	released bool
+}
+
+func newSession() *session {
+	return &session{
+		received: make(map[uint16]bool),
+	}
+}
+
+// track assigns a message id to an outgoing QoS 1 or 2 message, and keeps it until it is acknowledged
+func (s *session) track(msg *proto.Publish) {
+	s.Lock()
+	defer s.Unlock()
+
+	msg.MessageId = s.nextIDLocked()
+	s.inflight = append(s.inflight, &inflightMessage{publish: msg})
+}
+
+// acknowledged handles a PUBACK or PUBCOMP, returning false if the message wasn't in flight
+func (s *session) acknowledged(id uint16) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, inflight := range s.inflight {
+		if inflight.publish.MessageId == id {
+			s.inflight = append(s.inflight[:i], s.inflight[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// released handles a PUBREC. The message won't be published again, only its PUBREL.
+func (s *session) released(id uint16) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, inflight := range s.inflight {
+		if inflight.publish.MessageId == id {
+			inflight.released = true
+		}
+	}
+}
+
+// receive records an incoming QoS 2 message id, returning false if it has already been delivered
+func (s *session) receive(id uint16) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.received[id] {
+		return false
+	}
+	s.received[id] = true
+	return true
+}
+
+// release forgets an incoming QoS 2 message id once the broker sends its PUBREL
+func (s *session) release(id uint16) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.received, id)
+}
+
+// pending returns the messages to send again after a reconnect, in the order they were published
+func (s *session) pending() []proto.Message {
+	s.Lock()
+	defer s.Unlock()
+
+	messages := make([]proto.Message, 0, len(s.inflight))
+	for _, inflight := range s.inflight {
+		if inflight.released {
+			messages = append(messages, &proto.PubRel{
+				Header:    proto.Header{QosLevel: proto.QosAtLeastOnce},
+				MessageId: inflight.publish.MessageId,
+			})
+		} else {
+			msg := *inflight.publish
+			msg.DupFlag = true
+			messages = append(messages, &msg)
+		}
+	}
+	return messages
+}
+
+func (s *session) nextID() uint16 {
+	s.Lock()
+	defer s.Unlock()
+	return s.nextIDLocked()
+}
+
+func (s *session) nextIDLocked() uint16 {
+	for {
+		s.lastID++
+		if s.lastID == 0 {
+			continue
+		}
+
+		inUse := false
+		for _, inflight := range s.inflight {
+			if inflight.publish.MessageId == s.lastID {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			return s.lastID
+		}
+	}
+}
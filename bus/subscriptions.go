@@ -0,0 +1,152 @@
+package bus
+
+import "sync"
+
+// subscriptionTable holds the subscriptions of a bus connected to a broker. All the subscriptions
+// to a topic share a single subscription on the broker, made when the first arrives and dropped
+// when the last is cancelled.
+type subscriptionTable struct {
+	sync.Mutex
+	subscriptions *topicTrie
+
+	syncLock   sync.Mutex
+	subscribed map[string]QoS
+
+	// subscribe asks the broker for a subscription, returning false if it couldn't be asked (we'll
+	// try again after reconnecting) or an error if it was refused
+	subscribe func(topic string, qos QoS) (bool, error)
+	// unsubscribe drops a subscription on the broker
+	unsubscribe func(topic string) error
+}
+
+func newSubscriptionTable(subscribe func(topic string, qos QoS) (bool, error), unsubscribe func(topic string) error) *subscriptionTable {
+	return &subscriptionTable{
+		subscriptions: newTopicTrie(),
+		subscribed:    make(map[string]QoS),
+		subscribe:     subscribe,
+		unsubscribe:   unsubscribe,
+	}
+}
+
+// add adds a subscription, returning true if there were already others to the same topic
+func (t *subscriptionTable) add(subscription *Subscription) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	listeners, _ := t.listeners(subscription.topic)
+	t.subscriptions.add(subscription.topic, subscription)
+	return listeners > 0
+}
+
+// remove cancels a subscription, returning false if it had already been cancelled
+func (t *subscriptionTable) remove(subscription *Subscription) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if subscription.cancelled {
+		return false
+	}
+	subscription.stop()
+
+	t.subscriptions.remove(subscription.topic, subscription)
+	return true
+}
+
+// stopAll stops delivery to every subscription, e.g. when the bus is destroyed. The broker isn't told.
+func (t *subscriptionTable) stopAll() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.subscriptions.walk(func(_ string, s interface{}) {
+		s.(*Subscription).stop()
+	})
+	t.subscriptions = newTopicTrie()
+	t.subscribed = make(map[string]QoS)
+}
+
+// matching returns the subscriptions that a message on the topic should be delivered to
+func (t *subscriptionTable) matching(topic string) []*Subscription {
+	t.Lock()
+	defer t.Unlock()
+
+	var subscriptions []*Subscription
+	t.subscriptions.match(topic, func(s interface{}) {
+		subscriptions = append(subscriptions, s.(*Subscription))
+	})
+	return subscriptions
+}
+
+// listeners returns the number of subscriptions to a topic, and the highest QoS they asked for.
+// The lock must be held.
+func (t *subscriptionTable) listeners(topic string) (int, QoS) {
+	listeners := t.subscriptions.get(topic)
+	qos := AtMostOnce
+	for _, s := range listeners {
+		if s := s.(*Subscription); s.qos > qos {
+			qos = s.qos
+		}
+	}
+	return len(listeners), qos
+}
+
+// sync brings the broker's subscription to a topic in line with our own subscriptions, subscribing
+// when the first arrives (or one asks for a higher QoS) and unsubscribing when the last is cancelled.
+func (t *subscriptionTable) sync(topic string) error {
+	t.syncLock.Lock()
+	defer t.syncLock.Unlock()
+
+	t.Lock()
+	listeners, qos := t.listeners(topic)
+	t.Unlock()
+
+	current, subscribed := t.subscribed[topic]
+
+	switch {
+	case listeners > 0 && (!subscribed || qos > current):
+		ok, err := t.subscribe(topic, qos)
+		if ok {
+			t.subscribed[topic] = qos
+		}
+		return err
+	case listeners == 0 && subscribed:
+		delete(t.subscribed, topic)
+		return t.unsubscribe(topic)
+	}
+	return nil
+}
+
+// resync subscribes to every topic again after reconnecting, in case the broker didn't keep our session
+func (t *subscriptionTable) resync() {
+	t.syncLock.Lock()
+	t.subscribed = make(map[string]QoS)
+	t.syncLock.Unlock()
+
+	t.Lock()
+	topics := make(map[string]bool)
+	t.subscriptions.walk(func(topic string, _ interface{}) {
+		topics[topic] = true
+	})
+	t.Unlock()
+
+	for topic := range topics {
+		if err := t.sync(topic); err != nil {
+			log.Warningf("Failed to resubscribe: %s", err)
+		}
+	}
+}
+
+// isSubscribed returns true if we have a subscription to the topic on the broker
+func (t *subscriptionTable) isSubscribed(topic string) bool {
+	t.syncLock.Lock()
+	defer t.syncLock.Unlock()
+
+	_, ok := t.subscribed[topic]
+	return ok
+}
+
+// count returns the number of subscriptions that haven't been cancelled
+func (t *subscriptionTable) count() int {
+	t.Lock()
+	defer t.Unlock()
+	return t.subscriptions.len()
+}
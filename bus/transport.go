@@ -0,0 +1,117 @@
+package bus
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dial opens a network connection to the broker. The host is either host:port, for a TCP connection
+// (using TLS if the options ask for it), or a URL:
+//
+//	tcp://host:port
+//	ws://host:port/path      MQTT over a WebSocket
+//	wss://host:port/path     ...secured with TLS, using the options' TLS config if given
+//	unix:///path/to/socket   a Unix domain socket
+func dial(host string, options ConnectOptions) (net.Conn, error) {
+	if !strings.Contains(host, "://") {
+		return dialTCP(host, options)
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse mqtt host %s: %s", host, err)
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		return dialTCP(u.Host, options)
+	case "ws", "wss":
+		return dialWebsocket(u, options)
+	case "unix":
+		return net.DialTimeout("unix", u.Path, ackTimeout)
+	}
+	return nil, fmt.Errorf("Unsupported mqtt transport %s", u.Scheme)
+}
+
+func dialTCP(host string, options ConnectOptions) (net.Conn, error) {
+	if options.TLS != nil {
+		return tls.DialWithDialer(&net.Dialer{Timeout: ackTimeout}, "tcp", host, options.TLS)
+	}
+	return net.DialTimeout("tcp", host, ackTimeout)
+}
+
+func dialWebsocket(u *url.URL, options ConnectOptions) (net.Conn, error) {
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: ackTimeout,
+		Subprotocols:     []string{"mqtt"},
+		TLSClientConfig:  options.TLS,
+	}
+
+	ws, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return newWebsocketConn(ws), nil
+}
+
+// websocketConn carries an MQTT stream over a WebSocket, in binary messages. Packets may be split
+// across messages, or share them.
+type websocketConn struct {
+	*websocket.Conn
+	reader    io.Reader
+	writeLock sync.Mutex
+}
+
+func newWebsocketConn(ws *websocket.Conn) net.Conn {
+	return &websocketConn{Conn: ws}
+}
+
+func (c *websocketConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			kind, reader, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if kind != websocket.BinaryMessage {
+				return 0, fmt.Errorf("Unexpected websocket message type %d", kind)
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *websocketConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *websocketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
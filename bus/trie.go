@@ -0,0 +1,147 @@
+package bus
+
+import "strings"
+
+// topicTrie indexes values by the topic filter they were added with, one level of the filter per
+// node, so the values whose filters match a topic can be found by walking only the branches the
+// topic could match - the literal level, "+" and "#" - instead of comparing the topic against every
+// filter. The same filter may be added with any number of values. It is not safe for concurrent use.
+type topicTrie struct {
+	root *trieNode
+	size int
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	values   []interface{}
+}
+
+func newTopicTrie() *topicTrie {
+	return &topicTrie{
+		root: &trieNode{},
+	}
+}
+
+// add adds a value under a topic filter
+func (t *topicTrie) add(filter string, value interface{}) {
+	node := t.root
+	for _, level := range strings.Split(filter, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*trieNode)
+			}
+			child = &trieNode{}
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.values = append(node.values, value)
+	t.size++
+}
+
+// remove removes a value added under a topic filter, returning false if it wasn't there. Branches
+// left empty are pruned.
+func (t *topicTrie) remove(filter string, value interface{}) bool {
+	return t.root.remove(strings.Split(filter, "/"), value, t)
+}
+
+func (n *trieNode) remove(levels []string, value interface{}, t *topicTrie) bool {
+	if len(levels) == 0 {
+		for i, v := range n.values {
+			if v == value {
+				n.values = append(n.values[:i], n.values[i+1:]...)
+				t.size--
+				return true
+			}
+		}
+		return false
+	}
+
+	child, ok := n.children[levels[0]]
+	if !ok || !child.remove(levels[1:], value, t) {
+		return false
+	}
+	if len(child.values) == 0 && len(child.children) == 0 {
+		delete(n.children, levels[0])
+	}
+	return true
+}
+
+// get returns the values added under exactly this topic filter
+func (t *topicTrie) get(filter string) []interface{} {
+	node := t.root
+	for _, level := range strings.Split(filter, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			return nil
+		}
+		node = child
+	}
+	return node.values
+}
+
+// match calls visit with every value whose filter matches the topic, using the same rules as matches()
+func (t *topicTrie) match(topic string, visit func(value interface{})) {
+	t.root.match(topic, visit)
+}
+
+func (n *trieNode) match(topic string, visit func(value interface{})) {
+	// a # here matches whatever is left of the topic
+	if hash, ok := n.children["#"]; ok {
+		visitAll(hash.values, visit)
+	}
+
+	level, rest, last := topic, "", true
+	if i := strings.IndexByte(topic, '/'); i >= 0 {
+		level, rest, last = topic[:i], topic[i+1:], false
+	}
+
+	for _, key := range [2]string{level, "+"} {
+		child, ok := n.children[key]
+		if !ok {
+			continue
+		}
+		if last {
+			visitAll(child.values, visit)
+			// make finance/stock/ibm/# match finance/stock/ibm
+			if hash, ok := child.children["#"]; ok {
+				visitAll(hash.values, visit)
+			}
+		} else {
+			child.match(rest, visit)
+		}
+		if level == "+" {
+			break
+		}
+	}
+}
+
+// walk calls visit with every value, along with the filter it was added under
+func (t *topicTrie) walk(visit func(filter string, value interface{})) {
+	t.root.walk("", true, visit)
+}
+
+func (n *trieNode) walk(filter string, root bool, visit func(filter string, value interface{})) {
+	for _, v := range n.values {
+		visit(filter, v)
+	}
+	for level, child := range n.children {
+		if root {
+			child.walk(level, false, visit)
+		} else {
+			child.walk(filter+"/"+level, false, visit)
+		}
+	}
+}
+
+// len returns the number of values in the trie
+func (t *topicTrie) len() int {
+	return t.size
+}
+
+func visitAll(values []interface{}, visit func(value interface{})) {
+	for _, v := range values {
+		visit(v)
+	}
+}
@@ -0,0 +1,134 @@
+package bus
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+var trieFilters = []string{
+	"#",
+	"+",
+	"a",
+	"a/#",
+	"a/+",
+	"a/b",
+	"a/b/#",
+	"a/+/c",
+	"a/+/#",
+	"+/b/c",
+	"+/+/+",
+	"a//c",
+	"$node/+/#",
+	"/a",
+}
+
+var trieTopics = []string{
+	"",
+	"a",
+	"b",
+	"a/b",
+	"a/b/c",
+	"a/x/c",
+	"a/b/c/d",
+	"x/b/c",
+	"a//c",
+	"/a",
+	"$node/1234/module/rpc",
+}
+
+func TestTopicTrieMatchesLikeMatches(t *testing.T) {
+	trie := newTopicTrie()
+	for _, filter := range trieFilters {
+		trie.add(filter, filter)
+	}
+
+	for _, topic := range trieTopics {
+		var expected, actual []string
+		for _, filter := range trieFilters {
+			if matches(filter, topic) {
+				expected = append(expected, filter)
+			}
+		}
+		trie.match(topic, func(v interface{}) {
+			actual = append(actual, v.(string))
+		})
+		sort.Strings(expected)
+		sort.Strings(actual)
+
+		if fmt.Sprint(expected) != fmt.Sprint(actual) {
+			t.Errorf("Topic %q: expected %v, got %v", topic, expected, actual)
+		}
+	}
+}
+
+func TestTopicTrieRemove(t *testing.T) {
+	trie := newTopicTrie()
+	trie.add("a/b", 1)
+	trie.add("a/b", 2)
+	trie.add("a/+/c", 3)
+
+	if trie.remove("a/b", 3) {
+		t.Error("Removed a value that was added under another filter")
+	}
+	if !trie.remove("a/b", 1) || trie.remove("a/b", 1) {
+		t.Error("Expected to remove the value exactly once")
+	}
+	if values := trie.get("a/b"); len(values) != 1 || values[0] != 2 {
+		t.Errorf("Expected only 2 to be left under a/b, got %v", values)
+	}
+
+	trie.remove("a/b", 2)
+	trie.remove("a/+/c", 3)
+	if trie.len() != 0 || len(trie.root.children) != 0 {
+		t.Errorf("Expected an empty trie, with its branches pruned")
+	}
+}
+
+// subscribe the way a sphere does: a handful of subscriptions per channel of each device, and a
+// few wildcards
+func benchmarkSubscriptions(n int) (*subscriptionTable, []*Subscription) {
+	table := newSubscriptionTable(nil, nil)
+	var subscriptions []*Subscription
+	for i := 0; len(subscriptions) < n; i++ {
+		for _, topic := range []string{
+			"$device/%d/channel/%d/event/state",
+			"$device/%d/channel/%d/reply",
+			"$device/%d/channel/%d",
+		} {
+			s := &Subscription{topic: fmt.Sprintf(topic, i/10, i%10)}
+			table.add(s)
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	for _, topic := range []string{"$device/+/channel/+/event/state", "$node/+/module/#"} {
+		s := &Subscription{topic: topic}
+		table.add(s)
+		subscriptions = append(subscriptions, s)
+	}
+	return table, subscriptions
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		table, subscriptions := benchmarkSubscriptions(n)
+		topic := fmt.Sprintf("$device/%d/channel/%d/event/state", n/20, 5)
+
+		b.Run(fmt.Sprintf("trie/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				table.matching(topic)
+			}
+		})
+
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var matching []*Subscription
+				for _, s := range subscriptions {
+					if matches(s.topic, topic) {
+						matching = append(matching, s)
+					}
+				}
+			}
+		})
+	}
+}
@@ -152,6 +152,11 @@ func NoCloud() bool {
 	return Bool(false, "noCloud")
 }
 
+// DataPath returns the directory that persistent data (including the config files) is kept under
+func DataPath() string {
+	return dataPath
+}
+
 func String(def string, path ...string) string {
 	val := get(path...)
 	if val == nil {
@@ -199,6 +204,22 @@ func MustStringArray(path ...string) []string {
 	return b
 }
 
+// StringArray returns the string array property at the path, with a default. A string (as set from
+// the environment) is split on commas.
+func StringArray(def []string, path ...string) []string {
+	switch val := get(path...).(type) {
+	case []interface{}:
+		a := make([]string, len(val))
+		for i := range val {
+			a[i] = val[i].(string)
+		}
+		return a
+	case string:
+		return strings.Split(val, ",")
+	}
+	return def
+}
+
 // Int returns the integer property at the path, with a default
 func Int(def int, path ...string) int {
 	val := get(path...)
@@ -0,0 +1,17 @@
+package model
+
+// ACL declares the topics a module may publish and subscribe to
+type ACL struct {
+	Publish   TopicRules `json:"publish,omitempty"`
+	Subscribe TopicRules `json:"subscribe,omitempty"`
+}
+
+// TopicRules are topic patterns, which may use the + and # wildcards. Of the patterns a topic
+// matches, the most specific decides whether it is permitted (a topic level being more specific
+// than +, and + than #), and Deny wins if an Allow and a Deny pattern are as specific as each
+// other. A topic matching no Deny pattern is permitted, so deny "#" to permit only the allowed
+// topics.
+type TopicRules struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
@@ -8,6 +8,7 @@ type Module struct {
 	Description string `json:"description" redis:"description"`
 	Author      string `json:"author" redis:"author"`
 	License     string `json:"license" redis:"license"`
+	ACL         *ACL   `json:"acl,omitempty" redis:"-"`
 }
 
 func (m *Module) GetServiceAnnouncement() *ServiceAnnouncement {
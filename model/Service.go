@@ -5,4 +5,6 @@ type ServiceAnnouncement struct {
 	Schema           string    `json:"schema" redis:"schema"`
 	SupportedMethods *[]string `json:"supportedMethods" redis:"supportedMethods,json"`
 	SupportedEvents  *[]string `json:"supportedEvents" redis:"supportedEvents,json"`
+	// Codec is the rpc codec the service's requests, responses and events use. Empty means json2.
+	Codec string `json:"codec,omitempty" redis:"codec"`
 }
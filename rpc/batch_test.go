@@ -0,0 +1,130 @@
+package rpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nps5696/go-ninja/rpc"
+	"github.com/nps5696/go-ninja/rpc/json2"
+)
+
+type batchService struct {
+	notes chan string
+}
+
+func (s *batchService) Echo(text *string) (*string, error) {
+	return text, nil
+}
+
+func (s *batchService) Fail() error {
+	return errors.New("Failed")
+}
+
+func (s *batchService) Note(text *string) error {
+	s.notes <- *text
+	return nil
+}
+
+func TestCallBatch(t *testing.T) {
+	service := &batchService{notes: make(chan string, 10)}
+	b, _ := serve(t, "TestCallBatch", service, []string{"echo", "fail", "note"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+
+	var first, second string
+	calls := []*rpc.Call{
+		{ServiceMethod: "echo", Args: "first", Reply: &first},
+		{ServiceMethod: "fail"},
+		{ServiceMethod: "missing"},
+		{ServiceMethod: "echo", Args: "second", Reply: &second},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := client.CallBatch(ctx, serviceTopic, calls); err != nil {
+		t.Fatalf("Failed to call batch: %s", err)
+	}
+
+	if calls[0].Error != nil || first != "first" {
+		t.Errorf("Expected reply %q, got %q (error %v)", "first", first, calls[0].Error)
+	}
+	if calls[1].Error == nil {
+		t.Errorf("Expected the failed call to have an error")
+	}
+	if calls[2].Error == nil {
+		t.Errorf("Expected the call to a missing method to have an error")
+	}
+	if calls[3].Error != nil || second != "second" {
+		t.Errorf("Expected reply %q, got %q (error %v)", "second", second, calls[3].Error)
+	}
+}
+
+func TestBatchNotifications(t *testing.T) {
+	service := &batchService{notes: make(chan string, 10)}
+	b, _ := serve(t, "TestBatchNotifications", service, []string{"echo", "fail", "note"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	replies := make(chan []byte, 10)
+	b.Subscribe(serviceTopic+"/reply", func(topic string, payload []byte) {
+		replies <- payload
+	})
+
+	b.Publish(serviceTopic, []byte(`[
+		{"jsonrpc":"2.0","method":"note","params":"noted"},
+		{"jsonrpc":"2.0","id":"1","method":"fail"},
+		{"jsonrpc":"2.0","method":"fail"},
+		{"jsonrpc":"2.0","id":"2","method":"echo","params":"echoed"}
+	]`))
+
+	// notifications are served, but only the requests with an id are answered, in one message
+	expectReceived(t, service.notes, "noted")
+
+	var responses []map[string]json.RawMessage
+	select {
+	case reply := <-replies:
+		if err := json.Unmarshal(reply, &responses); err != nil || len(responses) != 2 {
+			t.Fatalf("Expected two responses, got %s", reply)
+		}
+		if _, ok := responses[0]["error"]; !ok || string(responses[0]["id"]) != `"1"` {
+			t.Errorf("Expected an error in reply to the first request, got %s", reply)
+		}
+		if string(responses[1]["result"]) != `"echoed"` || string(responses[1]["id"]) != `"2"` {
+			t.Errorf("Expected a result in reply to the second request, got %s", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the reply")
+	}
+
+	select {
+	case reply := <-replies:
+		t.Errorf("Expected a single reply, also got %s", reply)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestBatchEmpty(t *testing.T) {
+	service := &batchService{notes: make(chan string, 10)}
+	b, _ := serve(t, "TestBatchEmpty", service, []string{"echo"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	replies := make(chan string, 10)
+	b.Subscribe(serviceTopic+"/reply", func(topic string, payload []byte) {
+		replies <- string(payload)
+	})
+
+	b.Publish(serviceTopic, []byte(`[]`))
+
+	select {
+	case reply := <-replies:
+		if !json2IsError(reply) {
+			t.Errorf("Expected an error reply, got %s", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the reply")
+	}
+}
@@ -0,0 +1,166 @@
+package cbor_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nps5696/go-ninja/bus"
+	"github.com/nps5696/go-ninja/rpc"
+	"github.com/nps5696/go-ninja/rpc/cbor"
+)
+
+const serviceTopic = "$node/test/service"
+
+type power struct {
+	Voltage []float64 `json:"voltage"`
+	Name    string    `json:"name,omitempty"`
+}
+
+// serveCodec decodes each request published to serviceTopic with the cbor codec, as the server does,
+// and hands it to serve
+func serveCodec(t *testing.T, host string, serve func(b bus.Bus, req rpc.CodecRequest)) *bus.MemoryBus {
+	b, err := bus.ConnectMemoryBus(host, "server")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	codec := cbor.NewCodec()
+	b.Subscribe(serviceTopic, func(topic string, payload []byte) {
+		req, err := codec.NewRequest(topic, payload)
+		if err != nil {
+			req.WriteError(b, err)
+			return
+		}
+		serve(b, req)
+	})
+
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	b := serveCodec(t, "TestRoundTrip", func(b bus.Bus, req rpc.CodecRequest) {
+		var args power
+		if method, _ := req.Method(); method != "Get" {
+			req.WriteError(b, errors.New("Unexpected method "+method))
+			return
+		}
+		if err := req.ReadRequest(&args); err != nil {
+			req.WriteError(b, err)
+			return
+		}
+		req.(rpc.ProgressWriter).WriteProgress(b, 50)
+		args.Name = "got"
+		req.WriteResponse(b, &args)
+	})
+	defer b.Destroy()
+
+	client := rpc.NewClient(b, cbor.NewClientCodec())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var reply power
+	var updates []int
+	err := client.CallWithProgress(ctx, serviceTopic, "get", &power{Voltage: []float64{230.1, 229.9}}, &reply, func(update []byte) {
+		var percent int
+		if err := cbor.Unmarshal(update, &percent); err != nil {
+			t.Errorf("Failed to read update: %s", err)
+		}
+		updates = append(updates, percent)
+	})
+	if err != nil {
+		t.Fatalf("Failed to call get: %s", err)
+	}
+	if reply.Name != "got" || len(reply.Voltage) != 2 || reply.Voltage[0] != 230.1 || reply.Voltage[1] != 229.9 {
+		t.Errorf("Expected the args back, got %+v", reply)
+	}
+	if len(updates) != 1 || updates[0] != 50 {
+		t.Errorf("Expected one update of 50, got %v", updates)
+	}
+}
+
+func TestErrorRoundTrip(t *testing.T) {
+	errs := map[string]error{
+		"Missing": &rpc.Error{Code: rpc.E_NO_METHOD, Message: "No such method"},
+		"Fail":    errors.New("Failed"),
+		"Busy":    rpc.ErrBusy,
+	}
+
+	b := serveCodec(t, "TestErrorRoundTrip", func(b bus.Bus, req rpc.CodecRequest) {
+		method, _ := req.Method()
+		req.WriteError(b, errs[method])
+	})
+	defer b.Destroy()
+
+	client := rpc.NewClient(b, cbor.NewClientCodec())
+
+	// an error keeps its code and message
+	err := client.CallWithTimeout(serviceTopic, "missing", nil, nil, time.Second)
+	if rpcErr, ok := err.(*rpc.Error); !ok || rpcErr.Code != rpc.E_NO_METHOD || rpcErr.Message != "No such method" {
+		t.Errorf("Expected the service's error, got %#v", err)
+	}
+
+	// any other error is a server error
+	err = client.CallWithTimeout(serviceTopic, "fail", nil, nil, time.Second)
+	if rpcErr, ok := err.(*rpc.Error); !ok || rpcErr.Code != rpc.E_SERVER || rpcErr.Message != "Failed" {
+		t.Errorf("Expected a server error, got %#v", err)
+	}
+
+	if err := client.CallWithTimeout(serviceTopic, "busy", nil, nil, time.Second); err != rpc.ErrBusy {
+		t.Errorf("Expected ErrBusy, got %v", err)
+	}
+}
+
+func TestBadRequest(t *testing.T) {
+	// a request that isn't cbor is a parse error, with the same code as json2's
+	_, err := cbor.NewCodec().NewRequest(serviceTopic, []byte(`{"jsonrpc":"2.0"}`))
+	if rpcErr, ok := err.(*rpc.Error); !ok || rpcErr.Code != rpc.E_PARSE {
+		t.Errorf("Expected a parse error, got %#v", err)
+	}
+}
+
+func TestNotification(t *testing.T) {
+	b, err := bus.ConnectMemoryBus("TestNotification", "server")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer b.Destroy()
+
+	received := make(chan []byte, 1)
+	b.Subscribe("$node/test/event/state", func(topic string, payload []byte) {
+		received <- payload
+	})
+
+	if err := cbor.NewCodec().SendNotification(b, "$node/test/event/state", &power{Voltage: []float64{230.1}}); err != nil {
+		t.Fatalf("Failed to send notification: %s", err)
+	}
+
+	select {
+	case payload := <-received:
+		var state power
+		if err := cbor.ReadNotification(payload, &state); err != nil || len(state.Voltage) != 1 || state.Voltage[0] != 230.1 {
+			t.Errorf("Expected the notification's params, got %+v (error %v)", state, err)
+		}
+
+		// or as JSON, for callers that want it
+		var params json.RawMessage
+		if err := cbor.ReadNotification(payload, &params); err != nil || string(params) != `{"voltage":[230.1]}` {
+			t.Errorf("Expected the notification's params as JSON, got %s (error %v)", params, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the notification")
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	provider, ok := rpc.LookupCodec(cbor.Name)
+	if !ok {
+		t.Fatalf("Expected the cbor codec to be registered")
+	}
+	if _, ok := provider.NewClientCodec().(*cbor.ClientCodec); !ok {
+		t.Errorf("Expected the registered codec to make cbor client codecs")
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2014 Ninja Blocks Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbor
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	fxcbor "github.com/fxamacker/cbor/v2"
+	"github.com/nps5696/go-ninja/rpc"
+)
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// clientRequest represents a request sent by a client. See serverRequest.
+type clientRequest struct {
+	Method         string      `cbor:"1,keyasint"`
+	Params         interface{} `cbor:"2,keyasint,omitempty"`
+	ID             uint32      `cbor:"3,keyasint"`
+	Time           int64       `cbor:"4,keyasint,omitempty"`
+	Deadline       int64       `cbor:"5,keyasint,omitempty"`
+	Caller         string      `cbor:"6,keyasint,omitempty"`
+	Progress       bool        `cbor:"7,keyasint,omitempty"`
+	IdempotencyKey string      `cbor:"8,keyasint,omitempty"`
+	ReplyTo        string      `cbor:"9,keyasint,omitempty"`
+}
+
+// clientResponse represents a response, or a progress update, received by a client. See serverResponse.
+type clientResponse struct {
+	ID       fxcbor.RawMessage `cbor:"3,keyasint"`
+	Result   fxcbor.RawMessage `cbor:"10,keyasint"`
+	Error    *rpc.Error        `cbor:"11,keyasint"`
+	Progress fxcbor.RawMessage `cbor:"12,keyasint"`
+}
+
+func NewClientCodec() *ClientCodec {
+	return &ClientCodec{}
+}
+
+type ClientCodec struct {
+}
+
+// EncodeClientRequest encodes parameters for a client request.
+func (c *ClientCodec) EncodeClientRequest(call *rpc.Call) ([]byte, error) {
+	req := &clientRequest{
+		Method:         call.ServiceMethod,
+		Params:         call.Args,
+		ID:             call.ID,
+		Time:           makeTimestamp(),
+		Caller:         call.Caller,
+		Progress:       call.Progress != nil,
+		IdempotencyKey: call.IdempotencyKey,
+		ReplyTo:        call.ReplyTo,
+	}
+
+	if !call.Deadline.IsZero() {
+		req.Deadline = call.Deadline.UnixNano() / int64(time.Millisecond)
+	}
+
+	return encMode.Marshal(req)
+}
+
+func (c *ClientCodec) DecodeIdAndError(msg []byte) (*uint32, error) {
+	res := &clientResponse{}
+
+	if err := decMode.Unmarshal(msg, res); err != nil {
+		return nil, err
+	}
+
+	id, err := decodeID(res.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Error != nil {
+		if res.Error.Code == rpc.E_BUSY {
+			return &id, rpc.ErrBusy
+		}
+		return &id, res.Error
+	}
+
+	return &id, nil
+}
+
+// DecodeClientResponse decodes the response body of a client request into
+// the interface reply.
+func (c *ClientCodec) DecodeClientResponse(msg []byte, reply interface{}) error {
+	res := &clientResponse{}
+	if err := decMode.Unmarshal(msg, res); err != nil {
+		return err
+	}
+	if res.Result != nil {
+		return decMode.Unmarshal(res.Result, reply)
+	}
+	return nil
+}
+
+// DecodeProgress decodes an update on the progress of a call. The update is left CBOR encoded.
+func (c *ClientCodec) DecodeProgress(msg []byte) (uint32, []byte, bool) {
+	res := &clientResponse{}
+
+	if err := decMode.Unmarshal(msg, res); err != nil || res.Progress == nil {
+		return 0, nil, false
+	}
+
+	id, err := decodeID(res.ID)
+	if err != nil {
+		log.Debugf("Ignoring progress update: %s", err)
+		return 0, nil, false
+	}
+
+	return id, res.Progress, true
+}
+
+// decodeID reads the id of one of our calls from a response
+func decodeID(raw fxcbor.RawMessage) (uint32, error) {
+	if raw == nil {
+		return 0, fmt.Errorf("Reply has no id. Probably not for us")
+	}
+
+	var id uint32
+	err := decMode.Unmarshal(raw, &id)
+	if err != nil {
+		var sID string
+		if err = decMode.Unmarshal(raw, &sID); err == nil {
+			var bigID uint64
+			bigID, err = strconv.ParseUint(sID, 10, 32)
+			id = uint32(bigID)
+		}
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("Reply id isn't a uint32 or string uint32. Probably not for us")
+	}
+
+	return id, nil
+}
+
+// Unmarshal decodes a CBOR encoded value, e.g. an update on a call's progress, into v. A
+// *json.RawMessage is given the value as JSON, for callers that only handle JSON.
+func Unmarshal(data []byte, v interface{}) error {
+	raw, ok := v.(*json.RawMessage)
+	if !ok {
+		return decMode.Unmarshal(data, v)
+	}
+
+	var value interface{}
+	if err := decMode.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	*raw = encoded
+	return nil
+}
@@ -0,0 +1,317 @@
+// Copyright 2014 Ninja Blocks Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cbor is an rpc codec using CBOR (RFC 7049). It has the same requests, responses and
+// notifications as json2, but they are much smaller and cheaper to parse, which suits services sending
+// lots of events. Their fields are keyed by small integers instead of names.
+//
+// Errors are rpc.Errors, so that callers can handle them the same way whichever codec a service uses.
+//
+// Importing the package registers the codec with rpc.RegisterCodec, so that a module can call and
+// serve services announcing it:
+//
+//	import _ "github.com/nps5696/go-ninja/rpc/cbor"
+package cbor
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	fxcbor "github.com/fxamacker/cbor/v2"
+	"github.com/nps5696/go-ninja/bus"
+	"github.com/nps5696/go-ninja/logger"
+	"github.com/nps5696/go-ninja/rpc"
+	"github.com/nps5696/go-ninja/simtime"
+)
+
+// Name is the name services using this codec announce (see model.ServiceAnnouncement)
+const Name = "cbor"
+
+var log = logger.GetLogger("mqtt-cborrpc")
+
+func init() {
+	rpc.RegisterCodec(Name, rpc.CodecProvider{
+		NewCodec:         func() rpc.Codec { return NewCodec() },
+		NewClientCodec:   func() rpc.ClientCodec { return NewClientCodec() },
+		ReadNotification: ReadNotification,
+		Unmarshal:        Unmarshal,
+	})
+}
+
+// decMode decodes CBOR maps into interface{} values as map[string]interface{}, as encoding/json would,
+// so that they can be passed on as JSON
+var decMode, _ = fxcbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+// encMode encodes floats in fewer bytes where that loses nothing, which many sensor readings allow
+var encMode, _ = fxcbor.EncOptions{
+	ShortestFloat: fxcbor.ShortestFloat16,
+}.EncMode()
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// serverRequest represents a request, or a notification, received by the server
+type serverRequest struct {
+	Method         string            `cbor:"1,keyasint,omitempty"`
+	Params         fxcbor.RawMessage `cbor:"2,keyasint,omitempty"`
+	ID             fxcbor.RawMessage `cbor:"3,keyasint,omitempty"` // copied to the response as it is
+	Time           int64             `cbor:"4,keyasint,omitempty"` // milliseconds since the epoch
+	Deadline       int64             `cbor:"5,keyasint,omitempty"` // when the caller gives up
+	Caller         string            `cbor:"6,keyasint,omitempty"`
+	Progress       bool              `cbor:"7,keyasint,omitempty"` // whether the caller wants updates
+	IdempotencyKey string            `cbor:"8,keyasint,omitempty"`
+	ReplyTo        string            `cbor:"9,keyasint,omitempty"`
+}
+
+// serverNotification represents a notification sent by the server
+type serverNotification struct {
+	Params []interface{} `cbor:"2,keyasint"`
+	Time   int64         `cbor:"4,keyasint"`
+}
+
+// serverResponse represents a response, or an update on a request's progress, sent by the server
+type serverResponse struct {
+	ID       fxcbor.RawMessage `cbor:"3,keyasint"`
+	Time     int64             `cbor:"4,keyasint"`
+	Result   interface{}       `cbor:"10,keyasint,omitempty"`
+	Error    *rpc.Error        `cbor:"11,keyasint,omitempty"`
+	Progress interface{}       `cbor:"12,keyasint,omitempty"`
+}
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// NewCodec returns a new CBOR Codec.
+func NewCodec() *Codec {
+	return &Codec{}
+}
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct {
+}
+
+// NewRequest returns a CodecRequest.
+func (c *Codec) NewRequest(topic string, payload []byte) (rpc.CodecRequest, error) {
+
+	log.Debugf("> Incoming to %s : %d bytes", topic, len(payload))
+
+	req := new(serverRequest)
+	var err error
+	if errDecode := decMode.Unmarshal(payload, req); errDecode != nil {
+		log.Infof("Bad incoming cbor rpc request to %s error:%s", topic, errDecode)
+		err = &rpc.Error{
+			Code:    rpc.E_PARSE,
+			Message: errDecode.Error(),
+		}
+	} else if req.Method == "" {
+		err = &rpc.Error{
+			Code:    rpc.E_INVALID_REQ,
+			Message: "rpc: method request ill-formed: missing method field",
+		}
+	}
+
+	return &CodecRequest{request: req, err: err, topic: topic, replyTopic: inbox(req)}, err
+}
+
+// SendNotification sends a notification, e.g. an event
+func (c *Codec) SendNotification(client bus.Bus, topic string, payload ...interface{}) error {
+
+	notification, err := encMode.Marshal(&serverNotification{
+		Params: payload,
+		Time:   makeTimestamp(),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to marshall rpc notification: %s", err)
+	}
+
+	if !strings.HasSuffix(topic, "/module/status") {
+		log.Debugf("< Outgoing to %s : %d bytes", topic, len(notification))
+	}
+
+	client.Publish(topic, notification)
+
+	return nil
+}
+
+// ReadNotification reads the payload of a notification sent by SendNotification into params
+func ReadNotification(notification []byte, params interface{}) error {
+	msg := new(serverRequest)
+	if err := decMode.Unmarshal(notification, msg); err != nil {
+		return err
+	}
+
+	var payloads []fxcbor.RawMessage
+	if err := decMode.Unmarshal(msg.Params, &payloads); err != nil {
+		return err
+	}
+
+	if len(payloads) == 0 {
+		return nil
+	}
+	return Unmarshal(payloads[0], params)
+}
+
+// inbox returns the caller's own reply topic, if it named one. As with json2, only topics under $rpc/
+// are used.
+func inbox(req *serverRequest) string {
+	if !strings.HasPrefix(req.ReplyTo, "$rpc/") || strings.ContainsAny(req.ReplyTo, "+#") {
+		return ""
+	}
+	return req.ReplyTo
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	request         *serverRequest
+	err             error
+	topic           string
+	replyTopic      string
+	replyProperties *bus.Properties
+}
+
+// SetReply sends the response to the given topic, with the given properties
+func (c *CodecRequest) SetReply(topic string, properties *bus.Properties) {
+	c.replyTopic = topic
+	c.replyProperties = properties
+}
+
+// Deadline returns when the caller will give up waiting for the response, if it said
+func (c *CodecRequest) Deadline() (time.Time, bool) {
+	if c.request.Deadline == 0 {
+		return time.Time{}, false
+	}
+	return fromTimestamp(c.request.Deadline), true
+}
+
+// IdempotencyKey returns the key that every attempt at the call carries, if the caller gave one
+func (c *CodecRequest) IdempotencyKey() string {
+	return c.request.IdempotencyKey
+}
+
+// ReadMessage fills in the request's id, the time it was sent and its caller
+func (c *CodecRequest) ReadMessage(message *rpc.Message) {
+	if c.request.ID != nil {
+		var id interface{}
+		if err := decMode.Unmarshal(c.request.ID, &id); err == nil {
+			message.ID = fmt.Sprintf("%v", id)
+		}
+	}
+	if c.request.Time != 0 {
+		message.Time = fromTimestamp(c.request.Time)
+	}
+	message.Caller = c.request.Caller
+}
+
+// Method returns the RPC method for the current request.
+func (c *CodecRequest) Method() (string, error) {
+	if c.err == nil {
+		return upperFirst(c.request.Method), nil
+	}
+	return "", c.err
+}
+
+// ReadRequest fills the request object for the RPC method.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err == nil && c.request.Params != nil {
+		if err := decMode.Unmarshal(c.request.Params, args); err != nil {
+			c.err = &rpc.Error{
+				Code:    rpc.E_INVALID_REQ,
+				Message: err.Error(),
+			}
+		}
+	}
+	return c.err
+}
+
+// WriteResponse encodes the response and writes it to the reply topic
+func (c *CodecRequest) WriteResponse(client bus.Bus, reply interface{}) {
+	c.writeServerResponse(client, &serverResponse{
+		ID:     c.request.ID,
+		Result: reply,
+		Time:   makeTimestamp(),
+	})
+}
+
+func (c *CodecRequest) WriteError(client bus.Bus, err error) {
+	rpcErr, ok := err.(*rpc.Error)
+	if !ok {
+		code := rpc.E_SERVER
+		if err == rpc.ErrBusy {
+			code = rpc.E_BUSY
+		}
+		rpcErr = &rpc.Error{
+			Code:    code,
+			Message: err.Error(),
+		}
+	}
+	c.writeServerResponse(client, &serverResponse{
+		ID:    c.request.ID,
+		Error: rpcErr,
+		Time:  makeTimestamp(),
+	})
+}
+
+// WriteProgress sends an update on the request's progress, if the caller asked for them
+func (c *CodecRequest) WriteProgress(client bus.Bus, update interface{}) {
+	if c.request.Progress {
+		c.writeServerResponse(client, &serverResponse{
+			ID:       c.request.ID,
+			Progress: update,
+			Time:     makeTimestamp(),
+		})
+	}
+}
+
+func (c *CodecRequest) writeServerResponse(client bus.Bus, res *serverResponse) {
+	// Id is null for notifications and they don't have a response.
+	if c.request.ID == nil {
+		return
+	}
+
+	replyTopic := c.topic + "/reply"
+	if c.replyTopic != "" {
+		replyTopic = c.replyTopic
+	}
+
+	payload, err := encMode.Marshal(res)
+	if err != nil {
+		log.Errorf("Failed to marshall rpc response: %s", err)
+		return
+	}
+
+	log.Debugf("< Outgoing to %s : %d bytes", replyTopic, len(payload))
+
+	err = client.PublishWithOptions(replyTopic, payload, bus.PublishOptions{QoS: bus.AtLeastOnce, Properties: c.replyProperties})
+	if err != nil {
+		log.Errorf("Failed to write rpc response to MQTT: %s", err)
+	}
+}
+
+func makeTimestamp() int64 {
+	return simtime.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func fromTimestamp(timestamp int64) time.Time {
+	return time.Unix(0, timestamp*int64(time.Millisecond))
+}
+
+func upperFirst(s string) string {
+	if s == "" {
+		return ""
+	}
+	r, n := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[n:]
+}
@@ -6,8 +6,10 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"strconv"
 	"sync"
 	"time"
 
@@ -25,6 +27,20 @@ type ClientCodec interface {
 	DecodeClientResponse(msg []byte, reply interface{}) error
 }
 
+// BatchClientCodec is implemented by ClientCodecs that can send several calls in one message
+type BatchClientCodec interface {
+	EncodeClientBatch(calls []*Call) ([]byte, error)
+	// SplitClientResponses splits a batch of responses, returning false if msg isn't a batch
+	SplitClientResponses(msg []byte) ([][]byte, bool)
+}
+
+// ProgressClientCodec is implemented by ClientCodecs that can ask for and decode progress updates
+type ProgressClientCodec interface {
+	// DecodeProgress returns the id of the call a progress update is for, and the update, returning
+	// false if msg isn't one
+	DecodeProgress(msg []byte) (id uint32, update []byte, ok bool)
+}
+
 // Call represents an active RPC.
 type Call struct {
 	Topic         string      // The MQTT topic this call will be sent to
@@ -34,6 +50,16 @@ type Call struct {
 	Error         error       // After completion, the error status.
 	Done          chan *Call  // Strobes when call is complete.
 	ID            uint32      // Used to map responses
+	Deadline      time.Time   // When the caller gives up on the reply, if it will. Sent to the server.
+	Caller        string      // Who is making the call, if they want the server to know
+	// IdempotencyKey is the same for every attempt at a call, so the server only acts on it once
+	IdempotencyKey string
+	// ReplyTo is our own topic the reply is sent to, if not the shared "<topic>/reply"
+	ReplyTo string
+
+	// Progress is given the updates the server sends before its reply, as encoded by the codec. The
+	// server is only asked for them if it is set.
+	Progress func(update []byte)
 }
 
 // Client represents an RPC Client.
@@ -46,6 +72,20 @@ type Client struct {
 	mqtt       bus.Bus
 	pending    map[uint32]*Call
 	subscribed map[string]bool
+
+	// UserProperties are sent with every call, if the bus speaks MQTT 5
+	UserProperties map[string]string
+	// Caller identifies us to the services we call
+	Caller string
+	// ReplyInbox has replies sent to a topic of our own, rather than the "<topic>/reply" that every
+	// client of a service listens to. The services called must understand the request's replyTo.
+	ReplyInbox bool
+	// Inbox is the topic of our own that replies are sent to. If empty, a random topic under $rpc/
+	// is used.
+	Inbox string
+
+	responseTopic string
+	breakers      map[string]*breaker
 }
 
 // NewClient creates a new rpc client using the provided MQTT connection
@@ -53,6 +93,7 @@ func NewClient(mqtt bus.Bus, codec ClientCodec) *Client {
 	client := &Client{
 		pending:    make(map[uint32]*Call),
 		subscribed: make(map[string]bool),
+		breakers:   make(map[string]*breaker),
 		mqtt:       mqtt,
 		codec:      codec,
 	}
@@ -61,43 +102,232 @@ func NewClient(mqtt bus.Bus, codec ClientCodec) *Client {
 
 func (client *Client) send(call *Call) error {
 
+	if call.Caller == "" {
+		call.Caller = client.Caller
+	}
+
+	if err := client.setReplyTo(call); err != nil {
+		return err
+	}
+
 	payload, err := client.codec.EncodeClientRequest(call)
 	if err != nil {
 		return err
 	}
 
-	if call.Done != nil {
-		replyTopic := call.Topic + "/reply"
+	return client.publish(call.Topic, payload, call)
+}
+
+// setReplyTo has the reply to a call sent to our inbox, if we use one. MQTT 5 calls name it in their
+// properties instead.
+func (client *Client) setReplyTo(call *Call) error {
+	if !client.ReplyInbox || call.Done == nil {
+		return nil
+	}
+
+	if _, ok := client.mqtt.(bus.PropertiesBus); ok {
+		return nil
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	inbox, err := client.inbox()
+	if err != nil {
+		return err
+	}
+
+	call.ReplyTo = inbox
+	return nil
+}
+
+// inbox returns our own topic for replies, subscribing to it the first time. The mutex must be held.
+func (client *Client) inbox() (string, error) {
+
+	if client.responseTopic != "" {
+		return client.responseTopic, nil
+	}
+
+	responseTopic := client.Inbox
+	if responseTopic == "" {
+		responseTopic = fmt.Sprintf("$rpc/%08x/reply", rand.Uint32())
+	}
+
+	log.Debugf("Subscribing to %s", responseTopic)
+
+	var err error
+	if mqtt, ok := client.mqtt.(bus.PropertiesBus); ok {
+		_, err = mqtt.SubscribeWithProperties(responseTopic, bus.SubscribeOptions{QoS: bus.AtLeastOnce}, func(topic string, payload []byte, properties *bus.Properties) {
+			log.Debugf("< Incoming to %s : %s", topic, payload)
+			// progress is handled in order, and before the reply
+			if client.handleProgress(payload) {
+				return
+			}
+			go client.handleResponseWithProperties(topic, payload, properties)
+		})
+	} else {
+		_, err = client.mqtt.SubscribeWithOptions(responseTopic, bus.SubscribeOptions{QoS: bus.AtLeastOnce}, func(topic string, payload []byte) {
+			log.Debugf("< Incoming to %s : %s", topic, payload)
+			if client.handleProgress(payload) {
+				return
+			}
+			go client.handleResponse(topic, payload)
+		})
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	client.responseTopic = responseTopic
+	return responseTopic, nil
+}
+
+// publish sends a request holding one or more calls, and waits for the replies to those that have a
+// Done channel
+func (client *Client) publish(topic string, payload []byte, calls ...*Call) error {
+
+	if mqtt, ok := client.mqtt.(bus.PropertiesBus); ok {
+		return client.sendWithProperties(mqtt, topic, payload, calls)
+	}
+
+	client.mutex.Lock()
+
+	for _, call := range calls {
+		if call.Done == nil {
+			continue
+		}
+
+		replyTopic := topic + "/reply"
 
-		if !client.subscribed[replyTopic] {
+		if call.ReplyTo == "" && !client.subscribed[replyTopic] {
 
 			log.Debugf("Subscribing to %s", replyTopic)
 
-			_, err := client.mqtt.Subscribe(replyTopic, func(topic string, payload []byte) {
+			// Replies are sent at QoS 1, so they aren't lost if the connection drops while we wait
+			_, err := client.mqtt.SubscribeWithOptions(replyTopic, bus.SubscribeOptions{QoS: bus.AtLeastOnce}, func(topic string, payload []byte) {
 				log.Debugf("< Incoming to %s : %s", topic, payload)
+				// progress is handled in order, and before the reply
+				if client.handleProgress(payload) {
+					return
+				}
 				go client.handleResponse(topic, payload)
 			})
 
 			if err != nil {
+				client.mutex.Unlock()
 				return err
 			}
 
 			client.subscribed[replyTopic] = true
 		}
+
+		client.pending[call.ID] = call
 	}
 
-	log.Debugf("< Outgoing to %s : %s", call.Topic, payload)
+	client.mutex.Unlock()
 
-	client.mqtt.Publish(call.Topic, payload)
+	log.Debugf("< Outgoing to %s : %s", topic, payload)
 
-	if call.Done != nil {
-		client.pending[call.ID] = call
-	}
+	client.mqtt.Publish(topic, payload)
 
 	return nil
 }
 
+// sendWithProperties sends a request over MQTT 5. Instead of listening on the shared "<topic>/reply",
+// the request names our own response topic, and the reply is matched to it by its correlation data.
+func (client *Client) sendWithProperties(mqtt bus.PropertiesBus, topic string, payload []byte, calls []*Call) error {
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	responseTopic, err := client.inbox()
+	if err != nil {
+		return err
+	}
+
+	properties := &bus.Properties{
+		UserProperties: client.UserProperties,
+	}
+
+	for _, call := range calls {
+		if call.Done != nil {
+			// a batch's replies are matched by their ids instead
+			properties.ResponseTopic = responseTopic
+			properties.CorrelationData = []byte(strconv.FormatUint(uint64(call.ID), 10))
+			client.pending[call.ID] = call
+		}
+	}
+
+	log.Debugf("< Outgoing to %s : %s", topic, payload)
+
+	return mqtt.PublishWithOptions(topic, payload, bus.PublishOptions{Properties: properties})
+}
+
+func (client *Client) handleResponseWithProperties(topic string, payload []byte, properties *bus.Properties) {
+	if client.handleBatchResponse(topic, payload) {
+		return
+	}
+
+	_, err := client.codec.DecodeIdAndError(payload)
+
+	id, parseErr := strconv.ParseUint(string(properties.CorrelationData), 10, 32)
+	if parseErr != nil {
+		log.Debugf("Ignoring reply without valid correlation data: %s", payload)
+		return
+	}
+
+	client.complete(uint32(id), err, payload)
+}
+
+// handleProgress passes a progress update to the call it is for, returning false if the payload isn't one
+func (client *Client) handleProgress(payload []byte) bool {
+	codec, ok := client.codec.(ProgressClientCodec)
+	if !ok {
+		return false
+	}
+
+	id, update, ok := codec.DecodeProgress(payload)
+	if !ok {
+		return false
+	}
+
+	client.mutex.Lock()
+	call := client.pending[id]
+	client.mutex.Unlock()
+
+	if call == nil || call.Progress == nil {
+		log.Debugf("Ignoring progress of call %d", id)
+	} else {
+		call.Progress(update)
+	}
+	return true
+}
+
+// handleBatchResponse completes the calls answered by a batch of responses, returning false if the
+// payload isn't one
+func (client *Client) handleBatchResponse(topic string, payload []byte) bool {
+	codec, ok := client.codec.(BatchClientCodec)
+	if !ok {
+		return false
+	}
+
+	responses, ok := codec.SplitClientResponses(payload)
+	if !ok {
+		return false
+	}
+
+	for _, response := range responses {
+		client.handleResponse(topic, response)
+	}
+	return true
+}
+
 func (client *Client) handleResponse(topic string, payload []byte) {
+	if client.handleBatchResponse(topic, payload) {
+		return
+	}
+
 	id, err := client.codec.DecodeIdAndError(payload)
 
 	if id == nil {
@@ -105,9 +335,15 @@ func (client *Client) handleResponse(topic string, payload []byte) {
 		return
 	}
 
+	client.complete(*id, err, payload)
+}
+
+// complete finishes the pending call with the given id, if there is one
+func (client *Client) complete(id uint32, err error, payload []byte) {
+
 	client.mutex.Lock()
-	call := client.pending[*id]
-	delete(client.pending, *id)
+	call := client.pending[id]
+	delete(client.pending, id)
 	client.mutex.Unlock()
 
 	if err != nil {
@@ -115,13 +351,13 @@ func (client *Client) handleResponse(topic string, payload []byte) {
 			call.Error = err
 			call.done()
 		} else {
-			log.Debugf("Ignoring error reply to call %d: %s", *id, err)
+			log.Debugf("Ignoring error reply to call %d: %s", id, err)
 		}
 		return
 	}
 
 	if call == nil {
-		log.Debugf("Ignoring reply to call %d", *id)
+		log.Debugf("Ignoring reply to call %d", id)
 		return
 	}
 
@@ -155,8 +391,31 @@ func (client *Client) Call(topic string, serviceMethod string, args interface{})
 	return client.send(call)
 }
 
-// CallWithTimeout invokes a function synchronously.
+// CallWithTimeout invokes a function synchronously. The server is told when the call will time out,
+// so it can give up too.
 func (client *Client) CallWithTimeout(topic string, serviceMethod string, args interface{}, reply interface{}, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := client.CallContext(ctx, topic, serviceMethod, args, reply)
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("Call to service %s - (method: %s) timed out after %d seconds", topic, serviceMethod, timeout/time.Second)
+	}
+	return err
+}
+
+// CallContext invokes a function synchronously, giving up when the context is done and returning
+// its error. The context's deadline, if it has one, is sent with the call so that the server can
+// give up at the same time. Calls to a service that keeps timing out fail with ErrCircuitOpen without
+// being sent, until it has had time to recover.
+func (client *Client) CallContext(ctx context.Context, topic string, serviceMethod string, args interface{}, reply interface{}) error {
+	return client.CallWithProgress(ctx, topic, serviceMethod, args, reply, nil)
+}
+
+// CallWithProgress invokes a long running function synchronously, as CallContext does. The server is
+// asked to send updates on its progress, which are given to the progress function, in order, before
+// the reply arrives.
+func (client *Client) CallWithProgress(ctx context.Context, topic string, serviceMethod string, args interface{}, reply interface{}, progress func(update []byte)) error {
 	call := &Call{
 		ID:            rand.Uint32(),
 		Topic:         topic,
@@ -164,10 +423,33 @@ func (client *Client) CallWithTimeout(topic string, serviceMethod string, args i
 		Args:          args,
 		Done:          make(chan *Call, 1),
 		Reply:         reply,
+		Progress:      progress,
+	}
+
+	return client.await(ctx, call)
+}
+
+// await sends a call, if the service's circuit breaker allows it, and waits for its reply until the
+// context is done
+func (client *Client) await(ctx context.Context, call *Call) error {
+
+	if deadline, ok := ctx.Deadline(); ok {
+		call.Deadline = deadline
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	breaker := client.breaker(call.Topic)
+	if !breaker.allow() {
+		log.Infof("Not calling %s on %s, it keeps timing out", call.ServiceMethod, call.Topic)
+		return ErrCircuitOpen
 	}
 
 	err := client.send(call)
 	if err != nil {
+		breaker.abandoned()
 		return err
 	}
 	sentTime := simtime.Now()
@@ -177,10 +459,82 @@ func (client *Client) CallWithTimeout(topic string, serviceMethod string, args i
 	select {
 	case <-call.Done:
 		log.Debugf("id:%d - Returned after %s", call.ID, time.Since(sentTime))
+		breaker.done(call.Error)
 		return call.Error
-	case <-time.After(timeout):
+	case <-ctx.Done():
+		client.mutex.Lock()
 		delete(client.pending, call.ID)
-		return fmt.Errorf("id:%d - Call to service %s - (method: %s) timed out after %d seconds", call.ID, topic, serviceMethod, timeout/time.Second)
+		client.mutex.Unlock()
+
+		log.Debugf("id:%d - Call to service %s - (method: %s) gave up: %s", call.ID, call.Topic, call.ServiceMethod, ctx.Err())
+		breaker.done(ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// CallBatch sends several calls to the service on a topic in one message, and waits until all have
+// been answered or the context is done. Only the ServiceMethod, Args and Reply of each call need to
+// be set; the others are filled in. As with CallContext, each call's Reply is filled in, or its Error
+// set. The error returned is the context's, ErrCircuitOpen, or one from sending the batch.
+func (client *Client) CallBatch(ctx context.Context, topic string, calls []*Call) error {
+	codec, ok := client.codec.(BatchClientCodec)
+	if !ok {
+		return fmt.Errorf("Failed to call %s, the rpc codec doesn't support batches", topic)
 	}
 
+	deadline, hasDeadline := ctx.Deadline()
+
+	for _, call := range calls {
+		call.ID = rand.Uint32()
+		call.Topic = topic
+		call.Done = make(chan *Call, 1)
+		if hasDeadline {
+			call.Deadline = deadline
+		}
+		if call.Caller == "" {
+			call.Caller = client.Caller
+		}
+		if err := client.setReplyTo(call); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	payload, err := codec.EncodeClientBatch(calls)
+	if err != nil {
+		return err
+	}
+
+	breaker := client.breaker(topic)
+	if !breaker.allow() {
+		log.Infof("Not calling %s, it keeps timing out", topic)
+		return ErrCircuitOpen
+	}
+
+	if err := client.publish(topic, payload, calls...); err != nil {
+		breaker.abandoned()
+		return err
+	}
+
+	for i, call := range calls {
+		select {
+		case <-call.Done:
+		case <-ctx.Done():
+			client.mutex.Lock()
+			for _, call := range calls[i:] {
+				delete(client.pending, call.ID)
+			}
+			client.mutex.Unlock()
+
+			log.Debugf("Batch call to service %s gave up: %s", topic, ctx.Err())
+			breaker.done(ctx.Err())
+			return ctx.Err()
+		}
+	}
+
+	breaker.succeeded()
+	return nil
 }
@@ -0,0 +1,142 @@
+package rpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nps5696/go-ninja/bus"
+	"github.com/nps5696/go-ninja/rpc"
+	"github.com/nps5696/go-ninja/rpc/json2"
+)
+
+const serviceTopic = "$node/test/service"
+
+// serve connects a memory bus, and registers the methods of a service on serviceTopic with a
+// json2 server
+func serve(t *testing.T, host string, receiver interface{}, methods []string, options rpc.ServiceOptions) (*bus.MemoryBus, *rpc.Server) {
+	b, err := bus.ConnectMemoryBus(host, "server")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	server := rpc.NewServer(b, json2.NewCodec())
+	if _, err := server.RegisterServiceMethods(receiver, serviceTopic, methods, options); err != nil {
+		b.Destroy()
+		t.Fatalf("Failed to register service: %s", err)
+	}
+
+	return b, server
+}
+
+// expectReceived waits for a value from a channel
+func expectReceived(t *testing.T, received chan string, expected string) {
+	select {
+	case got := <-received:
+		if got != expected {
+			t.Errorf("Expected %q, got %q", expected, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for %q", expected)
+	}
+}
+
+type deadlineService struct {
+	called chan string
+}
+
+func (s *deadlineService) Wait(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	s.called <- fmt.Sprintf("deadline %t", ok && time.Until(deadline) < time.Second)
+
+	<-ctx.Done()
+	s.called <- ctx.Err().Error()
+	return ctx.Err()
+}
+
+func (s *deadlineService) Hurry(ctx context.Context) (*string, error) {
+	_, ok := ctx.Deadline()
+	s.called <- fmt.Sprintf("deadline %t", ok)
+
+	reply := "done"
+	return &reply, nil
+}
+
+func TestCallContextDeadline(t *testing.T) {
+	service := &deadlineService{called: make(chan string, 10)}
+	b, _ := serve(t, "TestCallContextDeadline", service, []string{"wait", "hurry"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+
+	// the method is given the caller's deadline, and cancelled when it passes
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	// the server gives up at the same time, so its error may arrive first
+	if err := client.CallContext(ctx, serviceTopic, "wait", nil, nil); err == nil || err.Error() != context.DeadlineExceeded.Error() {
+		t.Errorf("Expected the call to time out, got %v", err)
+	}
+	expectReceived(t, service.called, "deadline true")
+	expectReceived(t, service.called, context.DeadlineExceeded.Error())
+
+	// a call without one has no deadline on the server
+	var reply string
+	if err := client.CallContext(context.Background(), serviceTopic, "hurry", nil, &reply); err != nil || reply != "done" {
+		t.Errorf("Expected reply %q, got %q (error %v)", "done", reply, err)
+	}
+	expectReceived(t, service.called, "deadline false")
+}
+
+func TestCallWithTimeout(t *testing.T) {
+	service := &deadlineService{called: make(chan string, 10)}
+	b, _ := serve(t, "TestCallWithTimeout", service, []string{"wait"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+
+	if err := client.CallWithTimeout(serviceTopic, "wait", nil, nil, time.Millisecond*100); err == nil {
+		t.Errorf("Expected the call to time out")
+	}
+	expectReceived(t, service.called, "deadline true")
+}
+
+func TestDeadlinePassed(t *testing.T) {
+	service := &deadlineService{called: make(chan string, 10)}
+	b, _ := serve(t, "TestDeadlinePassed", service, []string{"hurry"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	replies := make(chan string, 10)
+	b.Subscribe(serviceTopic+"/reply", func(topic string, payload []byte) {
+		replies <- string(payload)
+	})
+
+	// a request the caller has given up on by the time it arrives isn't served
+	deadline := time.Now().Add(-time.Second).UnixNano() / int64(time.Millisecond)
+	b.Publish(serviceTopic, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":"1","method":"hurry","deadline":%d}`, deadline)))
+
+	select {
+	case reply := <-replies:
+		if !json2IsError(reply) {
+			t.Errorf("Expected an error reply, got %s", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the reply")
+	}
+
+	select {
+	case got := <-service.called:
+		t.Errorf("Expected the method not to be called, got %q", got)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+// json2IsError returns true if a json2 response is an error
+func json2IsError(payload string) bool {
+	var response struct {
+		Error *json2.Error `json:"error"`
+	}
+	return json.Unmarshal([]byte(payload), &response) == nil && response.Error != nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2014 Ninja Blocks Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import "sync"
+
+// CodecProvider makes the codecs of an encoding that services may announce they use, such as the one
+// in rpc/cbor. Importing the encoding's package registers it, so that a module only depends on the
+// encodings it imports.
+type CodecProvider struct {
+	// NewCodec returns a codec for a server whose services use the encoding
+	NewCodec func() Codec
+	// NewClientCodec returns a codec for calling services that use the encoding
+	NewClientCodec func() ClientCodec
+	// ReadNotification decodes the params of a notification sent by a service into params
+	ReadNotification func(notification []byte, params interface{}) error
+	// Unmarshal decodes a value in the encoding, e.g. an update on a call's progress, into v
+	Unmarshal func(data []byte, v interface{}) error
+}
+
+var (
+	codecs     = make(map[string]CodecProvider)
+	codecsLock sync.Mutex
+)
+
+// RegisterCodec makes an encoding available by name. It panics if the name is already taken.
+func RegisterCodec(name string, provider CodecProvider) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	if _, ok := codecs[name]; ok {
+		panic("rpc: RegisterCodec called twice for codec " + name)
+	}
+	codecs[name] = provider
+}
+
+// LookupCodec returns the encoding registered with a name, if it has been
+func LookupCodec(name string) (CodecProvider, bool) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	provider, ok := codecs[name]
+	return provider, ok
+}
@@ -0,0 +1,115 @@
+// Copyright 2014 Ninja Blocks Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+
+	"github.com/nps5696/go-ninja/bus"
+)
+
+// ErrBusy is returned to callers when a service already has as many requests waiting as it may
+var ErrBusy = errors.New("Server busy")
+
+// Ordering decides whether a service's requests may be served at the same time
+type Ordering int
+
+const (
+	// InOrder services serve one request at a time, in the order they arrived, as services always
+	// have. Useful for devices that can't cope with overlapping commands. They don't count towards
+	// the server's concurrency, so a slow one only holds up its own requests.
+	InOrder Ordering = iota
+	// Parallel services may serve any number of requests at once, up to the server's concurrency
+	Parallel
+)
+
+// ServiceOptions decide how the requests to a service are scheduled
+type ServiceOptions struct {
+	Ordering Ordering
+	// QueueSize is the number of requests that may wait to be served before more are refused with
+	// ErrBusy. Zero uses rpc.queueSize from the config.
+	QueueSize int
+	// Codec encodes the service's requests, responses and events. Nil uses the server's codec.
+	Codec Codec
+}
+
+// optionsService is implemented by services that choose their own ServiceOptions
+type optionsService interface {
+	GetRPCOptions() ServiceOptions
+}
+
+// request is a request waiting to be served
+type request struct {
+	topic      string
+	payload    []byte
+	properties *bus.Properties
+}
+
+// dispatcher queues the requests to one service, and hands them to the server's workers
+type dispatcher struct {
+	server   *Server
+	ordering Ordering
+	codec    Codec
+	queue    chan *request
+}
+
+func newDispatcher(server *Server, options ServiceOptions) *dispatcher {
+	if options.QueueSize <= 0 {
+		options.QueueSize = server.queueSize
+	}
+	if options.Codec == nil {
+		options.Codec = server.codec
+	}
+
+	d := &dispatcher{
+		server:   server,
+		ordering: options.Ordering,
+		codec:    options.Codec,
+		queue:    make(chan *request, options.QueueSize),
+	}
+	go d.run()
+	return d
+}
+
+// dispatch queues a request, or refuses it if the queue is full
+func (d *dispatcher) dispatch(topic string, payload []byte, properties *bus.Properties) {
+	select {
+	case d.queue <- &request{topic, payload, properties}:
+	default:
+		log.Warningf("Refusing request to %s, %d requests are already waiting", topic, cap(d.queue))
+		d.server.refuseRequest(d.codec, topic, payload, properties, ErrBusy)
+	}
+}
+
+func (d *dispatcher) run() {
+	for req := range d.queue {
+		if d.ordering == InOrder {
+			d.server.serveRequest(d.codec, req.topic, req.payload, req.properties)
+			continue
+		}
+
+		d.server.acquireWorker()
+		go d.serve(req)
+	}
+}
+
+// serve serves a request to a Parallel service, releasing its worker when done
+func (d *dispatcher) serve(req *request) {
+	defer d.server.releaseWorker()
+	d.server.serveRequest(d.codec, req.topic, req.payload, req.properties)
+}
+
+// acquireWorker waits until fewer than the configured number of requests are being served
+func (s *Server) acquireWorker() {
+	if s.workers != nil {
+		s.workers <- struct{}{}
+	}
+}
+
+func (s *Server) releaseWorker() {
+	if s.workers != nil {
+		<-s.workers
+	}
+}
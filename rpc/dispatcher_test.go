@@ -0,0 +1,193 @@
+package rpc_test
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nps5696/go-ninja/config"
+	"github.com/nps5696/go-ninja/rpc"
+	"github.com/nps5696/go-ninja/rpc/json2"
+)
+
+type orderService struct {
+	sync.Mutex
+	served  []int
+	running int
+	most    int
+	done    chan bool
+}
+
+func (s *orderService) Step(n *int) error {
+	s.Lock()
+	s.running++
+	if s.running > s.most {
+		s.most = s.running
+	}
+	s.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	s.Lock()
+	s.running--
+	s.served = append(s.served, *n)
+	if len(s.served) == cap(s.served) {
+		close(s.done)
+	}
+	s.Unlock()
+	return nil
+}
+
+func TestInOrder(t *testing.T) {
+	const calls = 50
+
+	service := &orderService{served: make([]int, 0, calls), done: make(chan bool)}
+
+	// services are served in order unless they ask otherwise
+	b, _ := serve(t, "TestInOrder", service, []string{"step"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+	for i := 0; i < calls; i++ {
+		if err := client.Call(serviceTopic, "step", i); err != nil {
+			t.Fatalf("Failed to call step %d: %s", i, err)
+		}
+	}
+
+	select {
+	case <-service.done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Timed out waiting for the calls to be served")
+	}
+
+	service.Lock()
+	defer service.Unlock()
+
+	if service.most != 1 {
+		t.Errorf("Expected one request to be served at a time, %d were", service.most)
+	}
+	for i, n := range service.served {
+		if n != i {
+			t.Fatalf("Expected the requests to be served in order, got %v", service.served)
+		}
+	}
+}
+
+type barrierService struct {
+	sync.Mutex
+	waiting int
+	all     chan bool
+}
+
+// Meet returns once the given number of requests are being served at once
+func (s *barrierService) Meet(n *int) error {
+	s.Lock()
+	s.waiting++
+	if s.waiting == *n {
+		close(s.all)
+	}
+	s.Unlock()
+
+	select {
+	case <-s.all:
+		return nil
+	case <-time.After(time.Second * 2):
+		return context.DeadlineExceeded
+	}
+}
+
+func TestParallel(t *testing.T) {
+	const calls = 4
+
+	service := &barrierService{all: make(chan bool)}
+	b, _ := serve(t, "TestParallel", service, []string{"meet"}, rpc.ServiceOptions{Ordering: rpc.Parallel})
+	defer b.Destroy()
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+
+	errors := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		go func() {
+			errors <- client.CallWithTimeout(serviceTopic, "meet", calls, nil, time.Second*5)
+		}()
+	}
+
+	for i := 0; i < calls; i++ {
+		if err := <-errors; err != nil {
+			t.Errorf("Expected the requests to be served at once, got %s", err)
+		}
+	}
+}
+
+type slowService struct {
+	started chan bool
+	release chan bool
+}
+
+func (s *slowService) Block() error {
+	s.started <- true
+	<-s.release
+	return nil
+}
+
+func TestInOrderHoldsUpOnlyItself(t *testing.T) {
+	// a server that serves one parallel request at a time
+	os.Setenv("sphere_rpc_concurrency", "1")
+	config.MustRefresh()
+	defer func() {
+		os.Unsetenv("sphere_rpc_concurrency")
+		config.MustRefresh()
+	}()
+
+	slow := &slowService{started: make(chan bool, 10), release: make(chan bool)}
+	b, server := serve(t, "TestInOrderHoldsUpOnlyItself", slow, []string{"block"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+	defer close(slow.release)
+
+	fast := &deadlineService{called: make(chan string, 10)}
+	if _, err := server.RegisterServiceMethods(fast, "$node/test/fast", []string{"hurry"}, rpc.ServiceOptions{Ordering: rpc.Parallel}); err != nil {
+		t.Fatalf("Failed to register service: %s", err)
+	}
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+	client.Call(serviceTopic, "block", nil)
+	<-slow.started
+
+	var reply string
+	if err := client.CallWithTimeout("$node/test/fast", "hurry", nil, &reply, time.Second); err != nil {
+		t.Errorf("Expected a slow in order service not to hold up the others, got %s", err)
+	}
+}
+
+func TestBusy(t *testing.T) {
+	slow := &slowService{started: make(chan bool, 10), release: make(chan bool)}
+	b, _ := serve(t, "TestBusy", slow, []string{"block"}, rpc.ServiceOptions{QueueSize: 1})
+	defer b.Destroy()
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+
+	// the first is served, the second waits, and there's no room for the third
+	errors := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errors <- client.CallWithTimeout(serviceTopic, "block", nil, nil, time.Second*5)
+		}()
+		if i == 0 {
+			<-slow.started
+		}
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	if err := client.CallWithTimeout(serviceTopic, "block", nil, nil, time.Second); err != rpc.ErrBusy {
+		t.Errorf("Expected ErrBusy, got %v", err)
+	}
+
+	close(slow.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errors; err != nil {
+			t.Errorf("Expected the waiting requests to be served, got %s", err)
+		}
+	}
+}
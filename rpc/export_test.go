@@ -0,0 +1,7 @@
+package rpc
+
+// RegisterServiceMethods registers a service as RegisterServiceWithOptions does, exporting the given
+// methods rather than those in its schema
+func (s *Server) RegisterServiceMethods(receiver interface{}, topic string, methods []string, options ServiceOptions) (*ExportedService, error) {
+	return s.registerService(receiver, topic, "", methods, options)
+}
@@ -0,0 +1,109 @@
+// Copyright 2014 Ninja Blocks Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyReader is implemented by CodecRequests that can carry an idempotency key. Every
+// attempt at a call has the same key, so repeated requests can be answered without calling the
+// method again.
+type IdempotencyKeyReader interface {
+	// IdempotencyKey returns the request's key, or "" if it has none
+	IdempotencyKey() string
+}
+
+// cachedReply is the result of a request, kept for repeats of it
+type cachedReply struct {
+	done    chan struct{} // closed once the result is known
+	reply   interface{}
+	err     error
+	expires time.Time
+}
+
+// replyCache remembers the results of recent requests by their idempotency key. It holds at most
+// size of them, or any number if size is zero or less.
+type replyCache struct {
+	sync.Mutex
+	replies map[string]*cachedReply
+	ttl     time.Duration
+	size    int
+}
+
+func newReplyCache(ttl time.Duration, size int) *replyCache {
+	return &replyCache{
+		replies: make(map[string]*cachedReply),
+		ttl:     ttl,
+		size:    size,
+	}
+}
+
+// start returns the result for a key, and true if this is the first request with it. The first
+// request must finish it; the others wait for it to be done. ErrBusy is returned if the cache is
+// full of requests still being served.
+func (c *replyCache) start(key string) (*cachedReply, bool, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+
+	if cached, ok := c.replies[key]; ok && (cached.expires.IsZero() || now.Before(cached.expires)) {
+		return cached, false, nil
+	}
+
+	if c.size > 0 && len(c.replies) >= c.size {
+		c.expire(now)
+		if len(c.replies) >= c.size {
+			return nil, false, ErrBusy
+		}
+	}
+
+	cached := &cachedReply{done: make(chan struct{})}
+	c.replies[key] = cached
+	return cached, true, nil
+}
+
+// finish records the result of the first request with a key
+func (c *replyCache) finish(cached *cachedReply, reply interface{}, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	cached.reply = reply
+	cached.err = err
+	cached.expires = time.Now().Add(c.ttl)
+	close(cached.done)
+}
+
+// expire forgets the results that have expired, then the oldest of the others until there's room
+// for another. Those still being served are kept, so the cache may still be full.
+func (c *replyCache) expire(now time.Time) {
+	for key, cached := range c.replies {
+		if !cached.expires.IsZero() && now.After(cached.expires) {
+			delete(c.replies, key)
+		}
+	}
+
+	for len(c.replies) >= c.size {
+		var oldestKey string
+		var oldest *cachedReply
+
+		for key, cached := range c.replies {
+			if cached.expires.IsZero() {
+				// still being served
+				continue
+			}
+			if oldest == nil || cached.expires.Before(oldest.expires) {
+				oldestKey, oldest = key, cached
+			}
+		}
+
+		if oldest == nil {
+			return
+		}
+		delete(c.replies, oldestKey)
+	}
+}
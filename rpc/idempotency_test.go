@@ -0,0 +1,62 @@
+package rpc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplyCacheSize(t *testing.T) {
+	cache := newReplyCache(time.Minute, 2)
+
+	first, ok, _ := cache.start("first")
+	if !ok {
+		t.Fatalf("Expected the first request with a key to be served")
+	}
+	second, _, _ := cache.start("second")
+
+	// while the cache is full of requests being served, new keys are refused
+	if _, _, err := cache.start("third"); err != ErrBusy {
+		t.Fatalf("Expected ErrBusy, got %v", err)
+	}
+	if _, ok, err := cache.start("first"); ok || err != nil {
+		t.Errorf("Expected a repeated request to wait for the first, got %t (error %v)", ok, err)
+	}
+
+	// finished results make way for new ones, oldest first
+	cache.finish(first, "first", nil)
+	time.Sleep(time.Millisecond)
+	cache.finish(second, "second", nil)
+
+	for i := 0; i < 10; i++ {
+		cached, ok, err := cache.start(fmt.Sprintf("new %d", i))
+		if !ok || err != nil {
+			t.Fatalf("Expected a new request to be served, got %t (error %v)", ok, err)
+		}
+		cache.finish(cached, nil, nil)
+
+		if len(cache.replies) > 2 {
+			t.Fatalf("Expected at most 2 results to be kept, %d are", len(cache.replies))
+		}
+	}
+
+	if _, ok := cache.replies["first"]; ok {
+		t.Errorf("Expected the oldest result to have been forgotten")
+	}
+}
+
+func TestReplyCacheExpires(t *testing.T) {
+	cache := newReplyCache(time.Millisecond*10, 10)
+
+	cached, _, _ := cache.start("key")
+	cache.finish(cached, "reply", nil)
+
+	if again, ok, _ := cache.start("key"); ok || again.reply != "reply" {
+		t.Errorf("Expected the result to be kept")
+	}
+
+	time.Sleep(time.Millisecond * 20)
+	if _, ok, _ := cache.start("key"); !ok {
+		t.Errorf("Expected the result to have expired")
+	}
+}
@@ -0,0 +1,129 @@
+package rpc_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nps5696/go-ninja/bus"
+	"github.com/nps5696/go-ninja/rpc"
+	"github.com/nps5696/go-ninja/rpc/json2"
+)
+
+type echoService struct{}
+
+func (s *echoService) Echo(text *string) (*string, error) {
+	return text, nil
+}
+
+// collect returns a channel receiving the topic of each message published to a topic
+func collect(t *testing.T, b *bus.MemoryBus, topic string) chan string {
+	topics := make(chan string, 10)
+	if _, err := b.Subscribe(topic, func(topic string, payload []byte) {
+		topics <- topic
+	}); err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+	}
+	return topics
+}
+
+// expectNone checks that nothing more is received from a channel
+func expectNone(t *testing.T, received chan string, what string) {
+	select {
+	case got := <-received:
+		t.Errorf("Expected no %s, got %q", what, got)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestReplyInbox(t *testing.T) {
+	b, _ := serve(t, "TestReplyInbox", &echoService{}, []string{"echo"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	shared := collect(t, b, serviceTopic+"/reply")
+	inbox := collect(t, b, "$rpc/tester/reply")
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+	client.ReplyInbox = true
+	client.Inbox = "$rpc/tester/reply"
+
+	// replies to calls and batches go to our own inbox, not the service's shared reply topic
+	var reply string
+	if err := client.CallWithTimeout(serviceTopic, "echo", "one", &reply, time.Second); err != nil || reply != "one" {
+		t.Fatalf("Expected reply %q, got %q (error %v)", "one", reply, err)
+	}
+	expectReceived(t, inbox, "$rpc/tester/reply")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var first, second string
+	calls := []*rpc.Call{
+		{ServiceMethod: "echo", Args: "first", Reply: &first},
+		{ServiceMethod: "echo", Args: "second", Reply: &second},
+	}
+	if err := client.CallBatch(ctx, serviceTopic, calls); err != nil || first != "first" || second != "second" {
+		t.Fatalf("Expected replies to the batch, got %q and %q (error %v)", first, second, err)
+	}
+	expectReceived(t, inbox, "$rpc/tester/reply")
+
+	expectNone(t, shared, "reply on the shared topic")
+}
+
+func TestReplyInboxRandom(t *testing.T) {
+	b, _ := serve(t, "TestReplyInboxRandom", &echoService{}, []string{"echo"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	inboxes := collect(t, b, "$rpc/+/reply")
+
+	// without an inbox of its own, a client makes one up
+	client := rpc.NewClient(b, json2.NewClientCodec())
+	client.ReplyInbox = true
+
+	var reply string
+	if err := client.CallWithTimeout(serviceTopic, "echo", "one", &reply, time.Second); err != nil || reply != "one" {
+		t.Fatalf("Expected reply %q, got %q (error %v)", "one", reply, err)
+	}
+
+	select {
+	case topic := <-inboxes:
+		if !strings.HasPrefix(topic, "$rpc/") || topic == "$rpc/tester/reply" {
+			t.Errorf("Expected a random inbox, got %s", topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the reply")
+	}
+}
+
+func TestReplyToOutsideInbox(t *testing.T) {
+	b, _ := serve(t, "TestReplyToOutsideInbox", &echoService{}, []string{"echo"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	shared := collect(t, b, serviceTopic+"/reply")
+	elsewhere := collect(t, b, "$device/test/channel/reply")
+
+	// a caller can only have replies sent to a topic under $rpc/, anything else is ignored
+	b.Publish(serviceTopic, []byte(`{"jsonrpc":"2.0","id":"1","method":"echo","params":"one","replyTo":"$device/test/channel/reply"}`))
+
+	expectReceived(t, shared, serviceTopic+"/reply")
+	expectNone(t, elsewhere, "reply outside $rpc/")
+}
+
+func TestNoReplyInbox(t *testing.T) {
+	b, _ := serve(t, "TestNoReplyInbox", &echoService{}, []string{"echo"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	shared := collect(t, b, serviceTopic+"/reply")
+	inboxes := collect(t, b, "$rpc/+/reply")
+
+	// by default, replies go to the service's shared reply topic
+	client := rpc.NewClient(b, json2.NewClientCodec())
+	var reply string
+	if err := client.CallWithTimeout(serviceTopic, "echo", "one", &reply, time.Second); err != nil || reply != "one" {
+		t.Fatalf("Expected reply %q, got %q (error %v)", "one", reply, err)
+	}
+
+	expectReceived(t, shared, serviceTopic+"/reply")
+	expectNone(t, inboxes, "reply to an inbox")
+}
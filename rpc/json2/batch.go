@@ -0,0 +1,143 @@
+// Copyright 2014 Ninja Blocks Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/nps5696/go-ninja/bus"
+	"github.com/nps5696/go-ninja/rpc"
+)
+
+// isBatch returns true if the payload is a JSON array, rather than a single request or response
+func isBatch(payload []byte) bool {
+	payload = bytes.TrimLeft(payload, " \t\r\n")
+	return len(payload) > 0 && payload[0] == '['
+}
+
+// newBatchRequest decodes a batch of requests. A request in the batch that can't be decoded is
+// answered with an error, as the others are served. If it has no id, e.g. it isn't an object, the
+// error is sent with a null id.
+func newBatchRequest(topic string, payload []byte) (*BatchRequest, error) {
+
+	batch := &BatchRequest{replier: replier{topic: topic}}
+
+	var requests []json.RawMessage
+	if err := json.Unmarshal(payload, &requests); err != nil {
+		log.Infof("Bad incoming json-rpc batch to %s error:%s json:%s ", topic, err, payload)
+		return batch, &Error{
+			Code:    E_PARSE,
+			Message: err.Error(),
+		}
+	}
+
+	if len(requests) == 0 {
+		return batch, &Error{
+			Code:    E_INVALID_REQ,
+			Message: "rpc: batch must contain at least one request",
+		}
+	}
+
+	for _, raw := range requests {
+		req, err := parseRequest(topic, raw)
+		if err != nil && req.request.ID == nil {
+			// it isn't a request object, so there's no id to answer it with, but it's still answered
+			req.request.ID = &null
+		}
+		if err, ok := err.(*Error); ok && err.Code == E_PARSE {
+			// the batch was valid json, so it's this request that's at fault
+			err.Code = E_INVALID_REQ
+		}
+		req.batch = batch
+		req.payload = raw
+		batch.requests = append(batch.requests, req)
+
+		// the batch's responses go wherever its requests asked
+		if batch.replyTopic == "" {
+			batch.replyTopic = req.replyTopic
+		}
+	}
+
+	return batch, nil
+}
+
+// BatchRequest holds the requests in a JSON-RPC batch. Their responses are collected, and sent in one
+// array once all have been served.
+type BatchRequest struct {
+	replier
+	requests []*CodecRequest
+
+	sync.Mutex
+	responses []*serverResponse
+}
+
+// Requests returns the requests in the batch
+func (b *BatchRequest) Requests() []rpc.CodecRequest {
+	requests := make([]rpc.CodecRequest, len(b.requests))
+	for i, req := range b.requests {
+		requests[i] = req
+	}
+	return requests
+}
+
+// Flush sends the responses written to the requests in the batch. Nothing is sent if they were all
+// notifications.
+func (b *BatchRequest) Flush(client bus.Bus) {
+	b.Lock()
+	responses := b.responses
+	b.responses = nil
+	b.Unlock()
+
+	if len(responses) > 0 {
+		b.publish(client, responses)
+	}
+}
+
+func (b *BatchRequest) add(res *serverResponse) {
+	b.Lock()
+	defer b.Unlock()
+	b.responses = append(b.responses, res)
+}
+
+// Method returns an error, a batch holds the methods of several requests
+func (b *BatchRequest) Method() (string, error) {
+	return "", fmt.Errorf("rpc: a batch has no single method")
+}
+
+// ReadRequest returns an error, a batch holds the params of several requests
+func (b *BatchRequest) ReadRequest(args interface{}) error {
+	return fmt.Errorf("rpc: a batch has no single request")
+}
+
+// WriteResponse answers every request in the batch with the same reply
+func (b *BatchRequest) WriteResponse(client bus.Bus, reply interface{}) {
+	for _, req := range b.requests {
+		req.WriteResponse(client, reply)
+	}
+	b.Flush(client)
+}
+
+// WriteError answers every request in the batch with the same error, e.g. when it can't be served.
+// If the batch couldn't be decoded or was empty, there's no request to answer, so a single response
+// with a null id is sent, as the spec asks.
+func (b *BatchRequest) WriteError(client bus.Bus, err error) {
+	if len(b.requests) == 0 {
+		b.publish(client, &serverResponse{
+			Version: Version,
+			Error:   toError(err),
+			ID:      &null,
+			Time:    makeTimestamp(),
+		})
+		return
+	}
+
+	for _, req := range b.requests {
+		req.WriteError(client, err)
+	}
+	b.Flush(client)
+}
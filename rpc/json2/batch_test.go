@@ -0,0 +1,150 @@
+package json2
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nps5696/go-ninja/bus"
+)
+
+const batchTopic = "$node/test/batch"
+
+// serveBatch decodes a payload as the server does, answering each request to "echo" with its params,
+// and every other with an error. It returns the reply that is sent, if any.
+func serveBatch(t *testing.T, host string, payload string) []byte {
+	b, err := bus.ConnectMemoryBus(host, "server")
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer b.Destroy()
+
+	replies := make(chan []byte, 10)
+	b.Subscribe(batchTopic+"/reply", func(topic string, payload []byte) {
+		replies <- payload
+	})
+
+	codecReq, err := NewCodec().NewRequest(batchTopic, []byte(payload))
+	if err != nil {
+		codecReq.WriteError(b, err)
+	} else {
+		batch := codecReq.(*BatchRequest)
+		for _, req := range batch.Requests() {
+			var params string
+			if method, err := req.Method(); err != nil {
+				req.WriteError(b, err)
+			} else if method == "Echo" && req.ReadRequest(&params) == nil {
+				req.WriteResponse(b, &params)
+			} else {
+				req.WriteError(b, errors.New("Failed"))
+			}
+		}
+		batch.Flush(b)
+	}
+
+	select {
+	case reply := <-replies:
+		return reply
+	case <-time.After(time.Millisecond * 200):
+		return nil
+	}
+}
+
+func TestBatchNotifications(t *testing.T) {
+	reply := serveBatch(t, "TestBatchNotifications", `[
+		{"jsonrpc":"2.0","method":"echo","params":"a"},
+		{"jsonrpc":"2.0","id":"1","method":"echo","params":"b"},
+		{"jsonrpc":"2.0","id":"2","method":"fail"},
+		{"jsonrpc":"2.0","method":"fail"}
+	]`)
+
+	// only the requests with an id are answered, in one array
+	var responses []struct {
+		ID     string          `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  *Error          `json:"error"`
+	}
+	if err := json.Unmarshal(reply, &responses); err != nil {
+		t.Fatalf("Expected an array of responses, got %s", reply)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("Expected 2 responses, got %s", reply)
+	}
+
+	for _, res := range responses {
+		switch res.ID {
+		case "1":
+			if string(res.Result) != `"b"` || res.Error != nil {
+				t.Errorf("Expected result %q, got %s", "b", reply)
+			}
+		case "2":
+			if res.Error == nil || res.Error.Code != E_SERVER {
+				t.Errorf("Expected an error, got %s", reply)
+			}
+		default:
+			t.Errorf("Expected no response to a notification, got %s", reply)
+		}
+	}
+}
+
+func TestBatchAllNotifications(t *testing.T) {
+	reply := serveBatch(t, "TestBatchAllNotifications", `[{"jsonrpc":"2.0","method":"echo","params":"a"},{"jsonrpc":"2.0","method":"fail"}]`)
+	if reply != nil {
+		t.Errorf("Expected nothing to be sent, got %s", reply)
+	}
+}
+
+func TestBatchInvalid(t *testing.T) {
+	for payload, code := range map[string]ErrorCode{
+		`[]`:         E_INVALID_REQ,
+		` [ `:        E_PARSE,
+		`[{"id":1},`: E_PARSE,
+	} {
+		reply := serveBatch(t, "TestBatchInvalid", payload)
+
+		// there's no request to answer, so a single response with a null id is sent
+		var res struct {
+			ID    json.RawMessage `json:"id"`
+			Error *Error          `json:"error"`
+		}
+		if err := json.Unmarshal(reply, &res); err != nil {
+			t.Errorf("Expected a single response to %q, got %s", payload, reply)
+			continue
+		}
+		if string(res.ID) != "null" {
+			t.Errorf("Expected a null id in the response to %q, got %s", payload, reply)
+		}
+		if res.Error == nil || res.Error.Code != code {
+			t.Errorf("Expected error %d in the response to %q, got %s", code, payload, reply)
+		}
+	}
+
+	// each element that isn't a request is answered with its own error, with a null id
+	for payload, invalid := range map[string]int{
+		`[1]`:   1,
+		`[1,2]`: 2,
+		`[1,{"jsonrpc":"2.0","id":"1","method":"echo","params":"a"}]`: 1,
+	} {
+		reply := serveBatch(t, "TestBatchInvalid", payload)
+
+		var responses []struct {
+			ID    json.RawMessage `json:"id"`
+			Error *Error          `json:"error"`
+		}
+		if err := json.Unmarshal(reply, &responses); err != nil {
+			t.Errorf("Expected an array of responses to %q, got %s", payload, reply)
+			continue
+		}
+
+		nulls := 0
+		for _, res := range responses {
+			if string(res.ID) == "null" && res.Error != nil && res.Error.Code == E_INVALID_REQ {
+				nulls++
+			}
+		}
+		if nulls != invalid {
+			t.Errorf("Expected %d errors with a null id in the response to %q, got %s", invalid, payload, reply)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/nps5696/go-ninja/rpc"
 )
@@ -33,6 +34,24 @@ type clientRequest struct {
 
 	// JSON-RPC protocol.
 	Version string `json:"jsonrpc"`
+
+	// When the request was sent, in milliseconds since the epoch
+	Time int64 `json:"time,omitempty"`
+
+	// When the caller will give up waiting for the response, in milliseconds since the epoch
+	Deadline int64 `json:"deadline,omitempty"`
+
+	// Who is making the call
+	Caller string `json:"caller,omitempty"`
+
+	// Whether the caller wants updates on the call's progress
+	Progress bool `json:"progress,omitempty"`
+
+	// The same for every attempt at the call, so that the server only acts on it once
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// Where the caller wants the response sent, if not "<topic>/reply"
+	ReplyTo string `json:"replyTo,omitempty"`
 }
 
 // clientResponse represents a JSON-RPC response returned to a client.
@@ -43,6 +62,12 @@ type clientResponse struct {
 	Version string           `json:"jsonrpc"`
 }
 
+// clientProgress represents an update on the progress of a call, sent before its response
+type clientProgress struct {
+	Progress *json.RawMessage `json:"progress"`
+	ID       *json.RawMessage `json:"id"`
+}
+
 func NewClientCodec() *ClientCodec {
 	return &ClientCodec{}
 }
@@ -53,42 +78,69 @@ type ClientCodec struct {
 // EncodeClientRequest encodes parameters for a JSON-RPC client request.
 func (c *ClientCodec) EncodeClientRequest(call *rpc.Call) ([]byte, error) {
 	req := &clientRequest{
-		Version: "2.0",
-		Method:  call.ServiceMethod,
-		Params:  []interface{}{},
-		ID:      fmt.Sprintf("%d", call.ID),
+		Version:        "2.0",
+		Method:         call.ServiceMethod,
+		Params:         []interface{}{},
+		ID:             fmt.Sprintf("%d", call.ID),
+		Time:           makeTimestamp(),
+		Caller:         call.Caller,
+		Progress:       call.Progress != nil,
+		IdempotencyKey: call.IdempotencyKey,
+		ReplyTo:        call.ReplyTo,
 	}
 
 	if call.Args != nil {
 		req.Params = call.Args
 	}
 
+	if !call.Deadline.IsZero() {
+		req.Deadline = call.Deadline.UnixNano() / int64(time.Millisecond)
+	}
+
 	return json.Marshal(req)
 }
 
-func (c *ClientCodec) DecodeIdAndError(msg []byte) (*uint32, error) {
-	res := &clientResponse{}
+// EncodeClientBatch encodes several calls as one JSON-RPC batch
+func (c *ClientCodec) EncodeClientBatch(calls []*rpc.Call) ([]byte, error) {
+	batch := make([]json.RawMessage, len(calls))
+	for i, call := range calls {
+		req, err := c.EncodeClientRequest(call)
+		if err != nil {
+			return nil, err
+		}
+		batch[i] = req
+	}
+	return json.Marshal(batch)
+}
 
-	if err := json.Unmarshal(msg, res); err != nil {
-		return nil, err
+// SplitClientResponses splits the response to a batch into the responses to each call in it
+func (c *ClientCodec) SplitClientResponses(msg []byte) ([][]byte, bool) {
+	if !isBatch(msg) {
+		return nil, false
 	}
 
-	var id uint32
-	err := json.Unmarshal(*res.ID, &id)
-	if err != nil {
+	var batch []json.RawMessage
+	if err := json.Unmarshal(msg, &batch); err != nil {
+		return nil, false
+	}
 
-		var sID string
-		err = json.Unmarshal(*res.ID, &sID)
+	responses := make([][]byte, len(batch))
+	for i, res := range batch {
+		responses[i] = res
+	}
+	return responses, true
+}
 
-		if err == nil {
-			var bigID uint64
-			bigID, err = strconv.ParseUint(sID, 10, 32)
-			id = uint32(bigID)
-		}
+func (c *ClientCodec) DecodeIdAndError(msg []byte) (*uint32, error) {
+	res := &clientResponse{}
+
+	if err := json.Unmarshal(msg, res); err != nil {
+		return nil, err
 	}
 
+	id, err := decodeID(res.ID)
 	if err != nil {
-		return nil, fmt.Errorf("Reply id isn't a uint32 or string uint32. Probably not for us '%s'", *res.ID)
+		return nil, err
 	}
 
 	if res.Error != nil {
@@ -99,6 +151,10 @@ func (c *ClientCodec) DecodeIdAndError(msg []byte) (*uint32, error) {
 				Message: string(*res.Error),
 			}
 		}
+		if jsonErr.Code == E_BUSY {
+			// so callers can tell they may try again
+			return &id, rpc.ErrBusy
+		}
 		return &id, jsonErr
 	}
 
@@ -106,6 +162,50 @@ func (c *ClientCodec) DecodeIdAndError(msg []byte) (*uint32, error) {
 
 }
 
+// DecodeProgress decodes an update on the progress of a call
+func (c *ClientCodec) DecodeProgress(msg []byte) (uint32, []byte, bool) {
+	res := &clientProgress{}
+
+	if err := json.Unmarshal(msg, res); err != nil || res.Progress == nil {
+		return 0, nil, false
+	}
+
+	id, err := decodeID(res.ID)
+	if err != nil {
+		log.Debugf("Ignoring progress update: %s", err)
+		return 0, nil, false
+	}
+
+	return id, *res.Progress, true
+}
+
+// decodeID reads the id of one of our calls from a response
+func decodeID(raw *json.RawMessage) (uint32, error) {
+	if raw == nil {
+		return 0, fmt.Errorf("Reply has no id. Probably not for us")
+	}
+
+	var id uint32
+	err := json.Unmarshal(*raw, &id)
+	if err != nil {
+
+		var sID string
+		err = json.Unmarshal(*raw, &sID)
+
+		if err == nil {
+			var bigID uint64
+			bigID, err = strconv.ParseUint(sID, 10, 32)
+			id = uint32(bigID)
+		}
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("Reply id isn't a uint32 or string uint32. Probably not for us '%s'", *raw)
+	}
+
+	return id, nil
+}
+
 // DecodeClientResponse decodes the response body of a client request into
 // the interface reply.
 func (c *ClientCodec) DecodeClientResponse(msg []byte, reply interface{}) error {
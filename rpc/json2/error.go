@@ -5,29 +5,19 @@
 
 package json2
 
-type ErrorCode int
+import "github.com/nps5696/go-ninja/rpc"
 
-const (
-	E_PARSE       ErrorCode = -32700
-	E_INVALID_REQ ErrorCode = -32600
-	E_NO_METHOD   ErrorCode = -32601
-	E_BAD_PARAMS  ErrorCode = -32602
-	E_INTERNAL    ErrorCode = -32603
-	E_SERVER      ErrorCode = -32000
-)
-
-type Error struct {
-	// A Number that indicates the error type that occurred.
-	Code ErrorCode `json:"code"` /* required */
+// ErrorCode and Error are rpc's, which every codec shares
+type ErrorCode = rpc.ErrorCode
 
-	// A String providing a short description of the error.
-	// The message SHOULD be limited to a concise single sentence.
-	Message string `json:"message"` /* required */
+type Error = rpc.Error
 
-	// A Primitive or Structured value that contains additional information about the error.
-	Data interface{} `json:"data"` /* optional */
-}
-
-func (e *Error) Error() string {
-	return e.Message
-}
+const (
+	E_PARSE       = rpc.E_PARSE
+	E_INVALID_REQ = rpc.E_INVALID_REQ
+	E_NO_METHOD   = rpc.E_NO_METHOD
+	E_BAD_PARAMS  = rpc.E_BAD_PARAMS
+	E_INTERNAL    = rpc.E_INTERNAL
+	E_SERVER      = rpc.E_SERVER
+	E_BUSY        = rpc.E_BUSY
+)
@@ -21,6 +21,10 @@ import (
 var null = json.RawMessage([]byte("null"))
 var Version = "2.0"
 
+// Name is the name services using this codec may announce (see model.ServiceAnnouncement). It's the
+// default, so most don't.
+const Name = "json2"
+
 var log = logger.GetLogger("mqtt-jsonrpc2")
 
 // ----------------------------------------------------------------------------
@@ -45,6 +49,21 @@ type serverRequest struct {
 	Version string `json:"jsonrpc"`
 
 	Time int64 `json:"time"`
+
+	// When the caller will give up waiting for the response, in milliseconds since the epoch
+	Deadline int64 `json:"deadline,omitempty"`
+
+	// Who made the request, if they said
+	Caller string `json:"caller,omitempty"`
+
+	// Whether the caller wants updates on the request's progress
+	Progress bool `json:"progress,omitempty"`
+
+	// The same for every attempt at a call, so that we only act on it once
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// Where the caller wants the response sent, if not "<topic>/reply"
+	ReplyTo string `json:"replyTo,omitempty"`
 }
 
 // serverResponse represents a JSON-RPC response returned by the server.
@@ -69,6 +88,14 @@ type serverResponse struct {
 	Time int64 `json:"time"`
 }
 
+// serverProgress represents an update on the progress of a request, sent before its response
+type serverProgress struct {
+	Progress interface{}      `json:"progress"`
+	ID       *json.RawMessage `json:"id"`
+	Version  string           `json:"jsonrpc"`
+	Time     int64            `json:"time"`
+}
+
 // ----------------------------------------------------------------------------
 // Codec
 // ----------------------------------------------------------------------------
@@ -118,11 +145,21 @@ func (c *Codec) SendNotification(client bus.Bus, topic string, payload ...interf
 // CodecRequest
 // ----------------------------------------------------------------------------
 
-// newCodecRequest returns a new CodecRequest.
+// newCodecRequest returns a new CodecRequest, or a batch of them if the payload is an array.
 func newCodecRequest(topic string, payload []byte) (rpc.CodecRequest, error) {
 
 	log.Debugf("> Incoming to %s : %s", topic, payload)
 
+	if isBatch(payload) {
+		return newBatchRequest(topic, payload)
+	}
+
+	return parseRequest(topic, payload)
+}
+
+// parseRequest decodes a single request
+func parseRequest(topic string, payload []byte) (*CodecRequest, error) {
+
 	// Decode the request body and check if RPC method is valid.
 	req := new(serverRequest)
 	err := json.Unmarshal(payload, req)
@@ -133,6 +170,12 @@ func newCodecRequest(topic string, payload []byte) (rpc.CodecRequest, error) {
 			Data:    req,
 		}
 		log.Infof("Bad incoming json-rpc request to %s error:%s json:%s ", topic, err, payload)
+	} else if req.Method == nil {
+		err = &Error{
+			Code:    E_INVALID_REQ,
+			Message: "rpc: method request ill-formed: missing method field",
+			Data:    req,
+		}
 	} else {
 		method := upperFirst(*req.Method)
 
@@ -146,14 +189,97 @@ func newCodecRequest(topic string, payload []byte) (rpc.CodecRequest, error) {
 			}
 		}
 	}
-	return &CodecRequest{request: req, err: err, topic: topic}, err
+	return &CodecRequest{request: req, err: err, replier: replier{topic: topic, replyTopic: inbox(req)}}, err
+}
+
+// inbox returns the caller's own reply topic, if it named one. Only topics under $rpc/ are used, so a
+// request can't have its response published over some other topic.
+func inbox(req *serverRequest) string {
+	if !strings.HasPrefix(req.ReplyTo, "$rpc/") || strings.ContainsAny(req.ReplyTo, "+#") {
+		if req.ReplyTo != "" {
+			log.Infof("Ignoring request to reply to %s", req.ReplyTo)
+		}
+		return ""
+	}
+	return req.ReplyTo
 }
 
-// CodecRequest decodes and encodes a single request.
+// CodecRequest decodes and encodes a single request. Its response is sent to "<topic>/reply", the
+// caller's own reply topic if the request named one, or the MQTT 5 response topic it came with.
 type CodecRequest struct {
+	replier
 	request *serverRequest
 	err     error
-	topic   string
+	batch   *BatchRequest // the batch the request came in, if it did
+	payload []byte        // the request's part of the batch
+}
+
+// replier sends the responses to a request
+type replier struct {
+	topic           string
+	replyTopic      string
+	replyProperties *bus.Properties
+}
+
+// SetReply sends the response to the given topic, with the given properties, instead of to
+// "<topic>/reply"
+func (r *replier) SetReply(topic string, properties *bus.Properties) {
+	r.replyTopic = topic
+	r.replyProperties = properties
+}
+
+func (r *replier) publish(client bus.Bus, response interface{}) {
+
+	replyTopic := r.topic + "/reply"
+	if r.replyTopic != "" {
+		replyTopic = r.replyTopic
+	}
+
+	payload, err := json.Marshal(response)
+
+	log.Debugf("< Outgoing to %s : %s", replyTopic, payload)
+
+	if err != nil {
+		log.Errorf("Failed to marshall rpc response: %s", err)
+		return
+	}
+
+	err = client.PublishWithOptions(replyTopic, payload, bus.PublishOptions{QoS: bus.AtLeastOnce, Properties: r.replyProperties})
+
+	if err != nil {
+		log.Errorf("Failed to write rpc response to MQTT: %s", err)
+	}
+}
+
+// Deadline returns when the caller will give up waiting for the response, if it said
+func (c *CodecRequest) Deadline() (time.Time, bool) {
+	if c.request.Deadline == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, c.request.Deadline*int64(time.Millisecond)), true
+}
+
+// IdempotencyKey returns the key that every attempt at the call carries, if the caller gave one
+func (c *CodecRequest) IdempotencyKey() string {
+	return c.request.IdempotencyKey
+}
+
+// ReadMessage fills in the request's id, the time it was sent and its caller. A request that came in a
+// batch is given its own part of the payload.
+func (c *CodecRequest) ReadMessage(message *rpc.Message) {
+	if c.request.ID != nil {
+		// ids are usually strings, but may be any json value
+		if err := json.Unmarshal(*c.request.ID, &message.ID); err != nil {
+			message.ID = string(*c.request.ID)
+		}
+	}
+	if c.request.Time != 0 {
+		message.Time = time.Unix(0, c.request.Time*int64(time.Millisecond))
+	}
+	message.Caller = c.request.Caller
+	if c.payload != nil {
+		message.Payload = c.payload
+	}
 }
 
 // Method returns the RPC method for the current request.
@@ -241,41 +367,59 @@ func (c *CodecRequest) WriteResponse(client bus.Bus, reply interface{}) {
 }
 
 func (c *CodecRequest) WriteError(client bus.Bus, err error) {
-	jsonErr, ok := err.(*Error)
-	if !ok {
-		jsonErr = &Error{
-			Code:    E_SERVER,
-			Message: err.Error(),
-		}
-	}
 	res := &serverResponse{
 		Version: Version,
-		Error:   jsonErr,
+		Error:   toError(err),
 		ID:      c.request.ID,
 		Time:    makeTimestamp(),
 	}
 	c.writeServerResponse(client, res)
 }
 
-func (c *CodecRequest) writeServerResponse(client bus.Bus, res *serverResponse) {
-	// Id is null for notifications and they don't have a response.
-
-	if c.request.ID != nil {
+// toError returns the json-rpc error to send for an error returned while serving a request
+func toError(err error) *Error {
+	if jsonErr, ok := err.(*Error); ok {
+		return jsonErr
+	}
+	code := E_SERVER
+	if err == rpc.ErrBusy {
+		code = E_BUSY
+	}
+	return &Error{
+		Code:    code,
+		Message: err.Error(),
+	}
+}
 
-		payload, err := json.Marshal(res)
+// WriteProgress sends an update on the request's progress to the reply topic, if the caller asked for
+// them. Those on requests in a batch are sent straight away, not with the responses.
+func (c *CodecRequest) WriteProgress(client bus.Bus, update interface{}) {
+	if !c.request.Progress || c.request.ID == nil {
+		return
+	}
 
-		log.Debugf("< Outgoing to %s : %s", c.topic+"/reply", payload)
+	res := &serverProgress{
+		Version:  Version,
+		Progress: update,
+		ID:       c.request.ID,
+		Time:     makeTimestamp(),
+	}
 
-		if err != nil {
-			log.Errorf("Failed to marshall rpc response: %s", err)
-			return
-		}
+	if c.batch != nil {
+		c.batch.publish(client, res)
+	} else {
+		c.publish(client, res)
+	}
+}
 
-		client.Publish(c.topic+"/reply", payload)
+func (c *CodecRequest) writeServerResponse(client bus.Bus, res *serverResponse) {
+	// Id is null for notifications and they don't have a response.
 
-		if err != nil {
-			log.Errorf("Failed to write rpc response to MQTT: %s", err)
-			return
+	if c.request.ID != nil {
+		if c.batch != nil {
+			c.batch.add(res)
+		} else {
+			c.publish(client, res)
 		}
 	}
 }
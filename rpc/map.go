@@ -7,6 +7,7 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
 	log2 "log"
 	"reflect"
@@ -21,6 +22,7 @@ var (
 	// Precompute the reflect.Type of error and *rpc.Message
 	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
 	typeOfRequest = reflect.TypeOf((*Message)(nil))
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 )
 
 // ----------------------------------------------------------------------------
@@ -39,6 +41,8 @@ type serviceMethod struct {
 	argsType     reflect.Type   // type of the request argument
 	replyType    reflect.Type   // type of the response argument
 	hasRedisConn bool
+	hasContext   bool // whether the first argument is a context.Context
+	hasRequest   bool // whether there is a *rpc.Message argument, after the context if there is one
 }
 
 // ----------------------------------------------------------------------------
@@ -99,15 +103,28 @@ func (m *serviceMap) register(rcvr interface{}, name string, exportableMethods [
 			continue
 		}
 
+		// The first argument may be a context
+		var hasContext = mtype.NumIn() > 1 && mtype.In(1) == typeOfContext
+		first := 1
+		if hasContext {
+			first++
+		}
+
+		// Then it may ask for the request itself
+		var hasRequest = mtype.NumIn() > first && mtype.In(first) == typeOfRequest
+		if hasRequest {
+			first++
+		}
+
 		var hasRedisConn = false
 		nonRedisConn := mtype.NumIn()
-		if (mtype.NumIn() == 2 || mtype.NumIn() == 3) && mtype.In(mtype.NumIn()-1).Implements(reflect.TypeOf((*redis.Conn)(nil)).Elem()) {
+		if (nonRedisConn == first+1 || nonRedisConn == first+2) && mtype.In(mtype.NumIn()-1).Implements(reflect.TypeOf((*redis.Conn)(nil)).Elem()) {
 			hasRedisConn = true
 			nonRedisConn--
 		}
 
-		// Method must have no or one arguments (plus optional redis connection)
-		if nonRedisConn > 2 {
+		// Method must have no or one arguments (plus optional context, request and redis connection)
+		if nonRedisConn > first+1 {
 			//log.Infof("Wrong number: %s", method.Name)
 			continue
 		}
@@ -120,8 +137,8 @@ func (m *serviceMap) register(rcvr interface{}, name string, exportableMethods [
 
 		// The one argument (args) must be a pointer and must be exported, if its there
 		var args reflect.Type
-		if nonRedisConn > 1 {
-			args = mtype.In(1)
+		if nonRedisConn > first {
+			args = mtype.In(first)
 			if !isExportedOrBuiltin(args) {
 				log2.Fatalf("RPC Method %s.%s arguments must be exported", name, method.Name)
 				continue
@@ -154,6 +171,8 @@ func (m *serviceMap) register(rcvr interface{}, name string, exportableMethods [
 		s.methods[method.Name] = &serviceMethod{
 			method:       method,
 			hasRedisConn: hasRedisConn,
+			hasContext:   hasContext,
+			hasRequest:   hasRequest,
 		}
 		if reply != nil {
 			s.methods[method.Name].replyType = reply.Elem()
@@ -0,0 +1,107 @@
+package rpc_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nps5696/go-ninja/rpc"
+	"github.com/nps5696/go-ninja/rpc/json2"
+)
+
+type progressService struct{}
+
+// Count sends each number up to n as an update on its progress, then replies with n
+func (s *progressService) Count(m *rpc.Message, n *int) (*int, error) {
+	for i := 1; i <= *n; i++ {
+		m.Progress(i)
+	}
+	return n, nil
+}
+
+func TestCallWithProgress(t *testing.T) {
+	b, _ := serve(t, "TestCallWithProgress", &progressService{}, []string{"count"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// the updates all arrive, in order, before the reply
+	var updates []string
+	var reply int
+	err := client.CallWithProgress(ctx, serviceTopic, "count", 3, &reply, func(update []byte) {
+		updates = append(updates, string(update))
+	})
+	if err != nil || reply != 3 {
+		t.Fatalf("Expected reply 3, got %d (error %v)", reply, err)
+	}
+	if got := strings.Join(updates, ","); got != "1,2,3" {
+		t.Errorf("Expected updates 1,2,3, got %s", got)
+	}
+}
+
+func TestProgressNotAsked(t *testing.T) {
+	b, _ := serve(t, "TestProgressNotAsked", &progressService{}, []string{"count"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	replies := make(chan string, 10)
+	b.Subscribe(serviceTopic+"/reply", func(topic string, payload []byte) {
+		replies <- string(payload)
+	})
+
+	// a caller that doesn't ask for updates only gets the reply
+	client := rpc.NewClient(b, json2.NewClientCodec())
+	var reply int
+	if err := client.CallWithTimeout(serviceTopic, "count", 3, &reply, time.Second); err != nil || reply != 3 {
+		t.Fatalf("Expected reply 3, got %d (error %v)", reply, err)
+	}
+
+	select {
+	case got := <-replies:
+		if strings.Contains(got, `"progress"`) {
+			t.Errorf("Expected no progress updates, got %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the reply")
+	}
+
+	select {
+	case got := <-replies:
+		t.Errorf("Expected only the reply, also got %s", got)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestProgressInBatch(t *testing.T) {
+	b, _ := serve(t, "TestProgressInBatch", &progressService{}, []string{"count"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+
+	// updates on a request in a batch are sent as they happen, not held back with the responses
+	updates := make(chan string, 10)
+	var first, second int
+	calls := []*rpc.Call{
+		{ServiceMethod: "count", Args: 2, Reply: &first, Progress: func(update []byte) {
+			updates <- fmt.Sprintf("first %s", update)
+		}},
+		{ServiceMethod: "count", Args: 1, Reply: &second},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := client.CallBatch(ctx, serviceTopic, calls); err != nil {
+		t.Fatalf("Failed to call batch: %s", err)
+	}
+	if first != 2 || second != 1 {
+		t.Errorf("Expected replies 2 and 1, got %d and %d", first, second)
+	}
+
+	expectReceived(t, updates, "first 1")
+	expectReceived(t, updates, "first 2")
+}
@@ -0,0 +1,202 @@
+// Copyright 2014 Ninja Blocks Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nps5696/go-ninja/config"
+)
+
+// ErrCircuitOpen is returned, without calling the service, while a service that keeps timing out is
+// given time to recover
+var ErrCircuitOpen = errors.New("Circuit open, the service keeps timing out")
+
+// RetryPolicy decides how calls that time out, or find the server busy, are tried again
+type RetryPolicy struct {
+	// Attempts is the most times a call is tried, including the first
+	Attempts int
+	// Backoff is the wait before the first retry. It doubles before each one after, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// CallWithRetry invokes a function synchronously, as CallWithTimeout does, trying again if it times out
+// or the server is busy. Every attempt carries the same idempotency key, so a server that did receive
+// an earlier attempt replies with its result instead of calling the method again. It gives up with
+// ErrCircuitOpen if the service's circuit breaker opens.
+func (client *Client) CallWithRetry(topic string, serviceMethod string, args interface{}, reply interface{}, timeout time.Duration, policy RetryPolicy) error {
+
+	key := newIdempotencyKey()
+	backoff := policy.Backoff
+
+	for attempt := 1; ; attempt++ {
+
+		// each attempt is a call of its own, so a late reply to an earlier one can't touch it
+		call := &Call{
+			ID:             mathrand.Uint32(),
+			Topic:          topic,
+			ServiceMethod:  serviceMethod,
+			Args:           args,
+			Done:           make(chan *Call, 1),
+			Reply:          newReply(reply),
+			IdempotencyKey: key,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := client.await(ctx, call)
+		cancel()
+
+		if err == nil {
+			setReply(reply, call.Reply)
+		}
+
+		if err != context.DeadlineExceeded && err != ErrBusy {
+			// Either we have a reply, or it couldn't be sent, or the circuit is open. None is worth
+			// trying again.
+			return err
+		}
+
+		if attempt >= policy.Attempts {
+			if err == ErrBusy {
+				return err
+			}
+			return fmt.Errorf("Call to service %s - (method: %s) timed out after %d attempts", topic, serviceMethod, attempt)
+		}
+
+		log.Debugf("id:%d - Call to service %s - (method: %s) failed: %s. Trying again in %s", call.ID, topic, serviceMethod, err, backoff)
+
+		// a little jitter, so that callers who failed together don't all try again together
+		if backoff > 0 {
+			time.Sleep(backoff + time.Duration(mathrand.Int63n(int64(backoff)/2+1)))
+		}
+
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// newReply returns a new value for an attempt's reply to be decoded into, of the type reply points to
+func newReply(reply interface{}) interface{} {
+	value := reflect.ValueOf(reply)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return reply
+	}
+	return reflect.New(value.Elem().Type()).Interface()
+}
+
+// setReply copies the reply of the attempt that succeeded to the caller's
+func setReply(reply, attempt interface{}) {
+	value := reflect.ValueOf(reply)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return
+	}
+	value.Elem().Set(reflect.ValueOf(attempt).Elem())
+}
+
+func newIdempotencyKey() string {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		// still unique enough to tell one call from another
+		return fmt.Sprintf("%x%x", time.Now().UnixNano(), mathrand.Int63())
+	}
+	return hex.EncodeToString(key)
+}
+
+// breaker returns the circuit breaker for the service on a topic. Once a service has timed out
+// rpc.breaker.failures times in a row (5 by default), calls to it fail with ErrCircuitOpen for
+// rpc.breaker.cooldown (30s), after which a single call is let through to see if it has recovered.
+func (client *Client) breaker(topic string) *breaker {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	b, ok := client.breakers[topic]
+	if !ok {
+		b = &breaker{
+			threshold: config.Int(5, "rpc", "breaker", "failures"),
+			cooldown:  config.Duration(time.Second*30, "rpc", "breaker", "cooldown"),
+		}
+		client.breakers[topic] = b
+	}
+	return b
+}
+
+// breaker stops calls to a service that keeps timing out, until it has had time to recover
+type breaker struct {
+	sync.Mutex
+	threshold int // timeouts in a row before the breaker opens, or zero if it never does
+	cooldown  time.Duration
+
+	failures  int
+	openUntil time.Time
+	trial     bool // whether a call is testing if the service has recovered
+}
+
+// allow returns true if a call may be made
+func (b *breaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+
+	b.trial = true
+	return true
+}
+
+// done records how a call the breaker allowed went. Only a timeout counts against the service; a
+// call the caller cancelled says nothing about it either way.
+func (b *breaker) done(err error) {
+	switch err {
+	case context.DeadlineExceeded:
+		b.failed()
+	case context.Canceled:
+		b.abandoned()
+	default:
+		b.succeeded()
+	}
+}
+
+func (b *breaker) succeeded() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *breaker) failed() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// abandoned forgets a call without counting it for or against the service
+func (b *breaker) abandoned() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.trial = false
+}
@@ -0,0 +1,226 @@
+package rpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nps5696/go-ninja/bus"
+	"github.com/nps5696/go-ninja/config"
+	"github.com/nps5696/go-ninja/rpc"
+	"github.com/nps5696/go-ninja/rpc/json2"
+)
+
+type countService struct {
+	sync.Mutex
+	calls int
+	delay time.Duration
+}
+
+// Count replies with the number of times it has been called, after the service's delay
+func (s *countService) Count() (*int, error) {
+	s.Lock()
+	s.calls++
+	calls := s.calls
+	s.Unlock()
+
+	time.Sleep(s.delay)
+	return &calls, nil
+}
+
+func (s *countService) called() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.calls
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	service := &countService{}
+	b, _ := serve(t, "TestIdempotencyKey", service, []string{"count"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	replies := make(chan string, 10)
+	b.Subscribe(serviceTopic+"/reply", func(topic string, payload []byte) {
+		replies <- string(payload)
+	})
+
+	// every request with the same key gets the result of the first, which is the only one served
+	request := []byte(`{"jsonrpc":"2.0","id":"1","method":"count","idempotencyKey":"abc"}`)
+	for i := 0; i < 3; i++ {
+		b.Publish(serviceTopic, request)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case reply := <-replies:
+			var res struct {
+				Result int `json:"result"`
+			}
+			if err := json.Unmarshal([]byte(reply), &res); err != nil || res.Result != 1 {
+				t.Errorf("Expected the result of the first request, got %s", reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for reply %d", i+1)
+		}
+	}
+
+	if calls := service.called(); calls != 1 {
+		t.Errorf("Expected the method to be called once, it was called %d times", calls)
+	}
+
+	// a different key is another call
+	b.Publish(serviceTopic, []byte(`{"jsonrpc":"2.0","id":"2","method":"count","idempotencyKey":"def"}`))
+	select {
+	case <-replies:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the reply")
+	}
+	if calls := service.called(); calls != 2 {
+		t.Errorf("Expected the method to have been called twice, it was called %d times", calls)
+	}
+}
+
+func TestCallWithRetry(t *testing.T) {
+	// the first attempt times out while the method is still running, and the second is given its result
+	service := &countService{delay: time.Millisecond * 150}
+	b, _ := serve(t, "TestCallWithRetry", service, []string{"count"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+
+	var reply int
+	if err := client.CallWithRetry(serviceTopic, "count", nil, &reply, time.Millisecond*100, rpc.RetryPolicy{Attempts: 3}); err != nil || reply != 1 {
+		t.Fatalf("Expected reply 1, got %d (error %v)", reply, err)
+	}
+	if calls := service.called(); calls != 1 {
+		t.Errorf("Expected the method to be called once, it was called %d times", calls)
+	}
+}
+
+func TestCallWithRetryLateReply(t *testing.T) {
+	b, _ := bus.ConnectMemoryBus("TestCallWithRetryLateReply", "server")
+	defer b.Destroy()
+
+	// each attempt is answered with its number. The reply to the first arrives after the second has
+	// been sent, but before its reply, and is ignored.
+	var attempts int32
+	b.Subscribe(serviceTopic, func(topic string, payload []byte) {
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.Unmarshal(payload, &req)
+
+		attempt := atomic.AddInt32(&attempts, 1)
+		reply := func() {
+			b.Publish(serviceTopic+"/reply", []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":%d}`, req.ID, attempt)))
+		}
+		if attempt == 1 {
+			time.AfterFunc(time.Millisecond*130, reply)
+		} else {
+			time.AfterFunc(time.Millisecond*80, reply)
+		}
+	})
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+
+	var reply int
+	if err := client.CallWithRetry(serviceTopic, "count", nil, &reply, time.Millisecond*100, rpc.RetryPolicy{Attempts: 3}); err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	if reply != 2 {
+		t.Errorf("Expected the reply to the second attempt, got %d", reply)
+	}
+}
+
+type hangService struct {
+	sync.Mutex
+	hang    bool
+	calls   int
+	release chan bool
+}
+
+// Work doesn't reply until the service is released, if it is hanging
+func (s *hangService) Work() error {
+	s.Lock()
+	s.calls++
+	hang := s.hang
+	s.Unlock()
+
+	if hang {
+		<-s.release
+	}
+	return nil
+}
+
+func (s *hangService) setHang(hang bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.hang = hang
+}
+
+func (s *hangService) called() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.calls
+}
+
+func TestBreaker(t *testing.T) {
+	os.Setenv("sphere_rpc_breaker_failures", "2")
+	os.Setenv("sphere_rpc_breaker_cooldown", "200ms")
+	config.MustRefresh()
+	defer func() {
+		os.Unsetenv("sphere_rpc_breaker_failures")
+		os.Unsetenv("sphere_rpc_breaker_cooldown")
+		config.MustRefresh()
+	}()
+
+	service := &hangService{hang: true, release: make(chan bool)}
+	b, _ := serve(t, "TestBreaker", service, []string{"work"}, rpc.ServiceOptions{Ordering: rpc.Parallel})
+	defer b.Destroy()
+	defer close(service.release)
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+
+	call := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		return client.CallContext(ctx, serviceTopic, "work", nil, nil)
+	}
+
+	// the breaker opens after two timeouts in a row, and calls fail without being sent
+	for i := 0; i < 2; i++ {
+		if err := call(); err != context.DeadlineExceeded {
+			t.Fatalf("Expected the call to time out, got %v", err)
+		}
+	}
+	if err := call(); err != rpc.ErrCircuitOpen {
+		t.Fatalf("Expected ErrCircuitOpen, got %v", err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if calls := service.called(); calls != 2 {
+		t.Errorf("Expected the service to have been called twice, it was called %d times", calls)
+	}
+
+	// after the cooldown a single call is let through, and opens it again if it times out too
+	time.Sleep(time.Millisecond * 200)
+	if err := call(); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the trial call to time out, got %v", err)
+	}
+	if err := call(); err != rpc.ErrCircuitOpen {
+		t.Fatalf("Expected ErrCircuitOpen after the trial failed, got %v", err)
+	}
+
+	// once the service has recovered, the trial call closes it
+	service.setHang(false)
+	time.Sleep(time.Millisecond * 250)
+	for i := 0; i < 3; i++ {
+		if err := call(); err != nil {
+			t.Fatalf("Expected the call to succeed once the service recovered, got %v", err)
+		}
+	}
+}
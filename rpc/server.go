@@ -7,12 +7,15 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/nps5696/go-ninja/bus"
+	"github.com/nps5696/go-ninja/config"
 	"github.com/nps5696/go-ninja/schemas"
 	"github.com/ninjasphere/redigo/redis"
 )
@@ -43,24 +46,78 @@ type CodecRequest interface {
 	WriteError(c bus.Bus, err error)
 }
 
+// ReplyRouter is implemented by CodecRequests that can send their response somewhere other than
+// the codec's default reply topic. It is used to answer MQTT 5 requests on their response topic.
+type ReplyRouter interface {
+	// SetReply sets the topic the response is published to, and the properties it is sent with
+	SetReply(topic string, properties *bus.Properties)
+}
+
+// DeadlineReader is implemented by CodecRequests that can carry the time the caller will give up
+// waiting for the response.
+type DeadlineReader interface {
+	// Deadline returns the caller's deadline, and false if it didn't give one
+	Deadline() (time.Time, bool)
+}
+
+// RequestReader is implemented by CodecRequests that can describe the request beyond its method
+// and params, for methods that ask for an *rpc.Message.
+type RequestReader interface {
+	// ReadMessage fills in the request id, the time it was sent and the caller, where known. A
+	// request from a batch may replace the Payload with its own part of it.
+	ReadMessage(message *Message)
+}
+
+// ProgressWriter is implemented by CodecRequests that can send updates on their progress before the
+// response
+type ProgressWriter interface {
+	// WriteProgress sends an update, if the caller asked for them
+	WriteProgress(c bus.Bus, update interface{})
+}
+
+// BatchRequest is implemented by CodecRequests holding several requests sent together. Each is served
+// in turn, and the responses are sent together once all have been.
+type BatchRequest interface {
+	// Requests returns the requests in the batch
+	Requests() []CodecRequest
+	// Flush sends the responses written to the requests in the batch
+	Flush(c bus.Bus)
+}
+
 // ----------------------------------------------------------------------------
 // Server
 // ----------------------------------------------------------------------------
 
-// NewServer returns a new RPC server.
+// NewServer returns a new RPC server. At most rpc.concurrency requests (from the config) to Parallel
+// services are served at once, or any number if it is less than one.
+//
+// The results of requests carrying an idempotency key are kept for rpc.idempotency.ttl (5m), for at
+// most rpc.idempotency.size (1000) keys. A request with a new key is refused with ErrBusy while that
+// many are still being served.
 func NewServer(client bus.Bus, codec Codec) *Server {
-	return &Server{
-		client:   client,
-		codec:    codec,
-		services: new(serviceMap),
+	server := &Server{
+		client:    client,
+		codec:     codec,
+		services:  new(serviceMap),
+		queueSize: config.Int(100, "rpc", "queueSize"),
+		replies:   newReplyCache(config.Duration(time.Minute*5, "rpc", "idempotency", "ttl"), config.Int(1000, "rpc", "idempotency", "size")),
 	}
+
+	if concurrency := config.Int(16, "rpc", "concurrency"); concurrency > 0 {
+		server.workers = make(chan struct{}, concurrency)
+	}
+
+	return server
 }
 
 // Server serves registered RPC services using registered codecs.
 type Server struct {
-	client   bus.Bus
-	codec    Codec
-	services *serviceMap
+	client    bus.Bus
+	codec     Codec
+	services  *serviceMap
+	workers   chan struct{} // holds a value for each request being served
+	queueSize int
+	replies   *replyCache
 }
 
 type ExportedService struct {
@@ -68,6 +125,7 @@ type ExportedService struct {
 	topic   string
 	server  *Server
 	schema  string
+	codec   Codec
 }
 
 func (s *ExportedService) SendEvent(event string, payload ...interface{}) error {
@@ -108,7 +166,13 @@ func (s *ExportedService) SendEvent(event string, payload ...interface{}) error
 		}
 	}
 
-	return s.server.SendNotification(s.topic+"/event/"+event, payload...)
+	// announcements are how callers learn which codec the service uses, so always use the server's own
+	codec := s.codec
+	if event == "announce" {
+		codec = s.server.codec
+	}
+
+	return codec.SendNotification(s.server.client, s.topic+"/event/"+event, payload...)
 }
 
 // RegisterService adds a new service to the server.
@@ -121,23 +185,53 @@ func (s *ExportedService) SendEvent(event string, payload ...interface{}) error
 //    - The receiver is exported (begins with an upper case letter) or local
 //      (defined in the package registering the service).
 //    - The method name is exported.
-//    - The method's first argument is *mqtt.Message
+//    - The method's first argument may be a context.Context, which is cancelled when the caller's
+//      deadline passes
+//    - The next may be an *rpc.Message, describing the request and who it came from, and through
+//      which updates on a long running request's progress can be sent
 //    - If there is a second argument (the RPC params value) it must be exported and a pointer
 //    - If there is a return value, it must be first, exported and a pointer
 //    - The method's last return value is an error
 //
 // All other methods are ignored.
+//
+// Requests are served one at a time, in the order they arrive, unless the receiver has a
+// GetRPCOptions() method returning other ServiceOptions, e.g. to have them served in Parallel.
 func (s *Server) RegisterService(receiver interface{}, topic string, schema string) (service *ExportedService, err error) {
+	options := ServiceOptions{}
+	if receiver, ok := receiver.(optionsService); ok {
+		options = receiver.GetRPCOptions()
+	}
+	return s.RegisterServiceWithOptions(receiver, topic, schema, options)
+}
 
-	_, err = s.client.Subscribe(topic, func(topic string, payload []byte) {
-		s.serveRequest(topic, payload)
-	})
+// RegisterServiceWithOptions adds a new service to the server, as RegisterService does, choosing how
+// its requests are scheduled and encoded.
+func (s *Server) RegisterServiceWithOptions(receiver interface{}, topic string, schema string, options ServiceOptions) (service *ExportedService, err error) {
 
+	methods, err := schemas.GetServiceMethods(schema)
 	if err != nil {
 		return nil, err
 	}
 
-	methods, err := schemas.GetServiceMethods(schema)
+	return s.registerService(receiver, topic, schema, methods, options)
+}
+
+// registerService exports the given methods of a service, and starts serving requests to them
+func (s *Server) registerService(receiver interface{}, topic string, schema string, methods []string, options ServiceOptions) (service *ExportedService, err error) {
+
+	dispatcher := newDispatcher(s, options)
+
+	if mqtt, ok := s.client.(bus.PropertiesBus); ok {
+		_, err = mqtt.SubscribeWithProperties(topic, bus.SubscribeOptions{}, func(topic string, payload []byte, properties *bus.Properties) {
+			dispatcher.dispatch(topic, payload, properties)
+		})
+	} else {
+		_, err = s.client.Subscribe(topic, func(topic string, payload []byte) {
+			dispatcher.dispatch(topic, payload, nil)
+		})
+	}
+
 	if err != nil {
 		return nil, err
 	}
@@ -150,7 +244,35 @@ func (s *Server) RegisterService(receiver interface{}, topic string, schema stri
 		exportedMethodsLower = append(exportedMethodsLower, lowerFirst(m))
 	}
 
-	return &ExportedService{Methods: exportedMethodsLower, topic: topic, server: s, schema: schema}, err
+	return &ExportedService{Methods: exportedMethodsLower, topic: topic, server: s, schema: schema, codec: dispatcher.codec}, err
+}
+
+// newMessage describes a request, with what the codec knows of it. The caller may also be named in
+// the MQTT 5 "caller" user property.
+func (s *Server) newMessage(codecReq CodecRequest, topic string, payload []byte, properties *bus.Properties) *Message {
+	message := &Message{
+		Payload: payload,
+		Topic:   topic,
+	}
+
+	if reader, ok := codecReq.(RequestReader); ok {
+		reader.ReadMessage(message)
+	}
+
+	if writer, ok := codecReq.(ProgressWriter); ok {
+		message.progress = func(update interface{}) {
+			writer.WriteProgress(s.client, update)
+		}
+	}
+
+	if properties != nil {
+		message.UserProperties = properties.UserProperties
+		if message.Caller == "" {
+			message.Caller = properties.UserProperties["caller"]
+		}
+	}
+
+	return message
 }
 
 func lowerFirst(s string) string {
@@ -174,24 +296,78 @@ func (s *Server) HasMethod(topic string, method string) bool {
 	return false
 }
 
+// Message describes the request a method is serving. Methods that take an *rpc.Message are given
+// one, e.g. to see which of several topics a request arrived on, or to audit who made it.
 type Message struct {
-	Payload []byte
-	Topic   string
+	Payload []byte    // The raw request
+	Topic   string    // The topic the request arrived on
+	ID      string    // The request id, empty for notifications
+	Time    time.Time // When the caller sent the request, zero if it didn't say
+	Caller  string    // Who sent the request, empty if it didn't say
+
+	// UserProperties are the MQTT 5 user properties sent with the request, if any
+	UserProperties map[string]string
+
+	progress func(update interface{})
 }
 
-// ServeRequest handles an incoming Json-RPC MQTT message
-func (s *Server) serveRequest(topic string, payload []byte) {
+// Progress sends an update on a long running request to the caller, before the response. It does
+// nothing unless the caller asked for them.
+func (m *Message) Progress(update interface{}) {
+	if m.progress != nil {
+		m.progress(update)
+	}
+}
+
+// newCodecRequest decodes a request, and routes its reply to the MQTT 5 response topic if it named one
+func (s *Server) newCodecRequest(codec Codec, topic string, payload []byte, properties *bus.Properties) (CodecRequest, error) {
+	codecReq, err := codec.NewRequest(topic, payload)
+
+	if router, ok := codecReq.(ReplyRouter); ok && properties != nil && properties.ResponseTopic != "" {
+		router.SetReply(properties.ResponseTopic, &bus.Properties{
+			CorrelationData: properties.CorrelationData,
+		})
+	}
+
+	return codecReq, err
+}
+
+// refuseRequest answers a request with an error, without serving it
+func (s *Server) refuseRequest(codec Codec, topic string, payload []byte, properties *bus.Properties, reason error) {
+	codecReq, err := s.newCodecRequest(codec, topic, payload, properties)
+	if err != nil {
+		reason = err
+	}
+	codecReq.WriteError(s.client, reason)
+}
+
+// ServeRequest handles an incoming Json-RPC MQTT message. If the request came with MQTT 5 properties
+// naming a response topic, the response is sent there along with the request's correlation data.
+func (s *Server) serveRequest(codec Codec, topic string, payload []byte, properties *bus.Properties) {
 
 	log.Debugf("Serving request to %s", topic)
 
-	// Create a new codec request.
-	codecReq, err := s.codec.NewRequest(topic, payload)
+	codecReq, err := s.newCodecRequest(codec, topic, payload, properties)
 
 	if err != nil {
 		codecReq.WriteError(s.client, err)
 		return
 	}
 
+	if batch, ok := codecReq.(BatchRequest); ok {
+		for _, req := range batch.Requests() {
+			s.serveCodecRequest(topic, payload, properties, req)
+		}
+		batch.Flush(s.client)
+		return
+	}
+
+	s.serveCodecRequest(topic, payload, properties, codecReq)
+}
+
+// serveCodecRequest calls the method a request is for, and writes its response
+func (s *Server) serveCodecRequest(topic string, payload []byte, properties *bus.Properties, codecReq CodecRequest) {
+
 	// Get service method to be called.
 	method, errMethod := codecReq.Method()
 	if errMethod != nil {
@@ -204,6 +380,59 @@ func (s *Server) serveRequest(topic string, payload []byte) {
 		codecReq.WriteError(s.client, errGet)
 		return
 	}
+
+	// There's no point starting work that the caller has already given up on
+	ctx := context.Background()
+	if reader, ok := codecReq.(DeadlineReader); ok {
+		if deadline, ok := reader.Deadline(); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+
+			if ctx.Err() != nil {
+				log.Infof("Not calling %s on %s, the caller's deadline has passed", method, topic)
+				codecReq.WriteError(s.client, ctx.Err())
+				return
+			}
+		}
+	}
+
+	// A repeated attempt at a call we have served, or are serving, gets the same result
+	var cached *cachedReply
+	if reader, ok := codecReq.(IdempotencyKeyReader); ok && reader.IdempotencyKey() != "" {
+		var first bool
+		var err error
+		cached, first, err = s.replies.start(topic + "#" + method + "#" + reader.IdempotencyKey())
+		if err != nil {
+			log.Warningf("Refusing request for %s on %s, too many are being served to remember their results", method, topic)
+			codecReq.WriteError(s.client, err)
+			return
+		}
+		if !first {
+			select {
+			case <-cached.done:
+				log.Debugf("Answering repeated request for %s on %s without calling it again", method, topic)
+				s.writeResult(codecReq, cached.reply, cached.err)
+			case <-ctx.Done():
+				// the caller has given up on this attempt, and will have tried again if it is going to
+				log.Debugf("Gave up waiting to answer repeated request for %s on %s: %s", method, topic, ctx.Err())
+			}
+			return
+		}
+	}
+
+	reply, errResult := s.call(ctx, codecReq, serviceSpec, methodSpec, topic, payload, properties)
+
+	if cached != nil {
+		s.replies.finish(cached, reply, errResult)
+	}
+
+	s.writeResult(codecReq, reply, errResult)
+}
+
+// call decodes a request's args, and calls its method
+func (s *Server) call(ctx context.Context, codecReq CodecRequest, serviceSpec *service, methodSpec *serviceMethod, topic string, payload []byte, properties *bus.Properties) (interface{}, error) {
+
 	// Decode the args.
 	var args reflect.Value
 	if methodSpec.argsType != nil {
@@ -214,8 +443,7 @@ func (s *Server) serveRequest(topic string, payload []byte) {
 		}
 
 		if errRead := codecReq.ReadRequest(args.Interface()); errRead != nil {
-			codecReq.WriteError(s.client, errRead)
-			return
+			return nil, errRead
 		}
 
 	}
@@ -225,12 +453,13 @@ func (s *Server) serveRequest(topic string, payload []byte) {
 		serviceSpec.rcvr,
 	}
 
-	/*
-		TODO: Allow the method to request an rpc.Message
-		reflect.ValueOf(&Message{
-			Payload: message.Payload(),
-			Topic:   topic,
-		}),*/
+	if methodSpec.hasContext {
+		params = append(params, reflect.ValueOf(ctx))
+	}
+
+	if methodSpec.hasRequest {
+		params = append(params, reflect.ValueOf(s.newMessage(codecReq, topic, payload, properties)))
+	}
 
 	if methodSpec.argsType != nil {
 		if methodSpec.argsType.Kind() == reflect.Ptr {
@@ -264,19 +493,17 @@ func (s *Server) serveRequest(topic string, payload []byte) {
 		errResult = errInter.(error)
 	}
 
-	var reply reflect.Value
 	if methodSpec.replyType != nil {
-		reply = retVals[0]
+		return retVals[0].Interface(), errResult
 	}
+	return nil, errResult
+}
 
-	// Encode the response.
-	if errResult == nil {
-		if methodSpec.replyType != nil {
-			codecReq.WriteResponse(s.client, reply.Interface())
-		} else {
-			codecReq.WriteResponse(s.client, nil)
-		}
+// writeResult encodes the response to a request
+func (s *Server) writeResult(codecReq CodecRequest, reply interface{}, err error) {
+	if err == nil {
+		codecReq.WriteResponse(s.client, reply)
 	} else {
-		codecReq.WriteError(s.client, errResult)
+		codecReq.WriteError(s.client, err)
 	}
 }
@@ -0,0 +1,81 @@
+package rpc_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nps5696/go-ninja/rpc"
+	"github.com/nps5696/go-ninja/rpc/json2"
+)
+
+type messageService struct {
+	messages chan *rpc.Message
+}
+
+func (s *messageService) Greet(ctx context.Context, m *rpc.Message, name *string) (*string, error) {
+	s.messages <- m
+	reply := "hello " + *name
+	return &reply, nil
+}
+
+func (s *messageService) Ping(m *rpc.Message) error {
+	s.messages <- m
+	return nil
+}
+
+func TestMessage(t *testing.T) {
+	service := &messageService{messages: make(chan *rpc.Message, 10)}
+	b, _ := serve(t, "TestMessage", service, []string{"greet", "ping"}, rpc.ServiceOptions{})
+	defer b.Destroy()
+
+	client := rpc.NewClient(b, json2.NewClientCodec())
+	client.Caller = "tester"
+
+	before := time.Now().Add(-time.Second)
+
+	var reply string
+	if err := client.CallWithTimeout(serviceTopic, "greet", "world", &reply, time.Second); err != nil || reply != "hello world" {
+		t.Fatalf("Expected reply %q, got %q (error %v)", "hello world", reply, err)
+	}
+
+	// the method is told about the request, after its context and before its params
+	m := <-service.messages
+	if m.Topic != serviceTopic {
+		t.Errorf("Expected the request to have arrived on %s, got %s", serviceTopic, m.Topic)
+	}
+	if m.Caller != "tester" {
+		t.Errorf("Expected the caller to be %q, got %q", "tester", m.Caller)
+	}
+	if m.ID == "" {
+		t.Errorf("Expected the request to have an id")
+	}
+	if m.Time.Before(before) {
+		t.Errorf("Expected the time the request was sent, got %s", m.Time)
+	}
+	if !strings.Contains(string(m.Payload), `"greet"`) {
+		t.Errorf("Expected the raw request, got %s", m.Payload)
+	}
+
+	// a method may take just the message
+	if err := client.CallWithTimeout(serviceTopic, "ping", nil, nil, time.Second); err != nil {
+		t.Fatalf("Failed to call ping: %s", err)
+	}
+	if m := <-service.messages; m.Caller != "tester" {
+		t.Errorf("Expected the caller to be %q, got %q", "tester", m.Caller)
+	}
+
+	// the caller is known even when it doesn't wait for the reply
+	if err := client.Call(serviceTopic, "ping", nil); err != nil {
+		t.Fatalf("Failed to call ping: %s", err)
+	}
+	select {
+	case m := <-service.messages:
+		if m.Caller != "tester" {
+			t.Errorf("Expected the caller to be %q, got %q", "tester", m.Caller)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for ping to be called")
+	}
+}